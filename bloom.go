@@ -0,0 +1,75 @@
+package vuvuzela
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// A BloomFilter is a set of DialTags that may report false positives,
+// but never false negatives.
+type BloomFilter struct {
+	Bits []byte
+	// Hashes is the number of bits each tag sets.
+	Hashes uint32
+}
+
+// NewBloomFilter returns an empty filter sized for n tags with the
+// given false-positive rate.
+func NewBloomFilter(n int, falsePositive float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	bits := math.Ceil(-float64(n) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	if bits < 8 {
+		bits = 8
+	}
+	hashes := math.Round(bits / float64(n) * math.Ln2)
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &BloomFilter{
+		Bits:   make([]byte, (int(bits)+7)/8),
+		Hashes: uint32(hashes),
+	}
+}
+
+// positions calls fn with the bits of tag.  Each bit comes from its own
+// eight bytes of a hash of the tag and a counter.  Double hashing would
+// be cheaper, but in a small filter its steps cycle through only a few
+// bits, which makes false positives far more likely than the filter was
+// sized for.
+func (f *BloomFilter) positions(tag *DialTag, fn func(bit uint64)) {
+	m := uint64(len(f.Bits)) * 8
+	var in [len(DialTag{}) + 4]byte
+	copy(in[:], tag[:])
+	var h [sha256.Size]byte
+	for i := uint32(0); i < f.Hashes; i++ {
+		j := i % (sha256.Size / 8)
+		if j == 0 {
+			binary.BigEndian.PutUint32(in[len(DialTag{}):], i)
+			h = sha256.Sum256(in[:])
+		}
+		fn(binary.BigEndian.Uint64(h[j*8:]) % m)
+	}
+}
+
+func (f *BloomFilter) Add(tag *DialTag) {
+	f.positions(tag, func(bit uint64) {
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	})
+}
+
+// Test reports whether tag may be in the filter.
+func (f *BloomFilter) Test(tag *DialTag) bool {
+	if len(f.Bits) == 0 {
+		return true
+	}
+	in := true
+	f.positions(tag, func(bit uint64) {
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			in = false
+		}
+	})
+	return in
+}
@@ -0,0 +1,167 @@
+package vuvuzela
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/crypto/onionbox"
+)
+
+func randomTag() DialTag {
+	var tag DialTag
+	rand.Read(tag[:])
+	return tag
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 2000
+	const rate = 0.01
+	f := NewBloomFilter(n, rate)
+	tags := make([]DialTag, n)
+	for i := range tags {
+		tags[i] = randomTag()
+		f.Add(&tags[i])
+	}
+	for i := range tags {
+		if !f.Test(&tags[i]) {
+			t.Fatalf("tag %d is missing from the filter", i)
+		}
+	}
+
+	const trials = 20000
+	positives := 0
+	for i := 0; i < trials; i++ {
+		tag := randomTag()
+		if f.Test(&tag) {
+			positives++
+		}
+	}
+	if positives > trials*rate*2 {
+		t.Fatalf("%d false positives in %d trials, want about %d", positives, trials, int(trials*rate))
+	}
+}
+
+func TestKeyDialTag(t *testing.T) {
+	alicePublic, alicePrivate, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPublic, bobPrivate, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolPublic, carolPrivate, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := KeyDialTag(bobPublic, alicePrivate, 1)
+	if KeyDialTag(alicePublic, bobPrivate, 1) != tag {
+		t.Fatalf("alice and bob get different tags")
+	}
+	if KeyDialTag(bobPublic, alicePrivate, 2) == tag {
+		t.Fatalf("tag does not change with the round")
+	}
+	if KeyDialTag(bobPublic, carolPrivate, 1) == tag || KeyDialTag(carolPublic, bobPrivate, 1) == tag {
+		t.Fatalf("carol gets alice and bob's tag")
+	}
+}
+
+// TestSmallBloomFilter checks the false-positive rate of filters that
+// hold a single tag, as the filters of nearly empty buckets do.
+func TestSmallBloomFilter(t *testing.T) {
+	const rate = 1e-3
+	const trials = 20000
+	positives := 0
+	for i := 0; i < trials; i++ {
+		f := NewBloomFilter(1, rate)
+		tag := randomTag()
+		f.Add(&tag)
+		other := randomTag()
+		if f.Test(&other) {
+			positives++
+		}
+	}
+	if positives > trials*rate*4 {
+		t.Fatalf("%d false positives in %d one-tag filters, want about %d", positives, trials, int(trials*rate))
+	}
+}
+
+// TestBloomBandwidth compares what a client downloads when it gets its
+// whole bucket with what it downloads when it gets a filter, and only
+// fetches the bucket when the filter matches.
+func TestBloomBandwidth(t *testing.T) {
+	route := []string{"last"}
+	pki, services, client := newDialServers(t, route, 1)
+	last := services[0]
+	ctx := context.Background()
+
+	const round = 1
+	if err := NewDialRound(ctx, client, round, 0, route, 1); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	alicePublic, alicePrivate, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPublic, bobPrivate, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const others = 1000
+	var onions [][]byte
+	for i := 0; i <= others; i++ {
+		ex := &DialExchange{Bucket: 1, Tag: randomTag()}
+		rand.Read(ex.EncryptedIntro[:])
+		if i == 0 {
+			// alice dials bob
+			ex.Tag = KeyDialTag(bobPublic, alicePrivate, round)
+		}
+		onion, _ := onionbox.Seal(ex.Marshal(), ForwardNonce(round), pki.ServerKeys(route).Keys())
+		onions = append(onions, onion)
+	}
+	if err := RunDialRound(ctx, client, round, onions); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+
+	buckets, err := dialBuckets(last, round)
+	if err != nil {
+		t.Fatalf("Buckets: %s", err)
+	}
+	full := len(buckets[0]) * SizeEncryptedIntro
+
+	filters := new(DialFiltersResult)
+	if err := last.Filters(&DialFiltersArgs{Round: round, FalsePositive: 0.01}, filters); err != nil {
+		t.Fatalf("Filters: %s", err)
+	}
+	if filters.Sizes[0] != others+1 {
+		t.Fatalf("bucket has %d intros, want %d", filters.Sizes[0], others+1)
+	}
+	tag := KeyDialTag(alicePublic, bobPrivate, round)
+	if !filters.Filters[0].Test(&tag) {
+		t.Fatalf("bob does not find alice's tag in the filter")
+	}
+
+	// Later calls get the same filters instead of building them again.
+	again := new(DialFiltersResult)
+	if err := last.Filters(&DialFiltersArgs{Round: round, FalsePositive: 0.01}, again); err != nil {
+		t.Fatalf("Filters: %s", err)
+	}
+	if again.Filters[0] != filters.Filters[0] {
+		t.Fatalf("Filters built the filters again")
+	}
+	fetched := new(DialFetchResult)
+	if err := last.Fetch(&DialFetchArgs{Round: round, Bucket: 1}, fetched); err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if len(fetched.Intros) != len(buckets[0]) {
+		t.Fatalf("fetched %d intros, want the bucket's %d", len(fetched.Intros), len(buckets[0]))
+	}
+
+	// Clients nobody dialed only download the filter.
+	filter := len(filters.Filters[0].Bits)
+	t.Logf("whole bucket: %d bytes, filter: %d bytes", full, filter)
+	if filter*10 > full {
+		t.Fatalf("filter takes %d bytes, want well under the bucket's %d", filter, full)
+	}
+}
@@ -1,6 +1,7 @@
 package vuvuzela
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,6 +25,13 @@ func (k *BoxKey) String() string {
 	return base32.EncodeToString(k[:])
 }
 
+// Fingerprint returns a short digest of the key, for comparing keys
+// without sending them.
+func (k *BoxKey) Fingerprint() string {
+	sum := sha256.Sum256(k[:])
+	return base32.EncodeToString(sum[:10])
+}
+
 func KeyFromString(s string) (*BoxKey, error) {
 	key := new(BoxKey)
 	b, err := base32.DecodeString(s)
@@ -0,0 +1,87 @@
+package vuvuzela
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// Compact encodings of the RPC arguments and replies that carry onion
+// batches, used when servers talk over vrpc.BinaryCodec.  Everything else
+// falls back to gob.
+
+var errShortArgs = errors.New("short vrpc message")
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errShortArgs
+	}
+	return x, data[n:], nil
+}
+
+func readVarint(data []byte) (int64, []byte, error) {
+	x, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, nil, errShortArgs
+	}
+	return x, data[n:], nil
+}
+
+func (args ConvoAddArgs) AppendVRPC(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(args.Round))
+	buf = binary.AppendVarint(buf, int64(args.Offset))
+	return vrpc.AppendBatch(buf, args.Onions)
+}
+
+func (args *ConvoAddArgs) UnmarshalVRPC(data []byte) error {
+	round, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	offset, data, err := readVarint(data)
+	if err != nil {
+		return err
+	}
+	onions, _, err := vrpc.ReadBatch(data)
+	if err != nil {
+		return err
+	}
+	args.Round = uint32(round)
+	args.Offset = int(offset)
+	args.Onions = onions
+	return nil
+}
+
+func (result ConvoGetResult) AppendVRPC(buf []byte) []byte {
+	return vrpc.AppendBatch(buf, result.Onions)
+}
+
+func (result *ConvoGetResult) UnmarshalVRPC(data []byte) error {
+	onions, _, err := vrpc.ReadBatch(data)
+	if err != nil {
+		return err
+	}
+	result.Onions = onions
+	return nil
+}
+
+func (args DialAddArgs) AppendVRPC(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(args.Round))
+	return vrpc.AppendBatch(buf, args.Onions)
+}
+
+func (args *DialAddArgs) UnmarshalVRPC(data []byte) error {
+	round, data, err := readUvarint(data)
+	if err != nil {
+		return err
+	}
+	onions, _, err := vrpc.ReadBatch(data)
+	if err != nil {
+		return err
+	}
+	args.Round = uint32(round)
+	args.Onions = onions
+	return nil
+}
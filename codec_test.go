@@ -0,0 +1,99 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+// vrpcMessage is one of the RPC arguments or replies with a compact
+// encoding.
+type vrpcMessage interface {
+	AppendVRPC(buf []byte) []byte
+	UnmarshalVRPC(data []byte) error
+}
+
+func randomOnions(n, size int) [][]byte {
+	onions := make([][]byte, n)
+	for i := range onions {
+		onions[i] = make([]byte, size)
+		rand.Read(onions[i])
+	}
+	return onions
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	onions := randomOnions(20, 100)
+	onions[3] = nil
+	tests := []struct {
+		in  vrpcMessage
+		out vrpcMessage
+	}{
+		{&ConvoAddArgs{Round: 1<<31 | 7, Offset: 4000, Onions: onions}, new(ConvoAddArgs)},
+		{&ConvoAddArgs{Round: 0, Offset: 0}, new(ConvoAddArgs)},
+		{&ConvoGetResult{Onions: onions}, new(ConvoGetResult)},
+		{&ConvoGetResult{}, new(ConvoGetResult)},
+		{&DialAddArgs{Round: 123456, Onions: onions}, new(DialAddArgs)},
+		{&DialAddArgs{Round: 1}, new(DialAddArgs)},
+	}
+	for _, test := range tests {
+		data := test.in.AppendVRPC(nil)
+		if err := test.out.UnmarshalVRPC(data); err != nil {
+			t.Fatalf("%T: UnmarshalVRPC: %s", test.in, err)
+		}
+		if got, want := describeMessage(test.out), describeMessage(test.in); got != want {
+			t.Fatalf("%T: round trip gave %s, want %s", test.in, got, want)
+		}
+
+		// AppendVRPC appends.
+		prefix := []byte("prefix")
+		if buf := test.in.AppendVRPC(prefix); !bytes.Equal(buf[len(prefix):], data) {
+			t.Fatalf("%T: AppendVRPC does not append to its buffer", test.in)
+		}
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	onions := randomOnions(3, 16)
+	tests := []struct {
+		in  vrpcMessage
+		out func() vrpcMessage
+	}{
+		{&ConvoAddArgs{Round: 300, Offset: -2, Onions: onions}, func() vrpcMessage { return new(ConvoAddArgs) }},
+		{&ConvoGetResult{Onions: onions}, func() vrpcMessage { return new(ConvoGetResult) }},
+		{&DialAddArgs{Round: 300, Onions: onions}, func() vrpcMessage { return new(DialAddArgs) }},
+	}
+	for _, test := range tests {
+		data := test.in.AppendVRPC(nil)
+		for i := 0; i < len(data); i++ {
+			if err := test.out().UnmarshalVRPC(data[:i]); err == nil {
+				t.Fatalf("%T: UnmarshalVRPC accepted %d of %d bytes", test.in, i, len(data))
+			}
+		}
+	}
+}
+
+// describeMessage prints a message with nil and empty onions alike,
+// since the encoding does not tell them apart.
+func describeMessage(m vrpcMessage) string {
+	switch m := m.(type) {
+	case *ConvoAddArgs:
+		return fmt.Sprintf("round %d offset %d %s", m.Round, m.Offset, describeOnions(m.Onions))
+	case *ConvoGetResult:
+		return describeOnions(m.Onions)
+	case *DialAddArgs:
+		return fmt.Sprintf("round %d %s", m.Round, describeOnions(m.Onions))
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+func describeOnions(onions [][]byte) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d onions:", len(onions))
+	for _, onion := range onions {
+		fmt.Fprintf(buf, " %x", onion)
+	}
+	return buf.String()
+}
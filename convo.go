@@ -1,9 +1,12 @@
 package vuvuzela
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
@@ -18,24 +21,58 @@ type ConvoService struct {
 	roundsMu sync.RWMutex
 	rounds   map[uint32]*ConvoRound
 
-	Idle *sync.Mutex
+	// Pipeline bounds the number of rounds in flight.  The mix server
+	// shares it with its DialService.
+	Pipeline *Pipeline
 
 	Laplace rand.Laplace
 
-	PKI        *PKI
-	ServerName string
-	PrivateKey *BoxKey
-	Client     *vrpc.Client
-  NextClients map[string]*vrpc.Client
-	SkipClient *vrpc.Client
+	PKI *PKI
+	// PKIStore, if set, supplies the PKI of each round's epoch in place
+	// of PKI.
+	PKIStore    *PKIStore
+	ServerName  string
+	PrivateKey  *BoxKey
+	NextClients map[string]*vrpc.Client
+	// Dial, if set, connects to a next server that is not in
+	// NextClients, such as one that joined after this server started.
+	Dial   func(address string) (*vrpc.Client, error)
+	nextMu sync.Mutex
+	// membership is the latest view passed to ConnectNext.
+	membership *Membership
 	LastServer bool
 
+	// Streaming sends rounds to the next server over a single stream
+	// (RunConvoRoundStream) instead of batched RPCs.
+	Streaming bool
+
+	// Timeout bounds how long Close waits on the next server.
+	// Zero means wait forever.
+	Timeout time.Duration
+
+	// RoundLifetime is how long a round may exist before it is aborted
+	// and its keys are erased.  Zero means rounds live until Delete.
+	RoundLifetime time.Duration
+
 	AccessCounts chan *AccessCount
 }
 
 type ConvoRound struct {
-	srv    *ConvoService
-	status convoStatus
+	srv     *ConvoService
+	status  convoStatus
+	created time.Time
+
+	// RPCs hold busy for reading while they use the round, so that it
+	// is not erased under them.
+	busy sync.RWMutex
+
+	// release gives the round's pipeline slot back.
+	release func()
+	// client is the connection to the next server while it holds this
+	// round, so that Delete can pass on to it.  Guarded by roundsMu.
+	client *vrpc.Client
+	// pki is the PKI of the epoch the round was started in.
+	pki *PKI
 
 	// Include routing information in each round
 	route         []string
@@ -59,6 +96,7 @@ const (
 	convoRoundNew convoStatus = iota + 1
 	convoRoundOpen
 	convoRoundClosed
+	convoRoundAborted
 )
 
 type AccessCount struct {
@@ -69,8 +107,32 @@ type AccessCount struct {
 func InitConvoService(srv *ConvoService) {
 	srv.rounds = make(map[uint32]*ConvoRound)
 	srv.AccessCounts = make(chan *AccessCount, 8)
+	if srv.RoundLifetime > 0 {
+		go collectRounds(srv.RoundLifetime, srv.abortExpired)
+	}
+}
+
+// roundContext returns the context used for calls to the next server.
+func roundContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
 }
 
+// slotContext bounds how long NewRound waits for a pipeline slot: no
+// longer than the caller waits for NewRound, or else than the round
+// would live.  A round started after the caller gave up would hold its
+// slot until it expired.
+func slotContext(timeout, lifetime time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = lifetime
+	}
+	return roundContext(timeout)
+}
+
+// getRound returns the round with its busy lock held for reading; the
+// caller must call round.busy.RUnlock when done with it.
 func (srv *ConvoService) getRound(round uint32, expectedStatus convoStatus) (*ConvoRound, error) {
 	srv.roundsMu.RLock()
 	r, ok := srv.rounds[round]
@@ -78,32 +140,62 @@ func (srv *ConvoService) getRound(round uint32, expectedStatus convoStatus) (*Co
 	if !ok {
 		return nil, fmt.Errorf("round %d not found", round)
 	}
-	if r.status != expectedStatus {
-		return r, fmt.Errorf("round %d: status %v, expecting %v", round, r.status, expectedStatus)
+
+	r.busy.RLock()
+	srv.roundsMu.RLock()
+	status := r.status
+	srv.roundsMu.RUnlock()
+	if status != expectedStatus {
+		r.busy.RUnlock()
+		return nil, fmt.Errorf("round %d: status %v, expecting %v", round, status, expectedStatus)
 	}
 	return r, nil
 }
 
+// setStatus moves a round to its next status.  Statuses are read and
+// written under roundsMu because RPCs for several rounds, and several
+// RPCs for one round, run at the same time.
+func (srv *ConvoService) setStatus(round *ConvoRound, status convoStatus) {
+	srv.roundsMu.Lock()
+	round.status = status
+	srv.roundsMu.Unlock()
+}
+
 // NewRound RPC
 func (srv *ConvoService) NewRound(args *ConvoNewRoundArgs, _ *struct{}) error {
-	log.WithFields(log.Fields{"service": "convo", "rpc": "NewRound", "round": args.Round, "route": args.Route}).Info()
+	log.WithFields(log.Fields{"service": "convo", "rpc": "NewRound", "round": args.Round, "epoch": args.Epoch, "route": args.Route}).Info()
 
 	Round := args.Round
-	// wait for the service to become idle before starting a new round
-	// TODO temporary hack
-	srv.Idle.Lock()
+	pki, err := roundPKI(srv.PKI, srv.PKIStore, args.Epoch)
+	if err != nil {
+		return err
+	}
+	if err := pki.checkPosition(srv.ServerName, args.Route, srv.LastServer); err != nil {
+		return fmt.Errorf("round %d: %s", Round, err)
+	}
+	// wait for a free slot in the pipeline before starting a new round
+	ctx, cancel := slotContext(srv.Timeout, srv.RoundLifetime)
+	release, err := srv.Pipeline.AcquireContext(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("round %d: no free pipeline slot: %s", Round, err)
+	}
 	srv.roundsMu.Lock()
 	// TODO: What is defer?
 	defer srv.roundsMu.Unlock()
 
 	_, exists := srv.rounds[Round]
 	if exists {
+		release()
 		return fmt.Errorf("round %d already exists", Round)
 	}
 
 	round := &ConvoRound{
-		srv: srv,
-		route: args.Route,
+		srv:     srv,
+		created: time.Now(),
+		route:   args.Route,
+		release: release,
+		pki:     pki,
 	}
 	srv.rounds[Round] = round
 	// Add Cover Traffic
@@ -114,13 +206,8 @@ func (srv *ConvoService) NewRound(args *ConvoNewRoundArgs, _ *struct{}) error {
 		round.noise = make([][]byte, round.numFakeSingles+round.numFakeDoubles)
 
 		nonce := ForwardNonce(Round)
-		nextKeys := srv.PKI.NextServerKeys(srv.ServerName,
+		nextKeys := round.pki.NextServerKeys(srv.ServerName,
 			round.route).Keys()
-		// ServerKeys may change due to middle server failure
-		// TODO: May need lock
-		// One possible race condition
-		// Round N Close RPC :middle server fails. change server order
-		// Round N+1 Newround: read server order
 		round.noiseWg.Add(1)
 		go func() {
 			FillWithFakeSingles(round.noise[:round.numFakeSingles], nonce, nextKeys)
@@ -145,13 +232,14 @@ func (srv *ConvoService) Open(args *ConvoOpenArgs, _ *struct{}) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
 
 	round.numIncoming = args.NumIncoming
 	// shareKeys = round.numIncoming x *[32]byte
 	round.sharedKeys = make([]*[32]byte, round.numIncoming)
 	// incoming  = round.numIncoming x []byte
 	round.incoming = make([][]byte, round.numIncoming)
-	round.status = convoRoundOpen
+	srv.setStatus(round, convoRoundOpen)
 
 	return nil
 }
@@ -162,8 +250,7 @@ type ConvoAddArgs struct {
 	Onions [][]byte
 }
 
-// What does Add actually do?
-// Peel a batch of onions
+// Add peels a batch of onions for an open round.
 func (srv *ConvoService) Add(args *ConvoAddArgs, _ *struct{}) error {
 	log.WithFields(log.Fields{"service": "convo", "rpc": "Add", "round": args.Round, "onions": len(args.Onions)}).Debug()
 
@@ -171,28 +258,24 @@ func (srv *ConvoService) Add(args *ConvoAddArgs, _ *struct{}) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
+	return srv.add(round, args.Round, args.Offset, args.Onions)
+}
 
-	nonce := ForwardNonce(args.Round)
-	// Needs a correct view of server order
-	// How does the update propagate to the tail of the server chain?
-	// Head of the server chain may know the update of the server chain because of error propagation
-	// Tail of the server chain may only know the update when some server explicitly tell them
-	// Solution 1: Query entry server actively every round
-	// Solution 2: Passively informed by the previous server
-	// Solution 3: Include the path in the round information (May also apply to dynamic routing)
-	// TODO: Any security implication?
-	// Solution 4: Dynamic Membership from Raft?
-	expectedOnionSize := srv.PKI.IncomingOnionOverhead(
+// add peels a batch of onions that starts at offset in the round.
+func (srv *ConvoService) add(round *ConvoRound, Round uint32, offset int, onions [][]byte) error {
+	nonce := ForwardNonce(Round)
+	expectedOnionSize := round.pki.IncomingOnionOverhead(
 		srv.ServerName,
 		round.route) + SizeConvoExchange
 
-	if args.Offset+len(args.Onions) > round.numIncoming {
-		return fmt.Errorf("overflowing onions (offset=%d, onions=%d, incoming=%d)", args.Offset, len(args.Onions), round.numIncoming)
+	if offset+len(onions) > round.numIncoming {
+		return fmt.Errorf("overflowing onions (offset=%d, onions=%d, incoming=%d)", offset, len(onions), round.numIncoming)
 	}
 
 	// Deal with onions
-	for k, onion := range args.Onions {
-		i := args.Offset + k
+	for k, onion := range onions {
+		i := offset + k
 		round.sharedKeys[i] = new([32]byte)
 
 		if len(onion) == expectedOnionSize {
@@ -210,7 +293,7 @@ func (srv *ConvoService) Add(args *ConvoAddArgs, _ *struct{}) error {
 			}
 		} else {
 			// for debugging
-      log.WithFields(log.Fields{"round": args.Round, "offset": args.Offset,"expected size": expectedOnionSize,  "onions": len(args.Onions), "onion": k, "onionLen": len(onion)}).Error("bad onion size")
+      log.WithFields(log.Fields{"round": Round, "offset": offset,"expected size": expectedOnionSize,  "onions": len(onions), "onion": k, "onionLen": len(onion)}).Error("bad onion size")
 		}
 	}
 
@@ -243,6 +326,156 @@ func (srv *ConvoService) filterIncoming(round *ConvoRound) {
 	round.incomingIndex = incomingIndex
 }
 
+// NextClient returns the connection to the next server at address,
+// connecting to it first if need be.  The mix server's DialService uses
+// it too.
+func (srv *ConvoService) NextClient(address string) (*vrpc.Client, error) {
+	srv.nextMu.Lock()
+	defer srv.nextMu.Unlock()
+	if client := srv.NextClients[address]; client != nil {
+		return client, nil
+	}
+	if srv.Dial == nil || address == "" {
+		return nil, fmt.Errorf("no connection to %q", address)
+	}
+	client, err := srv.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if srv.NextClients == nil {
+		srv.NextClients = make(map[string]*vrpc.Client)
+	}
+	srv.NextClients[address] = client
+	return client, nil
+}
+
+// ConnectNext records m as the view of which servers are up and
+// connects to the servers at the next level that it lists, so that the
+// first round through a server that has just joined does not wait on
+// the connection.
+func (srv *ConvoService) ConnectNext(pki *PKI, m *Membership) {
+	srv.nextMu.Lock()
+	srv.membership = m
+	srv.nextMu.Unlock()
+
+	info := pki.Servers[srv.ServerName]
+	if info == nil || srv.LastServer {
+		return
+	}
+	for _, s := range m.Levels[info.Level+1] {
+		next := pki.Servers[s]
+		if next == nil {
+			continue
+		}
+		if _, err := srv.NextClient(next.Address); err != nil {
+			log.WithFields(log.Fields{"service": "convo", "call": "ConnectNext", "server": s}).Error(err)
+		}
+	}
+}
+
+// replicas returns the servers a round may go to in place of next:
+// next itself and the other servers at its level that share its key, so
+// that the round's onions open at any of them.  Servers that are up and
+// whose connection is healthy come first, and next comes first among
+// those, so a round only moves when it has to.
+func (srv *ConvoService) replicas(pki *PKI, next string) []string {
+	info := pki.Servers[next]
+	if info == nil || len(pki.ServerLevels) == 0 {
+		return []string{next}
+	}
+
+	srv.nextMu.Lock()
+	defer srv.nextMu.Unlock()
+	levels := pki.ServerLevels
+	if m := srv.membership; m != nil && m.PKIEpoch == pki.Epoch {
+		levels = m.Levels
+	}
+	candidates := []string{next}
+	up := map[string]bool{}
+	for _, s := range levels[info.Level] {
+		up[s] = true
+		other := pki.Servers[s]
+		if s != next && other != nil && *other.PublicKey == *info.PublicKey {
+			candidates = append(candidates, s)
+		}
+	}
+	down := func(s string) bool {
+		client := srv.NextClients[pki.Servers[s].Address]
+		return !up[s] || (client != nil && !client.Healthy())
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return !down(candidates[i]) && down(candidates[j])
+	})
+	return candidates
+}
+
+// forward runs round at the next server on its route and returns the
+// replies.  If the next server cannot be reached, the round fails over
+// to the other replicas at its level in turn; the replicas share the
+// level's key, so the same onions go to each.  The round's pipeline slot
+// is released once a next server has the round, or when all have failed.
+func (srv *ConvoService) forward(round *ConvoRound, Round uint32, outgoing [][]byte) ([][]byte, error) {
+	defer round.release()
+
+	i := round.pki.Index(srv.ServerName, round.route)
+	var err error
+	for _, next := range srv.replicas(round.pki, round.route[i+1]) {
+		route := append([]string(nil), round.route...)
+		route[i+1] = next
+
+		var replies [][]byte
+		replies, err = srv.forwardTo(round, Round, route, next, outgoing)
+		if err == nil {
+			return replies, nil
+		}
+		hop, _ := AsHopError(err)
+		if hop == nil || hop.Server != next || !hop.Retryable {
+			// the next server reported a failure of its own, or one
+			// further down the chain, which its replicas would not fix
+			return nil, err
+		}
+		log.WithFields(log.Fields{"service": "convo", "round": Round, "server": next}).Warnf("failing over: %s", hop.Cause)
+	}
+	return nil, err
+}
+
+func (srv *ConvoService) forwardTo(round *ConvoRound, Round uint32, route []string, next string, outgoing [][]byte) ([][]byte, error) {
+	client, err := srv.NextClient(round.pki.Servers[next].Address)
+	if err != nil {
+		return nil, BlameHop(round.pki, next, Round, &stageError{"NewRound", err})
+	}
+
+	ctx, cancel := roundContext(srv.Timeout)
+	defer cancel()
+	if err := NewConvoRound(ctx, client, Round, round.pki.Epoch, route); err != nil {
+		return nil, BlameHop(round.pki, next, Round, &stageError{"NewRound", err})
+	}
+	// The next server has the round, so this server can take another.
+	round.release()
+	srv.roundsMu.Lock()
+	round.client = client
+	srv.roundsMu.Unlock()
+
+	// Ask the next server in the chain to run convo round
+	// Previous Server --incoming--> this server --> outgoing --> Next Server
+	// len(incoming) != len(outgoing)
+	// because of added cover traffic
+	var replies [][]byte
+	if srv.Streaming {
+		replies, err = RunConvoRoundStream(ctx, client, Round, outgoing)
+	} else {
+		replies, err = RunConvoRound(ctx, client, Round, outgoing)
+	}
+	if err != nil {
+		return nil, BlameHop(round.pki, next, Round, err)
+	}
+	// A round that ran has already been deleted from the next server.
+	srv.roundsMu.Lock()
+	round.client = nil
+	srv.roundsMu.Unlock()
+	return replies, nil
+}
+
 func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 	log.WithFields(log.Fields{"service": "convo", "rpc": "Close", "round": Round}).Info()
 
@@ -250,6 +483,7 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
 
 	srv.filterIncoming(round)
 	if !srv.LastServer {
@@ -264,66 +498,11 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 		shuffler.Shuffle(outgoing)
 
 		// Critical Part for Fault Tolerance
-		// if next server is dead
-		// err will be returned
-    nextServer := srv.PKI.NextServer(srv.ServerName, srv.rounds[Round].route)
-    client :=  srv.NextClients[nextServer] 
-    if client != nil {
-      srv.Client = client
-    } else {
-      srv.Client = srv.SkipClient
-    }
-		if err := NewConvoRound(srv.Client, Round, srv.rounds[Round].route); err != nil {
-			// TODO: Catch specific type of error
-			nextServerName := 
-				srv.PKI.NextServerName(
-				srv.ServerName,
-				round.route)
-			log.Println("NewConvoRound: ", err)
-			// TODO: Only substitute next client before new round start
-			if srv.SkipClient != nil {
-				// Update server order
-				// TODO: Potential Race Condition
-				log.Println("Remove  ", nextServerName)
-				// SkipClient becomes new client
-				srv.Client = srv.SkipClient
-				//srv.SkipClient = nil				
-				// return connection error
-				srv.Idle.Unlock()
-				log.Println("unlock ", nextServerName)
-				// TODO: Better to Customize error type
-				return fmt.Errorf("NewConvoRound: %s", nextServerName)
-			} else {
-				// The entire system is down
-				// Differentiate from error with backup
-				srv.Idle.Unlock()
-				return fmt.Errorf("NewConvoRound: %s", err)	
-			}
-			
-		}
-		srv.Idle.Unlock()
-
-		// TODO: What is replies?
-		// Ask the next server in the chain to run convo round
-		// Previous Server --incoming--> this server --> outgoing --> Next Server
-		// len(incoming) != len(outgoing)
-		// because of added cover traffic
-
-		replies, err := RunConvoRound(srv.Client, Round, outgoing)
+		// if the next server is dead, the round fails over to another
+		// replica at its level
+		replies, err := srv.forward(round, Round, outgoing)
 		if err != nil {
-			//log.Println("RunConvoRound: %s", err)
-			// TODO: Abstract out to avoid duplicate		
-			if srv.SkipClient != nil {
-				// SkipClient becomes new client
-				srv.Client = srv.SkipClient
-				//srv.SkipClient = nil
-				return fmt.Errorf("RunConvoRound: %s", err)
-			} else {
-				// The entire system is down
-				// Defferentiate from error with backup
-				fmt.Errorf("RunConvoround: %s", err)			
-			}
-
+			return err
 		}
 
 		// Reverse operation
@@ -376,7 +555,7 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 				}
 			}
 		})
-		srv.Idle.Unlock()
+		round.release()
 
 		ac := &AccessCount{
 			Singles: singles,
@@ -388,7 +567,7 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 		}
 	}
 
-	round.status = convoRoundClosed
+	srv.setStatus(round, convoRoundClosed)
 	return nil
 }
 
@@ -410,62 +589,150 @@ func (srv *ConvoService) Get(args *ConvoGetArgs, result *ConvoGetResult) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
+
+	result.Onions = srv.get(round, args.Round, args.Offset, args.Count)
+	return nil
+}
 
-	nonce := BackwardNonce(args.Round)
-	outgoingOnionSize := srv.PKI.OutgoingOnionOverhead(
+// get seals the replies to count onions starting at offset in the round.
+func (srv *ConvoService) get(round *ConvoRound, Round uint32, offset int, count int) [][]byte {
+	nonce := BackwardNonce(Round)
+	outgoingOnionSize := round.pki.OutgoingOnionOverhead(
 		srv.ServerName,
 		round.route) + SizeEncryptedMessage
 
-	result.Onions = make([][]byte, args.Count)
-	for k := range result.Onions {
-		i := args.Offset + k
+	onions := make([][]byte, count)
+	for k := range onions {
+		i := offset + k
 
 		if v := round.incomingIndex[i]; v > -1 {
 			reply := round.replies[v]
 			onion := box.SealAfterPrecomputation(nil, reply, nonce, round.sharedKeys[i])
-			result.Onions[k] = onion
+			onions[k] = onion
 		}
-		if len(result.Onions[k]) != outgoingOnionSize {
+		if len(onions[k]) != outgoingOnionSize {
 			onion := make([]byte, outgoingOnionSize)
 			rand.Read(onion)
-			result.Onions[k] = onion
+			onions[k] = onion
 		}
 	}
 
-	return nil
+	return onions
 }
 
 func (srv *ConvoService) Delete(Round uint32, _ *struct{}) error {
 	log.WithFields(log.Fields{"service": "convo", "rpc": "Delete", "round": Round}).Info()
 
 	srv.roundsMu.Lock()
+	round := srv.rounds[Round]
 	delete(srv.rounds, Round)
+	var client *vrpc.Client
+	if round != nil {
+		client = round.client
+	}
 	srv.roundsMu.Unlock()
-	return nil
+	if round == nil {
+		return nil
+	}
+	// in case the round was abandoned before Close
+	round.release()
+	if client == nil {
+		return nil
+	}
+
+	// The round failed after the next server got it.
+	ctx, cancel := roundContext(srv.Timeout)
+	defer cancel()
+	return DeleteConvoRound(ctx, client, Round)
+}
+
+// abortExpired aborts the rounds created before deadline.  A round that
+// an RPC is still using is left for the next pass.
+func (srv *ConvoService) abortExpired(deadline time.Time) {
+	srv.roundsMu.RLock()
+	var expired []uint32
+	for n, r := range srv.rounds {
+		if r.created.Before(deadline) {
+			expired = append(expired, n)
+		}
+	}
+	srv.roundsMu.RUnlock()
+
+	for _, n := range expired {
+		srv.roundsMu.RLock()
+		round := srv.rounds[n]
+		srv.roundsMu.RUnlock()
+		if round == nil || !round.busy.TryLock() {
+			continue
+		}
+
+		srv.roundsMu.Lock()
+		status := round.status
+		round.status = convoRoundAborted
+		delete(srv.rounds, n)
+		srv.roundsMu.Unlock()
+
+		round.release()
+		round.erase()
+		round.busy.Unlock()
+
+		log.WithFields(log.Fields{"service": "convo", "round": n, "status": status, "age": time.Since(round.created)}).Warn("aborted expired round")
+	}
+}
+
+// erase zeroes the round's keys and messages.
+func (round *ConvoRound) erase() {
+	round.noiseWg.Wait()
+	for _, key := range round.sharedKeys {
+		if key != nil {
+			*key = [32]byte{}
+		}
+	}
+	for _, msgs := range [][][]byte{round.incoming, round.replies, round.noise} {
+		for _, msg := range msgs {
+			zero(msg)
+		}
+	}
+	round.sharedKeys = nil
+	round.incoming = nil
+	round.replies = nil
+	round.noise = nil
 }
 
 type ConvoNewRoundArgs struct {
 	Round       uint32
+	// Epoch is the PKI epoch the round uses.
+	Epoch       uint64
 	// TODO: Can be optimized by using server id
 	Route       []string
 }
 // RPC: ConvoService.NewRound
-func NewConvoRound(client *vrpc.Client, round uint32, route []string) error {
+func NewConvoRound(ctx context.Context, client *vrpc.Client, round uint32, epoch uint64, route []string) error {
 	newRoundArgs := &ConvoNewRoundArgs{
 		Round: round,
+		Epoch: epoch,
 		Route: route,
 	}
-	return client.Call("ConvoService.NewRound", newRoundArgs, nil)
+	return client.CallContext(ctx, "ConvoService.NewRound", newRoundArgs, nil)
 }
+
+// DeleteConvoRound deletes a round from client's server and from every
+// server after it that still holds the round because mixing it failed.
+func DeleteConvoRound(ctx context.Context, client *vrpc.Client, round uint32) error {
+	return client.CallContext(ctx, "ConvoService.Delete", round, nil)
+}
+
 // Ask the next server to run convo round
-func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte, error) {
+// Gives up when ctx is done; a *vrpc.TimeoutError means the deadline expired.
+func RunConvoRound(ctx context.Context, client *vrpc.Client, round uint32, onions [][]byte) ([][]byte, error) {
 	openArgs := &ConvoOpenArgs{
 		Round:       round,
 		NumIncoming: len(onions),
 	}
 	// First Call RPC Open
-	if err := client.Call("ConvoService.Open", openArgs, nil); err != nil {
-		return nil, fmt.Errorf("Open: %s", err)
+	if err := client.CallContext(ctx, "ConvoService.Open", openArgs, nil); err != nil {
+		return nil, &stageError{"Open", err}
 	}
 
 	// Handle onions concurrently
@@ -489,13 +756,13 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 	})
 
 	// TODO: What is calls?
-	if err := client.CallMany(calls); err != nil {
-		return nil, fmt.Errorf("Add: %s", err)
+	if err := client.CallManyContext(ctx, calls); err != nil {
+		return nil, &stageError{"Add", err}
 	}
 
 	// Call RPC Close
-	if err := client.Call("ConvoService.Close", round, nil); err != nil {
-		return nil, fmt.Errorf("Close: %s", err)
+	if err := client.CallContext(ctx, "ConvoService.Close", round, nil); err != nil {
+		return nil, &stageError{"Close", err}
 	}
 	
 
@@ -515,8 +782,8 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 		}
 	})
 
-	if err := client.CallMany(calls); err != nil {
-		return nil, fmt.Errorf("Get: %s", err)
+	if err := client.CallManyContext(ctx, calls); err != nil {
+		return nil, &stageError{"Get", err}
 	}
 
 	replies := make([][]byte, len(onions))
@@ -527,8 +794,8 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 		}
 	})
 
-	if err := client.Call("ConvoService.Delete", round, nil); err != nil {
-		return nil, fmt.Errorf("Delete: %s", err)
+	if err := client.CallContext(ctx, "ConvoService.Delete", round, nil); err != nil {
+		return nil, &stageError{"Delete", err}
 	}
 
 	return replies, nil
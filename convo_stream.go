@@ -0,0 +1,291 @@
+package vuvuzela
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"runtime"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"vuvuzela.io/concurrency"
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// ConvoRoundStream is the name of the vrpc stream that ConvoService
+// serves with ServeRoundStream.
+const ConvoRoundStream = "ConvoService.Round"
+
+// In streaming mode a round is a single exchange of frames:
+//
+//	upstream -> downstream: open (round, number of onions), then batches
+//	                        of onions until all of them are sent
+//	downstream -> upstream: batches of replies and then done, or an
+//	                        error
+//
+// The downstream server peels each batch as soon as it arrives and
+// deletes the round once the replies are sent, so no Open, Add, Close,
+// Get or Delete RPCs are needed after NewRound.
+//
+// Streaming only changes how a round travels between two servers.  A
+// server still has to hold every onion of the round before it can
+// shuffle them, so it mixes and forwards the round as a whole at Close,
+// and its peak memory per round is the same as with the RPCs.
+const (
+	frameOpen byte = iota + 1
+	frameOnions
+	frameError
+	frameDone
+)
+
+const (
+	streamBatchSize = 4000
+	maxFrameSize    = 1 << 30
+)
+
+type onionStream struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newOnionStream(conn net.Conn) *onionStream {
+	return &onionStream{
+		r: bufio.NewReader(conn),
+		w: bufio.NewWriter(conn),
+	}
+}
+
+func (s *onionStream) writeFrame(kind byte, payload []byte) error {
+	var header [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)))
+	header[n] = kind
+	if _, err := s.w.Write(header[:n+1]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(payload)
+	return err
+}
+
+func (s *onionStream) writeOnions(onions [][]byte) error {
+	s.buf = vrpc.AppendBatch(s.buf[:0], onions)
+	return s.writeFrame(frameOnions, s.buf)
+}
+
+func (s *onionStream) readFrame() (byte, []byte, error) {
+	size, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame too large (%d bytes)", size)
+	}
+	kind, err := s.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if kind == frameError {
+		return kind, nil, rpc.ServerError(payload)
+	}
+	return kind, payload, nil
+}
+
+func (s *onionStream) readOnions() ([][]byte, error) {
+	kind, payload, err := s.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if kind != frameOnions {
+		return nil, fmt.Errorf("unexpected frame %d", kind)
+	}
+	onions, _, err := vrpc.ReadBatch(payload)
+	return onions, err
+}
+
+// ServeRoundStream runs the rest of a round, from Open to Delete, over a
+// stream opened by RunConvoRoundStream.
+func (srv *ConvoService) ServeRoundStream(conn net.Conn) {
+	s := newOnionStream(conn)
+	if err := srv.serveRoundStream(s); err != nil {
+		log.WithFields(log.Fields{"service": "convo", "stream": ConvoRoundStream}).Error(err)
+		if s.writeFrame(frameError, []byte(err.Error())) == nil {
+			s.w.Flush()
+		}
+	}
+}
+
+func (srv *ConvoService) serveRoundStream(s *onionStream) error {
+	kind, payload, err := s.readFrame()
+	if err != nil {
+		return err
+	}
+	if kind != frameOpen {
+		return fmt.Errorf("unexpected frame %d", kind)
+	}
+	Round, payload, err := readUvarint(payload)
+	if err != nil {
+		return err
+	}
+	numIncoming, _, err := readUvarint(payload)
+	if err != nil {
+		return err
+	}
+
+	openArgs := &ConvoOpenArgs{
+		Round:       uint32(Round),
+		NumIncoming: int(numIncoming),
+	}
+	if err := srv.Open(openArgs, nil); err != nil {
+		return err
+	}
+	round, err := srv.getRound(openArgs.Round, convoRoundOpen)
+	if err != nil {
+		return err
+	}
+	defer round.busy.RUnlock()
+
+	// Peel batches on several goroutines while the next ones arrive.
+	type batch struct {
+		offset int
+		onions [][]byte
+	}
+	batches := make(chan batch, 2)
+	var workers sync.WaitGroup
+	var addErr error
+	var addErrOnce sync.Once
+	for w := 0; w < runtime.NumCPU(); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for b := range batches {
+				if err := srv.add(round, openArgs.Round, b.offset, b.onions); err != nil {
+					addErrOnce.Do(func() { addErr = err })
+				}
+			}
+		}()
+	}
+
+	var readErr error
+	for offset := 0; offset < openArgs.NumIncoming; {
+		onions, err := s.readOnions()
+		if err != nil {
+			readErr = err
+			break
+		}
+		if len(onions) == 0 {
+			readErr = fmt.Errorf("empty batch with %d of %d onions still to come", openArgs.NumIncoming-offset, openArgs.NumIncoming)
+			break
+		}
+		batches <- batch{offset, onions}
+		offset += len(onions)
+	}
+	close(batches)
+	workers.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	if addErr != nil {
+		return addErr
+	}
+
+	if err := srv.Close(openArgs.Round, nil); err != nil {
+		return err
+	}
+
+	for _, span := range concurrency.Spans(openArgs.NumIncoming, streamBatchSize) {
+		onions := srv.get(round, openArgs.Round, span.Start, span.Count)
+		if err := s.writeOnions(onions); err != nil {
+			return err
+		}
+	}
+	if err := srv.Delete(openArgs.Round, nil); err != nil {
+		return err
+	}
+	if err := s.writeFrame(frameDone, nil); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// RunConvoRoundStream is like RunConvoRound, but sends the onions and
+// receives the replies over one stream, so the next server can peel
+// onions while later ones are still in transit.  The next server still
+// mixes the round as a whole once every onion has arrived.
+func RunConvoRoundStream(ctx context.Context, client *vrpc.Client, round uint32, onions [][]byte) ([][]byte, error) {
+	conn, err := client.Stream(ctx, ConvoRoundStream)
+	if err != nil {
+		return nil, &stageError{"Stream", err}
+	}
+	defer conn.Close()
+
+	s := newOnionStream(conn)
+	replies, err := runRoundStream(s, round, onions)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = &vrpc.TimeoutError{Method: ConvoRoundStream}
+		} else if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &stageError{"Stream", err}
+	}
+	return replies, nil
+}
+
+func runRoundStream(s *onionStream, round uint32, onions [][]byte) ([][]byte, error) {
+	open := binary.AppendUvarint(nil, uint64(round))
+	open = binary.AppendUvarint(open, uint64(len(onions)))
+	err := s.writeFrame(frameOpen, open)
+	for _, span := range concurrency.Spans(len(onions), streamBatchSize) {
+		if err != nil {
+			break
+		}
+		err = s.writeOnions(onions[span.Start : span.Start+span.Count])
+	}
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		// The next server may have hung up because it failed; its
+		// reason is more useful than the write error.
+		if _, _, readErr := s.readFrame(); readErr != nil {
+			if _, ok := readErr.(rpc.ServerError); ok {
+				return nil, readErr
+			}
+		}
+		return nil, err
+	}
+
+	replies := make([][]byte, 0, len(onions))
+	for len(replies) < len(onions) {
+		batch, err := s.readOnions()
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return nil, fmt.Errorf("empty batch with %d of %d replies still to come", len(onions)-len(replies), len(onions))
+		}
+		if len(replies)+len(batch) > len(onions) {
+			return nil, fmt.Errorf("too many replies")
+		}
+		replies = append(replies, batch...)
+	}
+	// The round is only done once the next server says so; with no
+	// onions this is where its errors arrive.
+	kind, _, err := s.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if kind != frameDone {
+		return nil, fmt.Errorf("unexpected frame %d", kind)
+	}
+	return replies, nil
+}
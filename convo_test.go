@@ -0,0 +1,507 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vuvuzela.io/crypto/onionbox"
+	"vuvuzela.io/crypto/rand"
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// convoChain is a chain of servers running in-process, and a client
+// connected to the first one.
+type convoChain struct {
+	pki   *PKI
+	route []string
+	first *vrpc.Client
+}
+
+func listenConvo(t *testing.T, srv *ConvoService, listen net.Listener) {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(srv); err != nil {
+		t.Fatal(err)
+	}
+	server := vrpc.NewServer(rpcServer, vrpc.GobCodec)
+	server.HandleStream(ConvoRoundStream, srv.ServeRoundStream)
+	go server.Accept(listen)
+}
+
+// trackedListener remembers the connections it accepts, so that a test
+// can take its server down.
+type trackedListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+
+	// serve starts the server on a listener.
+	serve func(net.Listener)
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+// kill stops accepting connections and hangs up on the open ones.
+func (l *trackedListener) kill() {
+	l.Listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// restart brings a killed server back up at the same address.
+func (l *trackedListener) restart(t *testing.T) {
+	nl, err := net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nl.Close() })
+	l.mu.Lock()
+	l.Listener = nl
+	l.conns = nil
+	l.mu.Unlock()
+	l.serve(l)
+}
+
+// waitAccept waits until the server has accepted a connection, as it
+// does once a client that lost its connection redials.
+func (l *trackedListener) waitAccept(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		n := len(l.conns)
+		l.mu.Unlock()
+		if n > 0 {
+			// let the client put the new connection in service
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody redialed %s", l.Addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dialConvo(t *testing.T, address string) *vrpc.Client {
+	client, err := vrpc.Dial("tcp", address, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newConvoServers starts a convo server for every name in levels.  Each
+// server is connected to all of the servers at the next level, and the
+// servers that are not last add noise.
+func newConvoServers(t *testing.T, levels [][]string, streaming bool, depth int) (*PKI, map[string]*trackedListener) {
+	pki := &PKI{
+		Servers:      make(map[string]*ServerInfo),
+		ServerLevels: make(map[int][]string),
+	}
+	listeners := make(map[string]*trackedListener)
+	privateKeys := make(map[string]*BoxKey)
+	for level, names := range levels {
+		pki.ServerLevels[level] = names
+		pki.ServerOrder = append(pki.ServerOrder, names[0])
+		// the servers at a level are replicas with the same key
+		public, private, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			listeners[name] = &trackedListener{Listener: l}
+			privateKeys[name] = private
+			pki.Servers[name] = &ServerInfo{
+				Address:   l.Addr().String(),
+				PublicKey: public,
+				Level:     level,
+			}
+		}
+	}
+
+	for level := len(levels) - 1; level >= 0; level-- {
+		for _, name := range levels[level] {
+			srv := &ConvoService{
+				Pipeline:   NewPipeline(depth),
+				PKI:        pki,
+				ServerName: name,
+				PrivateKey: privateKeys[name],
+				LastServer: level == len(levels)-1,
+				Streaming:  streaming,
+				Dial: func(address string) (*vrpc.Client, error) {
+					return vrpc.Dial("tcp", address, 1)
+				},
+			}
+			if !srv.LastServer {
+				srv.Laplace = rand.Laplace{Mu: 10, B: 1}
+				srv.NextClients = make(map[string]*vrpc.Client)
+				for _, next := range levels[level+1] {
+					address := pki.Servers[next].Address
+					srv.NextClients[address] = dialConvo(t, address)
+				}
+			}
+			InitConvoService(srv)
+			listeners[name].serve = func(l net.Listener) { listenConvo(t, srv, l) }
+			listeners[name].serve(listeners[name])
+		}
+	}
+	return pki, listeners
+}
+
+func newConvoChain(t *testing.T, streaming bool, depth int) *convoChain {
+	pki, _ := newConvoServers(t, [][]string{{"first"}, {"last"}}, streaming, depth)
+	return &convoChain{
+		pki:   pki,
+		route: []string{"first", "last"},
+		first: dialConvo(t, pki.Servers["first"].Address),
+	}
+}
+
+// runRound sends n onions, each to its own dead drop, and checks that
+// every client gets its own message back.
+func (c *convoChain) runRound(t *testing.T, round uint32, n int, streaming bool) {
+	if err := NewConvoRound(context.Background(), c.first, round, 0, c.route); err != nil {
+		t.Fatalf("NewConvoRound: %s", err)
+	}
+	if err := c.mixRound(round, n, streaming); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomExchanges(n int) []*ConvoExchange {
+	exchanges := make([]*ConvoExchange, n)
+	for i := range exchanges {
+		exchanges[i] = new(ConvoExchange)
+		rand.Read(exchanges[i].DeadDrop[:])
+		rand.Read(exchanges[i].EncryptedMessage[:])
+	}
+	return exchanges
+}
+
+// mixRound runs a round that has already been started with NewConvoRound.
+func (c *convoChain) mixRound(round uint32, n int, streaming bool) error {
+	return c.mixExchanges(round, randomExchanges(n), streaming)
+}
+
+func (c *convoChain) mixExchanges(round uint32, exchanges []*ConvoExchange, streaming bool) error {
+	onions := make([][]byte, len(exchanges))
+	sharedKeys := make([][]*[32]byte, len(exchanges))
+	for i, ex := range exchanges {
+		onions[i], sharedKeys[i] = onionbox.Seal(ex.Marshal(), ForwardNonce(round), c.pki.ServerKeys(c.route).Keys())
+	}
+
+	ctx := context.Background()
+	var replies [][]byte
+	var err error
+	if streaming {
+		replies, err = RunConvoRoundStream(ctx, c.first, round, onions)
+	} else {
+		replies, err = RunConvoRound(ctx, c.first, round, onions)
+	}
+	if err != nil {
+		return fmt.Errorf("round %d: %w", round, err)
+	}
+	if len(replies) != len(exchanges) {
+		return fmt.Errorf("round %d: got %d replies, want %d", round, len(replies), len(exchanges))
+	}
+	for i, reply := range replies {
+		msg, ok := onionbox.Open(reply, BackwardNonce(round), sharedKeys[i])
+		if !ok {
+			return fmt.Errorf("round %d: reply %d does not open", round, i)
+		}
+		if !bytes.Equal(msg, exchanges[i].EncryptedMessage[:]) {
+			return fmt.Errorf("round %d: reply %d is not the client's own message", round, i)
+		}
+	}
+	return nil
+}
+
+func TestConvoRound(t *testing.T) {
+	chain := newConvoChain(t, false, 1)
+	chain.runRound(t, 1, 100, false)
+	chain.runRound(t, 2, 5000, false)
+}
+
+func TestConvoRoundStream(t *testing.T) {
+	chain := newConvoChain(t, true, 1)
+	chain.runRound(t, 1, 100, true)
+	chain.runRound(t, 2, 5000, true)
+	chain.runRound(t, 3, 0, true)
+}
+
+func TestConvoRoundStreamEmptyBatch(t *testing.T) {
+	chain := newConvoChain(t, true, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := NewConvoRound(ctx, chain.first, 1, 0, chain.route); err != nil {
+		t.Fatalf("NewConvoRound: %s", err)
+	}
+	conn, err := chain.first.Stream(ctx, ConvoRoundStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// An upstream server that promises onions and then sends only
+	// empty batches must not keep the next server reading forever.
+	s := newOnionStream(conn)
+	open := binary.AppendUvarint(nil, 1)
+	open = binary.AppendUvarint(open, 10)
+	s.writeFrame(frameOpen, open)
+	for i := 0; i < 3; i++ {
+		s.writeOnions(nil)
+	}
+	if err := s.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.readFrame()
+	if _, ok := err.(rpc.ServerError); !ok || !strings.Contains(err.Error(), "empty batch") {
+		t.Fatalf("got error %v, want an empty batch error from the server", err)
+	}
+}
+
+func TestConvoRoundPipelined(t *testing.T) {
+	const depth = 3
+	chain := newConvoChain(t, false, depth)
+
+	// With a depth of 3, every round can be started before any of them
+	// is mixed.
+	for round := uint32(1); round <= depth; round++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := NewConvoRound(ctx, chain.first, round, 0, chain.route)
+		cancel()
+		if err != nil {
+			t.Fatalf("NewConvoRound %d: %s", round, err)
+		}
+	}
+
+	errs := make(chan error, depth)
+	for round := uint32(1); round <= depth; round++ {
+		go func(round uint32) {
+			errs <- chain.mixRound(round, 500*int(round), round%2 == 0)
+		}(round)
+	}
+	for i := 0; i < depth; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConvoRoundExpires(t *testing.T) {
+	public, private, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := []string{"last"}
+	srv := &ConvoService{
+		Pipeline: NewPipeline(1),
+		PKI: &PKI{
+			Servers:     map[string]*ServerInfo{"last": {PublicKey: public}},
+			ServerOrder: route,
+		},
+		ServerName:    "last",
+		PrivateKey:    private,
+		LastServer:    true,
+		RoundLifetime: 50 * time.Millisecond,
+	}
+	InitConvoService(srv)
+
+	if err := srv.NewRound(&ConvoNewRoundArgs{Round: 1, Route: route}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Open(&ConvoOpenArgs{Round: 1, NumIncoming: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	onion, _ := onionbox.Seal(new(ConvoExchange).Marshal(), ForwardNonce(1), srv.PKI.ServerKeys(route).Keys())
+	if err := srv.Add(&ConvoAddArgs{Round: 1, Onions: [][]byte{onion}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.roundsMu.RLock()
+	round := srv.rounds[1]
+	srv.roundsMu.RUnlock()
+	sharedKey := round.sharedKeys[0]
+	if *sharedKey == [32]byte{} {
+		t.Fatalf("no shared key to erase")
+	}
+
+	// A round in use is not aborted.
+	round.busy.RLock()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := srv.getRound(1, convoRoundOpen); err != nil {
+		t.Fatalf("round aborted while in use: %s", err)
+	}
+	round.busy.RUnlock()
+	round.busy.RUnlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.roundsMu.RLock()
+		_, exists := srv.rounds[1]
+		srv.roundsMu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("round not aborted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	round.busy.Lock()
+	erased := *sharedKey == [32]byte{}
+	round.busy.Unlock()
+	if !erased {
+		t.Fatalf("shared key not erased")
+	}
+	if n := srv.Pipeline.InFlight(); n != 0 {
+		t.Fatalf("pipeline slot not released (%d in flight)", n)
+	}
+	if err := srv.Close(1, nil); err == nil {
+		t.Fatalf("Close succeeded on an aborted round")
+	}
+}
+
+func TestConvoRoundDeleteFailed(t *testing.T) {
+	levels := [][]string{{"first"}, {"middle"}, {"last"}}
+	pki, _ := newConvoServers(t, levels, false, 2)
+	chain := &convoChain{
+		pki:   pki,
+		route: []string{"first", "middle", "last"},
+		first: dialConvo(t, pki.Servers["first"].Address),
+	}
+	middle := dialConvo(t, pki.Servers["middle"].Address)
+	last := dialConvo(t, pki.Servers["last"].Address)
+
+	// The last server refuses round 1 from middle, which leaves the
+	// round on middle after it fails.
+	ctx := context.Background()
+	if err := NewConvoRound(ctx, last, 1, 0, chain.route); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewConvoRound(ctx, chain.first, 1, 0, chain.route); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.mixRound(1, 10, false); err == nil {
+		t.Fatal("round succeeded")
+	}
+
+	if err := DeleteConvoRound(ctx, chain.first, 1); err != nil {
+		t.Fatal(err)
+	}
+	// middle only accepts round 1 again once the round is gone.
+	if err := NewConvoRound(ctx, middle, 1, 0, chain.route[1:]); err != nil {
+		t.Fatalf("round still on middle after Delete: %s", err)
+	}
+}
+
+func TestConvoRoundFailover(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		levels := [][]string{{"first"}, {"middle0", "middle1"}, {"last"}}
+		pki, listeners := newConvoServers(t, levels, streaming, 1)
+		chain := &convoChain{
+			pki:   pki,
+			route: []string{"first", "middle0", "last"},
+			first: dialConvo(t, pki.Servers["first"].Address),
+		}
+
+		// middle0 goes down once the round has started, and first
+		// sends the round to middle1 instead.
+		if err := NewConvoRound(context.Background(), chain.first, 1, 0, chain.route); err != nil {
+			t.Fatalf("NewConvoRound: %s", err)
+		}
+		listeners["middle0"].kill()
+		if err := chain.mixRound(1, 100, streaming); err != nil {
+			t.Fatalf("streaming=%t: round failed without middle0: %s", streaming, err)
+		}
+	}
+}
+
+func TestConvoRoundRetry(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		levels := [][]string{{"first"}, {"middle0", "middle1"}, {"last"}}
+		pki, listeners := newConvoServers(t, levels, streaming, 1)
+		chain := &convoChain{
+			pki:   pki,
+			route: []string{"first", "middle0", "last"},
+			first: dialConvo(t, pki.Servers["first"].Address),
+		}
+		ctx := context.Background()
+
+		// The whole middle level goes down once the round has started.
+		if err := NewConvoRound(ctx, chain.first, 1, 0, chain.route); err != nil {
+			t.Fatalf("NewConvoRound: %s", err)
+		}
+		listeners["middle0"].kill()
+		listeners["middle1"].kill()
+
+		exchanges := randomExchanges(100)
+		err := chain.mixExchanges(1, exchanges, streaming)
+		if err == nil {
+			t.Fatalf("streaming=%t: round succeeded without the middle level", streaming)
+		}
+		hop := BlameHop(pki, "first", 1, err)
+		if hop.Level != 1 || !hop.Retryable {
+			t.Fatalf("streaming=%t: got %#v, want a retryable failure at level 1", streaming, hop)
+		}
+
+		// With no other server up at the level, the route cannot be
+		// repaired without leaving the level out.
+		live := map[int][]string{0: {"first"}, 1: {}, 2: {"last"}}
+		if route, err := pki.RepairRoute(chain.route, hop.Server, live); err == nil {
+			t.Fatalf("streaming=%t: repaired route to %v with the middle level down", streaming, route)
+		}
+
+		// What the entry server does once a server is back: drop the
+		// failed server, repair the route, and mix the same exchanges
+		// again in a retry round.
+		back := "middle0"
+		if hop.Server == back {
+			back = "middle1"
+		}
+		listeners[back].restart(t)
+		listeners[back].waitAccept(t)
+		live[1] = []string{back}
+		chain.route, err = pki.RepairRoute(chain.route, hop.Server, live)
+		if err != nil {
+			t.Fatalf("streaming=%t: RepairRoute: %s", streaming, err)
+		}
+		if want := []string{"first", back, "last"}; fmt.Sprint(chain.route) != fmt.Sprint(want) {
+			t.Fatalf("repaired route is %v, want %v", chain.route, want)
+		}
+		const retryRound = 1 | 1<<31
+		if err := NewConvoRound(ctx, chain.first, retryRound, 0, chain.route); err != nil {
+			t.Fatalf("NewConvoRound: %s", err)
+		}
+		if err := chain.mixExchanges(retryRound, exchanges, streaming); err != nil {
+			t.Fatalf("streaming=%t: retry: %s", streaming, err)
+		}
+	}
+}
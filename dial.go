@@ -1,9 +1,11 @@
 package vuvuzela
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
@@ -18,23 +20,69 @@ type DialService struct {
 	roundsMu sync.RWMutex
 	rounds   map[uint32]*DialRound
 
-	Idle *sync.Mutex
+	// Pipeline bounds the number of rounds in flight.  The mix server
+	// shares it with its ConvoService.
+	Pipeline *Pipeline
 
 	Laplace rand.Laplace
 
 	PKI        *PKI
+	// PKIStore, if set, supplies the PKI of each round's epoch in place
+	// of PKI.
+	PKIStore   *PKIStore
 	ServerName string
 	PrivateKey *BoxKey
-	Client     *vrpc.Client
+	// NextClient returns the connection to the next server at address.
+	// The mix server shares its ConvoService's connections.
+	NextClient func(address string) (*vrpc.Client, error)
 	LastServer bool
+
+	// Timeout bounds how long Close waits on the next server.
+	// Zero means wait forever.
+	Timeout time.Duration
+
+	// RoundLifetime is how long a round may exist before it is aborted
+	// and its introductions are erased.  Zero means rounds are kept
+	// forever.
+	RoundLifetime time.Duration
+
+	// RetainRounds is how many deleted rounds the last server keeps
+	// around so that Buckets still works for them.
+	RetainRounds int
+
+	// retired lists the deleted rounds that are still kept, oldest
+	// first.  It is guarded by roundsMu.
+	retired []uint32
 }
 
 type DialRound struct {
 	sync.Mutex
 
 	status   dialStatus
+	created  time.Time
+	// RPCs hold busy for reading while they use the round, so that it
+	// is not erased under them.
+	busy     sync.RWMutex
+	// release gives the round's pipeline slot back.
+	release  func()
+	// client is the connection to the next server on the route, once
+	// the round has been sent there.
+	client   *vrpc.Client
 	route []string
+	// numBuckets is the number of buckets the entry server announced
+	// for the round.
+	numBuckets uint32
 	incoming [][]byte
+	// pki is the PKI of the epoch the round was started in.
+	pki *PKI
+
+	// buckets and their tags replace incoming once the round is retired.
+	buckets [][][SizeEncryptedIntro]byte
+	tags    [][]DialTag
+	// filters caches the Bloom filters of the buckets for the
+	// false-positive rate filterRate.  It is guarded by the mutex.
+	filters    *DialFiltersResult
+	filterRate float64
 
 	noise   [][]byte
 	noiseWg sync.WaitGroup
@@ -45,45 +93,107 @@ type dialStatus int
 const (
 	dialRoundOpen dialStatus = iota + 1
 	dialRoundClosed
+	// Retired rounds have been deleted by the entry server but are kept
+	// for late Buckets calls.
+	dialRoundRetired
+	dialRoundAborted
 )
 
 func InitDialService(srv *DialService) {
 	srv.rounds = make(map[uint32]*DialRound)
+	if srv.RoundLifetime > 0 {
+		go collectRounds(srv.RoundLifetime, srv.abortExpired)
+	}
 }
 
-func (srv *DialService) getRound(round uint32, expectedStatus dialStatus) (*DialRound, error) {
+// getRound returns the round with its busy lock held for reading; the
+// caller must call round.busy.RUnlock when done with it.  The round's
+// status must be one of expectedStatus.
+func (srv *DialService) getRound(round uint32, expectedStatus ...dialStatus) (*DialRound, error) {
 	srv.roundsMu.RLock()
 	r, ok := srv.rounds[round]
 	srv.roundsMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("round %d not found", round)
 	}
-	if r.status != expectedStatus {
-		return r, fmt.Errorf("round %d: status %v, expecting %v", round, r.status, expectedStatus)
+
+	r.busy.RLock()
+	srv.roundsMu.RLock()
+	status := r.status
+	srv.roundsMu.RUnlock()
+	for _, expected := range expectedStatus {
+		if status == expected {
+			return r, nil
+		}
 	}
-	return r, nil
+	r.busy.RUnlock()
+	return nil, fmt.Errorf("round %d: status %v, expecting %v", round, status, expectedStatus)
 }
 
-func (srv *DialService) NewRound(Round uint32, _ *struct{}) error {
-	log.WithFields(log.Fields{"service": "dial", "rpc": "NewRound", "round": Round}).Info()
-	srv.Idle.Lock()
+func (srv *DialService) setStatus(round *DialRound, status dialStatus) {
+	srv.roundsMu.Lock()
+	round.status = status
+	srv.roundsMu.Unlock()
+}
+
+type DialNewRoundArgs struct {
+	Round uint32
+	// Epoch is the PKI epoch the round uses.
+	Epoch uint64
+	// Route is the chain of servers that mixes the round, as for convo
+	// rounds.
+	Route []string
+	// Buckets is the number of dial buckets in the round.  Every server
+	// adds noise to each of them.
+	Buckets uint32
+}
+
+func (srv *DialService) NewRound(args *DialNewRoundArgs, _ *struct{}) error {
+	log.WithFields(log.Fields{"service": "dial", "rpc": "NewRound", "round": args.Round, "epoch": args.Epoch, "route": args.Route, "buckets": args.Buckets}).Info()
+
+	Round := args.Round
+	pki, err := roundPKI(srv.PKI, srv.PKIStore, args.Epoch)
+	if err != nil {
+		return err
+	}
+	if err := pki.checkPosition(srv.ServerName, args.Route, srv.LastServer); err != nil {
+		return fmt.Errorf("round %d: %s", Round, err)
+	}
+	if args.Buckets == 0 {
+		return fmt.Errorf("round %d: no dial buckets", Round)
+	}
+	ctx, cancel := slotContext(srv.Timeout, srv.RoundLifetime)
+	release, err := srv.Pipeline.AcquireContext(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("round %d: no free pipeline slot: %s", Round, err)
+	}
 
 	srv.roundsMu.Lock()
 	defer srv.roundsMu.Unlock()
 
 	_, exists := srv.rounds[Round]
 	if exists {
+		release()
 		return fmt.Errorf("round %d already exists", Round)
 	}
 
-	round := &DialRound{}
+	round := &DialRound{
+		created: time.Now(),
+		release: release,
+		route:   args.Route,
+		pki:     pki,
+
+		numBuckets: args.Buckets,
+	}
 	srv.rounds[Round] = round
 
 	round.noiseWg.Add(1)
 	go func() {
 		// NOTE: unlike the convo protocol, the last server also adds noise
+		// Bucket 0 is the dummy dead drop, which gets noise too.
 		noiseTotal := uint32(0)
-		noiseCounts := make([]uint32, TotalDialBuckets+1)
+		noiseCounts := make([]uint32, round.numBuckets+1)
 		for b := range noiseCounts {
 			bmu := srv.Laplace.Uint32()
 			noiseCounts[b] = bmu
@@ -92,7 +202,7 @@ func (srv *DialService) NewRound(Round uint32, _ *struct{}) error {
 		round.noise = make([][]byte, noiseTotal)
 
 		nonce := ForwardNonce(Round)
-		nextKeys := srv.PKI.NextServerKeys(
+		nextKeys := round.pki.NextServerKeys(
 			srv.ServerName,
 			round.route).Keys()
 
@@ -116,10 +226,11 @@ func (srv *DialService) Add(args *DialAddArgs, _ *struct{}) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
 
 	nonce := ForwardNonce(args.Round)
 	messages := make([][]byte, 0, len(args.Onions))
-	expectedOnionSize := srv.PKI.IncomingOnionOverhead(
+	expectedOnionSize := round.pki.IncomingOnionOverhead(
 		srv.ServerName,
 		round.route) + SizeDialExchange
 
@@ -164,6 +275,7 @@ func (srv *DialService) Close(Round uint32, _ *struct{}) error {
 	if err != nil {
 		return err
 	}
+	defer round.busy.RUnlock()
 
 	srv.filterIncoming(round)
 
@@ -174,21 +286,33 @@ func (srv *DialService) Close(Round uint32, _ *struct{}) error {
 	shuffler.Shuffle(round.incoming)
 
 	if !srv.LastServer {
-		if err := NewDialRound(srv.Client, Round); err != nil {
+		next := round.pki.NextServer(srv.ServerName, round.route)
+		client, err := srv.NextClient(next)
+		if err != nil {
+			round.release()
 			return fmt.Errorf("NewDialRound: %s", err)
 		}
-		srv.Idle.Unlock()
+		ctx, cancel := roundContext(srv.Timeout)
+		defer cancel()
+		if err := NewDialRound(ctx, client, Round, round.pki.Epoch, round.route, round.numBuckets); err != nil {
+			round.release()
+			return fmt.Errorf("NewDialRound: %s", err)
+		}
+		round.release()
+		srv.roundsMu.Lock()
+		round.client = client
+		srv.roundsMu.Unlock()
 
-		if err := RunDialRound(srv.Client, Round, round.incoming); err != nil {
+		if err := RunDialRound(ctx, client, Round, round.incoming); err != nil {
 			return fmt.Errorf("RunDialRound: %s", err)
 		}
 		round.incoming = nil
 	} else {
-		srv.Idle.Unlock()
+		round.release()
 	}
 	round.noise = nil
 
-	round.status = dialRoundClosed
+	srv.setStatus(round, dialRoundClosed)
 	return nil
 }
 
@@ -207,12 +331,126 @@ func (srv *DialService) Buckets(args *DialBucketsArgs, result *DialBucketsResult
 		return fmt.Errorf("Dial.Buckets can only be called on the last server")
 	}
 
-	round, err := srv.getRound(args.Round, dialRoundClosed)
+	buckets, _, err := srv.sortedRound(args.Round)
+	if err != nil {
+		return err
+	}
+	result.Buckets = buckets
+	return nil
+}
+
+type DialFiltersArgs struct {
+	Round uint32
+	// FalsePositive is the false-positive rate of the filters.
+	FalsePositive float64
+}
+
+type DialFiltersResult struct {
+	// Filters holds a Bloom filter of the tags in each bucket.
+	Filters []*BloomFilter
+	// Sizes is the number of introductions in each bucket.
+	Sizes []int
+}
+
+// Filters returns a Bloom filter of each bucket's tags, so that a client
+// only fetches its introductions when there may be some.  The filters
+// are built by the first call for a round and kept with the round, so
+// later calls for the same false-positive rate return them as they are.
+func (srv *DialService) Filters(args *DialFiltersArgs, result *DialFiltersResult) error {
+	log.WithFields(log.Fields{"service": "dial", "rpc": "Filters", "round": args.Round}).Info()
+
+	if !srv.LastServer {
+		return fmt.Errorf("Dial.Filters can only be called on the last server")
+	}
+	if !(args.FalsePositive > 0 && args.FalsePositive < 1) {
+		return fmt.Errorf("round %d: invalid false-positive rate %v", args.Round, args.FalsePositive)
+	}
+	round, err := srv.getRound(args.Round, dialRoundClosed, dialRoundRetired)
+	if err != nil {
+		return err
+	}
+	defer round.busy.RUnlock()
+
+	round.Lock()
+	defer round.Unlock()
+	if round.filters == nil || round.filterRate != args.FalsePositive {
+		_, tags := srv.sorted(round)
+		filters := &DialFiltersResult{
+			Filters: make([]*BloomFilter, len(tags)),
+			Sizes:   make([]int, len(tags)),
+		}
+		for b := range tags {
+			filters.Sizes[b] = len(tags[b])
+			f := NewBloomFilter(len(tags[b]), args.FalsePositive)
+			for i := range tags[b] {
+				f.Add(&tags[b][i])
+			}
+			filters.Filters[b] = f
+		}
+		round.filters = filters
+		round.filterRate = args.FalsePositive
+	}
+	*result = *round.filters
+	return nil
+}
+
+type DialFetchArgs struct {
+	Round  uint32
+	Bucket uint32
+}
+
+type DialFetchResult struct {
+	Intros [][SizeEncryptedIntro]byte
+}
+
+// Fetch returns the introductions in one bucket, for a client whose
+// filter matched.
+func (srv *DialService) Fetch(args *DialFetchArgs, result *DialFetchResult) error {
+	log.WithFields(log.Fields{"service": "dial", "rpc": "Fetch", "round": args.Round, "bucket": args.Bucket}).Debug()
+
+	if !srv.LastServer {
+		return fmt.Errorf("Dial.Fetch can only be called on the last server")
+	}
+	buckets, _, err := srv.sortedRound(args.Round)
 	if err != nil {
 		return err
 	}
+	if args.Bucket < 1 || args.Bucket > uint32(len(buckets)) {
+		return fmt.Errorf("round %d: no bucket %d", args.Round, args.Bucket)
+	}
+	result.Intros = buckets[args.Bucket-1]
+	return nil
+}
 
-	buckets := make([][][SizeEncryptedIntro]byte, TotalDialBuckets)
+// sortedRound returns the buckets of a closed or retired round, with
+// the tag of each introduction.
+func (srv *DialService) sortedRound(Round uint32) ([][][SizeEncryptedIntro]byte, [][]DialTag, error) {
+	round, err := srv.getRound(Round, dialRoundClosed, dialRoundRetired)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer round.busy.RUnlock()
+
+	buckets, tags := srv.sorted(round)
+	return buckets, tags, nil
+}
+
+// sorted returns the buckets of a round that is closed or retired.  The
+// caller holds round.busy for reading.
+func (srv *DialService) sorted(round *DialRound) ([][][SizeEncryptedIntro]byte, [][]DialTag) {
+	srv.roundsMu.RLock()
+	buckets, tags := round.buckets, round.tags
+	srv.roundsMu.RUnlock()
+	if buckets == nil {
+		buckets, tags = srv.sortIntros(round)
+	}
+	return buckets, tags
+}
+
+// sortIntros puts the introductions of a closed round into buckets.
+func (srv *DialService) sortIntros(round *DialRound) ([][][SizeEncryptedIntro]byte, [][]DialTag) {
+	buckets := make([][][SizeEncryptedIntro]byte, round.numBuckets)
+	tags := make([][]DialTag, round.numBuckets)
 
 	ex := new(DialExchange)
 	for _, m := range round.incoming {
@@ -229,19 +467,135 @@ func (srv *DialService) Buckets(args *DialBucketsArgs, result *DialBucketsResult
 			continue
 		}
 		buckets[ex.Bucket-1] = append(buckets[ex.Bucket-1], ex.EncryptedIntro)
+		tags[ex.Bucket-1] = append(tags[ex.Bucket-1], ex.Tag)
 	}
+	return buckets, tags
+}
 
-	result.Buckets = buckets
+// Delete deletes the round and forwards to the next server on its
+// route, if the round got that far.  The last server instead retires
+// the round: it drops the raw introductions but keeps the buckets of the
+// RetainRounds most recent rounds.
+func (srv *DialService) Delete(Round uint32, _ *struct{}) error {
+	log.WithFields(log.Fields{"service": "dial", "rpc": "Delete", "round": Round}).Info()
+
+	if !srv.LastServer {
+		srv.roundsMu.Lock()
+		round := srv.rounds[Round]
+		delete(srv.rounds, Round)
+		var client *vrpc.Client
+		if round != nil {
+			client = round.client
+		}
+		srv.roundsMu.Unlock()
+		if round == nil {
+			return fmt.Errorf("round %d not found", Round)
+		}
+		round.release()
+		if client == nil {
+			return nil
+		}
+
+		ctx, cancel := roundContext(srv.Timeout)
+		defer cancel()
+		return DeleteDialRound(ctx, client, Round)
+	}
+
+	round, err := srv.getRound(Round, dialRoundClosed)
+	if err != nil {
+		return err
+	}
+	buckets, tags := srv.sortIntros(round)
+	round.busy.RUnlock()
+
+	// Wait for Buckets calls that are still reading incoming.
+	round.busy.Lock()
+	defer round.busy.Unlock()
+	srv.roundsMu.Lock()
+	defer srv.roundsMu.Unlock()
+	if round.status != dialRoundClosed {
+		// retired or aborted in the meantime
+		return nil
+	}
+	round.buckets = buckets
+	round.tags = tags
+	round.incoming = nil
+	round.status = dialRoundRetired
+
+	srv.retired = append(srv.retired, Round)
+	for len(srv.retired) > srv.RetainRounds {
+		delete(srv.rounds, srv.retired[0])
+		srv.retired = srv.retired[1:]
+	}
 	return nil
 }
 
-// TODO we should probably have a corresponding Delete rpc
+// abortExpired aborts the rounds created before deadline.  A round that
+// an RPC is still using is left for the next pass.
+func (srv *DialService) abortExpired(deadline time.Time) {
+	srv.roundsMu.RLock()
+	var expired []uint32
+	for n, r := range srv.rounds {
+		// retired rounds are bounded by RetainRounds instead
+		if r.created.Before(deadline) && r.status != dialRoundRetired {
+			expired = append(expired, n)
+		}
+	}
+	srv.roundsMu.RUnlock()
+
+	for _, n := range expired {
+		srv.roundsMu.RLock()
+		round := srv.rounds[n]
+		srv.roundsMu.RUnlock()
+		if round == nil || !round.busy.TryLock() {
+			continue
+		}
+
+		srv.roundsMu.Lock()
+		status := round.status
+		round.status = dialRoundAborted
+		delete(srv.rounds, n)
+		srv.roundsMu.Unlock()
+
+		round.release()
+		round.erase()
+		round.busy.Unlock()
+
+		log.WithFields(log.Fields{"service": "dial", "round": n, "status": status, "age": time.Since(round.created)}).Warn("aborted expired round")
+	}
+}
+
+// erase zeroes the round's introductions.
+func (round *DialRound) erase() {
+	round.noiseWg.Wait()
+	for _, msgs := range [][][]byte{round.incoming, round.noise} {
+		for _, msg := range msgs {
+			zero(msg)
+		}
+	}
+	round.incoming = nil
+	round.noise = nil
+}
+
+func NewDialRound(ctx context.Context, client *vrpc.Client, round uint32, epoch uint64, route []string, buckets uint32) error {
+	args := &DialNewRoundArgs{
+		Round:   round,
+		Epoch:   epoch,
+		Route:   route,
+		Buckets: buckets,
+	}
+	return client.CallContext(ctx, "DialService.NewRound", args, nil)
+}
 
-func NewDialRound(client *vrpc.Client, round uint32) error {
-	return client.Call("DialService.NewRound", round, nil)
+// DeleteDialRound deletes a round from client's server and every server
+// after it.
+func DeleteDialRound(ctx context.Context, client *vrpc.Client, round uint32) error {
+	return client.CallContext(ctx, "DialService.Delete", round, nil)
 }
 
-func RunDialRound(client *vrpc.Client, round uint32, onions [][]byte) error {
+// RunDialRound gives up when ctx is done; a *vrpc.TimeoutError means the
+// deadline expired.
+func RunDialRound(ctx context.Context, client *vrpc.Client, round uint32, onions [][]byte) error {
 	spans := concurrency.Spans(len(onions), 4000)
 	calls := make([]*vrpc.Call, len(spans))
 
@@ -259,12 +613,12 @@ func RunDialRound(client *vrpc.Client, round uint32, onions [][]byte) error {
 		}
 	})
 
-	if err := client.CallMany(calls); err != nil {
-		return fmt.Errorf("Add: %s", err)
+	if err := client.CallManyContext(ctx, calls); err != nil {
+		return fmt.Errorf("Add: %w", err)
 	}
 
-	if err := client.Call("DialService.Close", round, nil); err != nil {
-		return fmt.Errorf("Close: %s", err)
+	if err := client.CallContext(ctx, "DialService.Close", round, nil); err != nil {
+		return fmt.Errorf("Close: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,220 @@
+package vuvuzela
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"vuvuzela.io/crypto/onionbox"
+	"vuvuzela.io/crypto/rand"
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+func serveDial(t *testing.T, srv *DialService) *vrpc.Client {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(srv); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go vrpc.NewServer(rpcServer, vrpc.GobCodec).Accept(l)
+
+	client, err := vrpc.Dial("tcp", l.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newDialServers creates noiseless dial services for the servers in
+// route, each forwarding to the next, and returns a client connected to
+// the first one.
+func newDialServers(t *testing.T, route []string, retain int) (*PKI, []*DialService, *vrpc.Client) {
+	pki := &PKI{
+		Servers:     make(map[string]*ServerInfo),
+		ServerOrder: route,
+	}
+	services := make([]*DialService, len(route))
+	for level, name := range route {
+		public, private, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pki.Servers[name] = &ServerInfo{PublicKey: public, Level: level}
+		services[level] = &DialService{
+			Pipeline:     NewPipeline(1),
+			PKI:          pki,
+			ServerName:   name,
+			PrivateKey:   private,
+			LastServer:   level == len(route)-1,
+			RetainRounds: retain,
+		}
+	}
+
+	var client *vrpc.Client
+	for i := len(services) - 1; i >= 0; i-- {
+		next := client
+		services[i].NextClient = func(string) (*vrpc.Client, error) { return next, nil }
+		InitDialService(services[i])
+		client = serveDial(t, services[i])
+	}
+	return pki, services, client
+}
+
+func dialBuckets(srv *DialService, round uint32) ([][][SizeEncryptedIntro]byte, error) {
+	result := new(DialBucketsResult)
+	err := srv.Buckets(&DialBucketsArgs{Round: round}, result)
+	return result.Buckets, err
+}
+
+func TestDialDelete(t *testing.T) {
+	route := []string{"last"}
+	pki, services, client := newDialServers(t, route, 2)
+	last := services[0]
+	ctx := context.Background()
+
+	for round := uint32(1); round <= 4; round++ {
+		if err := NewDialRound(ctx, client, round, 0, route, 1); err != nil {
+			t.Fatalf("NewDialRound: %s", err)
+		}
+		ex := make([]byte, SizeDialExchange)
+		binary.BigEndian.PutUint32(ex[0:4], 1)
+		rand.Read(ex[4:])
+		onion, _ := onionbox.Seal(ex, ForwardNonce(round), pki.ServerKeys(route).Keys())
+		if err := RunDialRound(ctx, client, round, [][]byte{onion}); err != nil {
+			t.Fatalf("RunDialRound: %s", err)
+		}
+
+		before, err := dialBuckets(last, round)
+		if err != nil {
+			t.Fatalf("Buckets %d: %s", round, err)
+		}
+		if len(before[0]) != 1 {
+			t.Fatalf("round %d: %d intros in bucket 1, want 1", round, len(before[0]))
+		}
+
+		if err := DeleteDialRound(ctx, client, round); err != nil {
+			t.Fatalf("DeleteDialRound %d: %s", round, err)
+		}
+
+		// Late clients can still fetch a retired round.
+		after, err := dialBuckets(last, round)
+		if err != nil {
+			t.Fatalf("Buckets %d after Delete: %s", round, err)
+		}
+		if len(after[0]) != 1 || after[0][0] != before[0][0] {
+			t.Fatalf("round %d: buckets changed after Delete", round)
+		}
+	}
+
+	if n := len(last.rounds); n != 2 {
+		t.Fatalf("last server has %d rounds, want 2", n)
+	}
+	for _, round := range []uint32{1, 2} {
+		if _, err := dialBuckets(last, round); err == nil {
+			t.Fatalf("round %d is still kept", round)
+		}
+	}
+	for _, round := range last.rounds {
+		if round.incoming != nil {
+			t.Fatalf("retired round still holds its introductions")
+		}
+	}
+}
+
+func TestDialDeleteCascades(t *testing.T) {
+	route := []string{"first", "middle", "last"}
+	_, services, client := newDialServers(t, route, 1)
+	ctx := context.Background()
+
+	if err := NewDialRound(ctx, client, 1, 0, route, 1); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	if err := RunDialRound(ctx, client, 1, nil); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+	if err := DeleteDialRound(ctx, client, 1); err != nil {
+		t.Fatalf("DeleteDialRound: %s", err)
+	}
+
+	for _, srv := range services[:2] {
+		if n := len(srv.rounds); n != 0 {
+			t.Fatalf("%s still has %d rounds", srv.ServerName, n)
+		}
+	}
+	if _, err := dialBuckets(services[2], 1); err != nil {
+		t.Fatalf("Buckets after Delete: %s", err)
+	}
+}
+
+func TestDialRoute(t *testing.T) {
+	route := []string{"first", "middle", "last"}
+	pki, services, client := newDialServers(t, route, 1)
+	ctx := context.Background()
+
+	if err := NewDialRound(ctx, client, 1, 0, []string{"middle", "last"}, 1); err == nil {
+		t.Fatalf("NewDialRound succeeded on a route without the first server")
+	}
+	if err := NewDialRound(ctx, client, 1, 0, route, 1); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	ex := make([]byte, SizeDialExchange)
+	binary.BigEndian.PutUint32(ex[0:4], 1)
+	rand.Read(ex[4:])
+	onion, _ := onionbox.Seal(ex, ForwardNonce(1), pki.ServerKeys(route).Keys())
+	if err := RunDialRound(ctx, client, 1, [][]byte{onion}); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+
+	buckets, err := dialBuckets(services[2], 1)
+	if err != nil {
+		t.Fatalf("Buckets: %s", err)
+	}
+	if len(buckets[0]) != 1 {
+		t.Fatalf("%d intros in bucket 1, want 1", len(buckets[0]))
+	}
+}
+
+func TestDialBucketCount(t *testing.T) {
+	route := []string{"first", "last"}
+	pki, services, client := newDialServers(t, route, 1)
+	ctx := context.Background()
+
+	if err := NewDialRound(ctx, client, 1, 0, route, 0); err == nil {
+		t.Fatalf("NewDialRound succeeded without buckets")
+	}
+	if err := NewDialRound(ctx, client, 1, 0, route, 4); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	var onions [][]byte
+	for _, bucket := range []uint32{3, 4, 5} {
+		ex := make([]byte, SizeDialExchange)
+		binary.BigEndian.PutUint32(ex[0:4], bucket)
+		rand.Read(ex[4:])
+		onion, _ := onionbox.Seal(ex, ForwardNonce(1), pki.ServerKeys(route).Keys())
+		onions = append(onions, onion)
+	}
+	if err := RunDialRound(ctx, client, 1, onions); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+
+	buckets, err := dialBuckets(services[1], 1)
+	if err != nil {
+		t.Fatalf("Buckets: %s", err)
+	}
+	if len(buckets) != 4 {
+		t.Fatalf("got %d buckets, want 4", len(buckets))
+	}
+	// the intro for bucket 5 is out of range and dropped
+	for i, want := range []int{0, 0, 1, 1} {
+		if len(buckets[i]) != want {
+			t.Fatalf("%d intros in bucket %d, want %d", len(buckets[i]), i+1, want)
+		}
+	}
+}
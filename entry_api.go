@@ -13,6 +13,7 @@ const (
 	// from client to server
 	MsgConvoRequest MsgType = iota
 	MsgDialRequest
+	MsgDialFetch
 
 	// from server to client
 	MsgBadRequestError
@@ -22,6 +23,10 @@ const (
 	MsgDialBucket
 	MsgAnnounceConvoRound
 	MsgAnnounceDialRound
+	MsgAnnounceConvoRetry
+	MsgAnnounceMembership
+	MsgDialFilter
+	MsgPrivacyLoss
 )
 
 type Envelope struct {
@@ -48,6 +53,16 @@ func (e *Envelope) Open() (interface{}, error) {
 		v = new(AnnounceConvoRound)
 	case MsgAnnounceDialRound:
 		v = new(AnnounceDialRound)
+	case MsgAnnounceConvoRetry:
+		v = new(AnnounceConvoRetry)
+	case MsgAnnounceMembership:
+		v = new(Membership)
+	case MsgDialFetch:
+		v = new(DialFetch)
+	case MsgDialFilter:
+		v = new(DialFilter)
+	case MsgPrivacyLoss:
+		v = new(PrivacyLoss)
 	default:
 		return nil, fmt.Errorf("unknown message type: %d", e.Type)
 	}
@@ -78,6 +93,16 @@ func Envelop(v interface{}) (*Envelope, error) {
 		t = MsgAnnounceConvoRound
 	case *AnnounceDialRound:
 		t = MsgAnnounceDialRound
+	case *AnnounceConvoRetry:
+		t = MsgAnnounceConvoRetry
+	case *Membership:
+		t = MsgAnnounceMembership
+	case *DialFetch:
+		t = MsgDialFetch
+	case *DialFilter:
+		t = MsgDialFilter
+	case *PrivacyLoss:
+		t = MsgPrivacyLoss
 	default:
 		return nil, fmt.Errorf("unsupported message type: %T", v)
 	}
@@ -102,6 +127,12 @@ type DialRequest struct {
 	Onion []byte
 }
 
+// DialFetch asks for the client's bucket in a dial round whose bucket
+// came as a DialFilter.  It comes back as a DialBucket.
+type DialFetch struct {
+	Round uint32
+}
+
 type BadRequestError struct {
 	Err string
 }
@@ -113,6 +144,9 @@ func (e *BadRequestError) Error() string {
 type ConvoError struct {
 	Round uint32
 	Err   string
+
+	// Hop is set when the round failed at a mix server.
+	Hop *HopError
 }
 
 func (e *ConvoError) Error() string {
@@ -138,11 +172,53 @@ type DialBucket struct {
 	Intros [][SizeEncryptedIntro]byte
 }
 
+// DialFilter replaces DialBucket when the entry server runs with Bloom
+// filters: Filter holds the tags of the introductions in the client's
+// bucket.  A client that finds the KeyDialTag it shares with one of its
+// contacts sends a DialFetch.  Anyone can send one, and false positives
+// make some clients fetch their bucket for nothing, so fetching does not
+// prove a client was dialed.
+type DialFilter struct {
+	Round  uint32
+	Filter *BloomFilter
+}
+
 type AnnounceConvoRound struct {
 	Round uint32
+	// Epoch is the PKI epoch of the round; Route's keys come from it.
+	Epoch uint64
+	// Route is the chain of servers that mixes the round.  Clients seal
+	// their onions to exactly these servers.
+	Route []RouteHop
+}
+
+// RouteHop is a server in an announced route.  Key is the fingerprint
+// of the server's public key, so that a client whose PKI lists another
+// key for the server does not seal to it.
+type RouteHop struct {
+	Server string
+	Key    string
+}
+
+// AnnounceConvoRetry is sent to the clients of a round that failed at a
+// mix server.  Each client seals the exchange it sent in Round again,
+// for Route and RetryRound, and sends it in a ConvoRequest for
+// RetryRound.  The replies come back as ConvoResponses for Round.
+type AnnounceConvoRetry struct {
+	Round      uint32
+	RetryRound uint32
+	Epoch      uint64
+	Route      []RouteHop
 }
 
 type AnnounceDialRound struct {
 	Round   uint32
 	Buckets uint32
+	// Epoch and Route are as in AnnounceConvoRound; dial rounds take
+	// routes chosen the same way as convo rounds.
+	Epoch uint64
+	Route []RouteHop
+	// Bloom is set when the round's buckets come as DialFilters.  Only
+	// then do clients tag their introductions.
+	Bloom bool
 }
@@ -0,0 +1,116 @@
+package vuvuzela
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"regexp"
+	"strconv"
+)
+
+// HopError reports the server at which a round broke down.  Servers
+// return it from ConvoService.Close (and over round streams), and each
+// server up the chain passes it along unchanged, so the entry server
+// learns which hop failed rather than only that its own call failed.
+type HopError struct {
+	// Server is the name of the server that failed or could not be
+	// reached, and Level is its level in the PKI (-1 if unknown).
+	Server string
+	Level  int
+
+	// Stage is the step of the round that failed: NewRound, Open, Add,
+	// Close, Get, Delete or Stream, or Round if it is not known.
+	Stage string
+	Round uint32
+
+	// Retryable is set when the server could not be reached or did not
+	// answer in time, so the round may succeed on a route without it.
+	// It is clear when the server answered with an error.
+	Retryable bool
+
+	// Cause is the text of the underlying error.
+	Cause string
+}
+
+// Error returns a line that AsHopError can parse back, since net/rpc
+// only carries the text of an error.
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop error: server=%q level=%d stage=%s round=%d retryable=%t: %s",
+		e.Server, e.Level, e.Stage, e.Round, e.Retryable, e.Cause)
+}
+
+var hopErrorPattern = regexp.MustCompile(`hop error: server=("(?:[^"\\]|\\.)*") level=(-?\d+) stage=(\w*) round=(\d+) retryable=(true|false): `)
+
+// AsHopError finds a HopError in err's chain or, failing that, in its
+// text, as it looks after crossing an RPC.
+func AsHopError(err error) (*HopError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	var hop *HopError
+	if errors.As(err, &hop) {
+		return hop, true
+	}
+
+	msg := err.Error()
+	m := hopErrorPattern.FindStringSubmatchIndex(msg)
+	if m == nil {
+		return nil, false
+	}
+	server, err := strconv.Unquote(msg[m[2]:m[3]])
+	if err != nil {
+		return nil, false
+	}
+	level, _ := strconv.Atoi(msg[m[4]:m[5]])
+	round, _ := strconv.ParseUint(msg[m[8]:m[9]], 10, 32)
+	return &HopError{
+		Server:    server,
+		Level:     level,
+		Stage:     msg[m[6]:m[7]],
+		Round:     uint32(round),
+		Retryable: msg[m[10]:m[11]] == "true",
+		Cause:     msg[m[1]:],
+	}, true
+}
+
+// stageError records which step of a round an error came from.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// BlameHop turns an error from a call to server into a HopError.  If
+// the error already names a hop further down the chain, that one is
+// returned so the original failure is what reaches the entry server.
+func BlameHop(pki *PKI, server string, round uint32, err error) *HopError {
+	if hop, ok := AsHopError(err); ok {
+		return hop
+	}
+
+	hop := &HopError{
+		Server: server,
+		Level:  -1,
+		Stage:  "Round",
+		Round:  round,
+		Cause:  err.Error(),
+	}
+	if info := pki.Servers[server]; info != nil {
+		hop.Level = info.Level
+	}
+	var stage *stageError
+	if errors.As(err, &stage) {
+		hop.Stage = stage.stage
+		hop.Cause = stage.err.Error()
+	}
+	var serverErr rpc.ServerError
+	hop.Retryable = !errors.As(err, &serverErr)
+	return hop
+}
@@ -0,0 +1,75 @@
+package vuvuzela
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"testing"
+
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+func TestHopErrorOverRPC(t *testing.T) {
+	hop := &HopError{
+		Server:    "local-middle0",
+		Level:     1,
+		Stage:     "NewRound",
+		Round:     7,
+		Retryable: true,
+		Cause:     "dial tcp 127.0.0.1:2719: connect: connection refused",
+	}
+	// what the entry server sees after two hops of net/rpc
+	err := &stageError{"Close", rpc.ServerError(fmt.Sprintf("Close: %s", hop))}
+
+	got, ok := AsHopError(err)
+	if !ok {
+		t.Fatalf("no hop error in %q", err)
+	}
+	if !reflect.DeepEqual(got, hop) {
+		t.Fatalf("got %#v, want %#v", got, hop)
+	}
+	if _, ok := AsHopError(rpc.ServerError("round 7 not found")); ok {
+		t.Fatalf("found a hop error in a plain error")
+	}
+}
+
+func TestHopErrorFromChain(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		chain := newConvoChain(t, streaming, 2)
+		last, err := vrpc.Dial("tcp", chain.pki.Servers["last"].Address, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer last.Close()
+
+		// The last server refuses the round from the first server
+		// because it already has it.
+		ctx := context.Background()
+		if err := NewConvoRound(ctx, last, 1, 0, chain.route); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewConvoRound(ctx, chain.first, 1, 0, chain.route); err != nil {
+			t.Fatal(err)
+		}
+		if streaming {
+			_, err = RunConvoRoundStream(ctx, chain.first, 1, nil)
+		} else {
+			_, err = RunConvoRound(ctx, chain.first, 1, nil)
+		}
+		if err == nil {
+			t.Fatalf("streaming=%t: round succeeded", streaming)
+		}
+		hop := BlameHop(chain.pki, "first", 1, err)
+		want := &HopError{
+			Server: "last",
+			Level:  1,
+			Stage:  "NewRound",
+			Round:  1,
+		}
+		hop.Cause = ""
+		if !reflect.DeepEqual(hop, want) {
+			t.Fatalf("streaming=%t: got %#v, want %#v", streaming, hop, want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+
+	. "vuvuzela.io/vuvuzela"
+)
+
+// ServerConf is the conf file of a mix server.
+type ServerConf struct {
+	ServerName string
+	PublicKey  *BoxKey
+	PrivateKey *BoxKey
+	ListenAddr string `json:",omitempty"`
+	DebugAddr  string `json:",omitempty"`
+
+	ConvoMu float64
+	ConvoB  float64
+
+	DialMu float64
+	DialB  float64
+}
+
+// EntryConf is the conf file of the entry server.
+type EntryConf struct {
+	PublicKey  *BoxKey
+	PrivateKey *BoxKey
+}
+
+// ClientConf is the conf file of a client.
+type ClientConf struct {
+	MyName       string
+	MyPublicKey  *BoxKey
+	MyPrivateKey *BoxKey
+}
+
+// WriteJSONFile writes val to path as indented JSON.  Conf files hold
+// private keys, so only the owner may read them.
+func WriteJSONFile(path string, val interface{}) error {
+	data, err := json.MarshalIndent(val, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,311 @@
+package vuvuzela
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// Membership is a view of which mix servers are up.
+type Membership struct {
+	// Epoch increases every time a server joins or leaves.
+	Epoch uint64
+	// PKIEpoch is the epoch of the PKI the view is drawn from.
+	PKIEpoch uint64
+	// Levels lists the live servers at each level, like
+	// PKI.ServerLevels, healthiest first.
+	Levels map[int][]string
+}
+
+// Live reports whether server is up.
+func (m *Membership) Live(server string) bool {
+	for _, servers := range m.Levels {
+		for _, s := range servers {
+			if s == server {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MembershipService keeps track of which mix servers are up.  Mix
+// servers register with it and send it heartbeats, and a server that
+// stops sending them is evicted, as is one the entry server reports
+// failed.  A server that has never registered is taken to be up until
+// it is evicted, so the service also works when the mix servers do not
+// use it.  Evicted servers come back by registering again.
+type MembershipService struct {
+	PKIStore *PKIStore
+
+	// HeartbeatTimeout is how long a registered server may go without
+	// a heartbeat before it is evicted.  Zero means never.
+	HeartbeatTimeout time.Duration
+
+	// OnChange, if set, is called with every new view, in order.
+	OnChange func(*Membership)
+
+	mu       sync.Mutex
+	pki      *PKI
+	lastSeen map[string]time.Time
+	evicted  map[string]bool
+	current  *Membership
+
+	notifyMu sync.Mutex
+	notified uint64
+}
+
+// MemberArgs names the server calling Register or Heartbeat.
+type MemberArgs struct {
+	Server string
+}
+
+func InitMembershipService(srv *MembershipService) {
+	srv.lastSeen = make(map[string]time.Time)
+	srv.evicted = make(map[string]bool)
+	srv.current = new(Membership)
+	srv.SetPKI(srv.PKIStore.Current())
+	if srv.HeartbeatTimeout > 0 {
+		go srv.evictLoop()
+	}
+}
+
+// Current returns the latest view.  It must not be modified.
+func (srv *MembershipService) Current() *Membership {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.current
+}
+
+// SetPKI moves the service to a new PKI.  Servers that have left the
+// PKI are forgotten, and servers new to it are taken to be up.
+func (srv *MembershipService) SetPKI(pki *PKI) {
+	srv.mu.Lock()
+	srv.pki = pki
+	for s := range srv.lastSeen {
+		if pki.Servers[s] == nil {
+			delete(srv.lastSeen, s)
+		}
+	}
+	for s := range srv.evicted {
+		if pki.Servers[s] == nil {
+			delete(srv.evicted, s)
+		}
+	}
+	m := srv.update()
+	srv.mu.Unlock()
+	srv.notify(m)
+}
+
+// update rebuilds the view; srv.mu must be held.  Servers that send
+// heartbeats come before those that have never registered, and the
+// level's server in ServerOrder comes first among equals, so that routes
+// stay on one replica of a level until it fails.
+func (srv *MembershipService) update() *Membership {
+	rank := func(level int, s string) int {
+		r := 0
+		if _, ok := srv.lastSeen[s]; !ok {
+			r += 2
+		}
+		if level >= len(srv.pki.ServerOrder) || srv.pki.ServerOrder[level] != s {
+			r++
+		}
+		return r
+	}
+	levels := make(map[int][]string, len(srv.pki.ServerLevels))
+	for level, servers := range srv.pki.ServerLevels {
+		live := make([]string, 0, len(servers))
+		for _, s := range servers {
+			if !srv.evicted[s] {
+				live = append(live, s)
+			}
+		}
+		sort.SliceStable(live, func(i, j int) bool {
+			return rank(level, live[i]) < rank(level, live[j])
+		})
+		levels[level] = live
+	}
+	srv.current = &Membership{
+		Epoch:    srv.current.Epoch + 1,
+		PKIEpoch: srv.pki.Epoch,
+		Levels:   levels,
+	}
+	return srv.current
+}
+
+func (srv *MembershipService) notify(m *Membership) {
+	if srv.OnChange == nil {
+		return
+	}
+	srv.notifyMu.Lock()
+	defer srv.notifyMu.Unlock()
+	if m.Epoch <= srv.notified {
+		// a newer view has been sent already
+		return
+	}
+	srv.notified = m.Epoch
+	srv.OnChange(m)
+}
+
+// Register RPC
+func (srv *MembershipService) Register(args *MemberArgs, reply *Membership) error {
+	srv.mu.Lock()
+	if srv.pki.Servers[args.Server] == nil {
+		srv.mu.Unlock()
+		return fmt.Errorf("server %q is not in the PKI (epoch %d)", args.Server, srv.pki.Epoch)
+	}
+	_, registered := srv.lastSeen[args.Server]
+	srv.lastSeen[args.Server] = time.Now()
+	var m *Membership
+	if !registered || srv.evicted[args.Server] {
+		// the server is back, or now counts as healthier
+		delete(srv.evicted, args.Server)
+		m = srv.update()
+	}
+	*reply = *srv.current
+	srv.mu.Unlock()
+
+	log.WithFields(log.Fields{"service": "membership", "rpc": "Register", "server": args.Server}).Info()
+	if m != nil {
+		srv.notify(m)
+	}
+	return nil
+}
+
+// Heartbeat RPC.  It fails for a server that is not registered, such as
+// one that has been evicted, which must register again.
+func (srv *MembershipService) Heartbeat(args *MemberArgs, reply *Membership) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.lastSeen[args.Server]; !ok {
+		return fmt.Errorf("server %q is not registered", args.Server)
+	}
+	srv.lastSeen[args.Server] = time.Now()
+	*reply = *srv.current
+	return nil
+}
+
+// Evict takes server out of the live levels until it registers again.
+// The entry server calls it for a server that failed a round; it is not
+// an RPC, so that mix servers cannot evict each other.
+func (srv *MembershipService) Evict(server, reason string) {
+	srv.mu.Lock()
+	var m *Membership
+	if !srv.evicted[server] && srv.pki.Servers[server] != nil {
+		srv.evicted[server] = true
+		delete(srv.lastSeen, server)
+		m = srv.update()
+	}
+	srv.mu.Unlock()
+
+	if m != nil {
+		log.WithFields(log.Fields{"service": "membership", "call": "Evict", "server": server, "epoch": m.Epoch}).Warn(reason)
+		srv.notify(m)
+	}
+}
+
+// Members RPC
+func (srv *MembershipService) Members(_ *struct{}, reply *Membership) error {
+	*reply = *srv.Current()
+	return nil
+}
+
+// A MembershipConn serves the membership service on one connection from
+// a mix server.  With PeerKey set, the connection may only register and
+// send heartbeats for servers that the PKI lists with that key.
+type MembershipConn struct {
+	Service *MembershipService
+	PeerKey *BoxKey
+}
+
+func (c *MembershipConn) checkPeer(server string) error {
+	if c.PeerKey == nil {
+		return nil
+	}
+	srv := c.Service
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	info := srv.pki.Servers[server]
+	if info == nil || info.PublicKey == nil || *info.PublicKey != *c.PeerKey {
+		return fmt.Errorf("peer %s is not server %q", c.PeerKey, server)
+	}
+	return nil
+}
+
+// Register RPC
+func (c *MembershipConn) Register(args *MemberArgs, reply *Membership) error {
+	if err := c.checkPeer(args.Server); err != nil {
+		return err
+	}
+	return c.Service.Register(args, reply)
+}
+
+// Heartbeat RPC
+func (c *MembershipConn) Heartbeat(args *MemberArgs, reply *Membership) error {
+	if err := c.checkPeer(args.Server); err != nil {
+		return err
+	}
+	return c.Service.Heartbeat(args, reply)
+}
+
+// Members RPC
+func (c *MembershipConn) Members(args *struct{}, reply *Membership) error {
+	return c.Service.Members(args, reply)
+}
+
+// evictLoop evicts registered servers whose heartbeats have stopped.
+func (srv *MembershipService) evictLoop() {
+	ticker := time.NewTicker(srv.HeartbeatTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []string
+		srv.mu.Lock()
+		for s, seen := range srv.lastSeen {
+			if time.Since(seen) > srv.HeartbeatTimeout {
+				expired = append(expired, s)
+			}
+		}
+		srv.mu.Unlock()
+
+		for _, s := range expired {
+			srv.Evict(s, "missed heartbeats")
+		}
+	}
+}
+
+// KeepMembership registers server with the membership service at client
+// and sends it a heartbeat every interval, registering again whenever a
+// heartbeat fails.  onChange, if set, is called with every new view the
+// service returns.  It does not return.
+func KeepMembership(client *vrpc.Client, server string, interval time.Duration, onChange func(*Membership)) {
+	var epoch uint64
+	registered := false
+	for ; ; time.Sleep(interval) {
+		method := "MembershipService.Heartbeat"
+		if !registered {
+			method = "MembershipService.Register"
+		}
+		m := new(Membership)
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := client.CallContext(ctx, method, &MemberArgs{Server: server}, m)
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{"service": "membership", "call": method}).Error(err)
+			registered = false
+			continue
+		}
+		registered = true
+		if m.Epoch != epoch {
+			epoch = m.Epoch
+			if onChange != nil {
+				onChange(m)
+			}
+		}
+	}
+}
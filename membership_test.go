@@ -0,0 +1,183 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+func membershipPKI() *PKI {
+	pki := &PKI{
+		Servers:      make(map[string]*ServerInfo),
+		ServerLevels: map[int][]string{0: {"first"}, 1: {"middle1", "middle2"}, 2: {"last"}},
+		ServerOrder:  []string{"first", "middle1", "last"},
+	}
+	for level, servers := range pki.ServerLevels {
+		for _, s := range servers {
+			pki.Servers[s] = &ServerInfo{Level: level}
+		}
+	}
+	return pki
+}
+
+func TestMembershipEvict(t *testing.T) {
+	var views []*Membership
+	srv := &MembershipService{
+		PKIStore: StaticPKIStore(membershipPKI()),
+		OnChange: func(m *Membership) { views = append(views, m) },
+	}
+	InitMembershipService(srv)
+	if !srv.Current().Live("middle1") || !srv.Current().Live("middle2") {
+		t.Fatalf("servers that never registered should be live")
+	}
+
+	srv.Evict("middle1", "test")
+	m := srv.Current()
+	if m.Live("middle1") || len(m.Levels[1]) != 1 {
+		t.Fatalf("middle1 not evicted: %v", m.Levels)
+	}
+	if len(views) != 2 || views[1].Epoch <= views[0].Epoch {
+		t.Fatalf("OnChange got %d views, want 2 with increasing epochs", len(views))
+	}
+	if err := srv.Heartbeat(&MemberArgs{Server: "middle1"}, m); err == nil {
+		t.Fatalf("heartbeat from an evicted server succeeded")
+	}
+
+	if err := srv.Register(&MemberArgs{Server: "middle1"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Live("middle1") {
+		t.Fatalf("middle1 not back after registering")
+	}
+	if err := srv.Heartbeat(&MemberArgs{Server: "middle1"}, m); err != nil {
+		t.Fatalf("Heartbeat: %s", err)
+	}
+	if err := srv.Register(&MemberArgs{Server: "middle3"}, m); err == nil {
+		t.Fatalf("registered a server that is not in the PKI")
+	}
+
+	// A new PKI without middle2 drops it.
+	pki := membershipPKI()
+	pki.Epoch = 1
+	pki.ServerLevels[1] = []string{"middle1"}
+	delete(pki.Servers, "middle2")
+	srv.SetPKI(pki)
+	if m := srv.Current(); m.PKIEpoch != 1 || m.Live("middle2") {
+		t.Fatalf("membership did not follow the PKI: %#v", m)
+	}
+}
+
+func TestMembershipHeartbeats(t *testing.T) {
+	srv := &MembershipService{
+		PKIStore:         StaticPKIStore(membershipPKI()),
+		HeartbeatTimeout: 200 * time.Millisecond,
+	}
+	InitMembershipService(srv)
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(srv); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go vrpc.NewServer(rpcServer, vrpc.GobCodec).Accept(l)
+	client, err := vrpc.Dial("tcp", l.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	views := make(chan *Membership, 16)
+	go KeepMembership(client, "middle1", 20*time.Millisecond, func(m *Membership) { views <- m })
+
+	// middle2 registers once and then goes quiet.
+	m := new(Membership)
+	if err := client.Call("MembershipService.Register", &MemberArgs{Server: "middle2"}, m); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m = <-views:
+		case <-timeout:
+			t.Fatalf("middle2 was not evicted")
+		}
+		if !m.Live("middle2") {
+			break
+		}
+	}
+	if !m.Live("middle1") {
+		t.Fatalf("middle1 was evicted even though it sends heartbeats")
+	}
+}
+
+func TestMembershipOrder(t *testing.T) {
+	srv := &MembershipService{PKIStore: StaticPKIStore(membershipPKI())}
+	InitMembershipService(srv)
+	if got := srv.Current().Levels[1]; got[0] != "middle1" {
+		t.Fatalf("level 1 is %v, want the ServerOrder server first", got)
+	}
+
+	// A server that sends heartbeats comes before one that never has.
+	m := new(Membership)
+	if err := srv.Register(&MemberArgs{Server: "middle2"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Levels[1]; got[0] != "middle2" {
+		t.Fatalf("level 1 is %v, want middle2 first", got)
+	}
+	if err := srv.Register(&MemberArgs{Server: "middle1"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Levels[1]; got[0] != "middle1" {
+		t.Fatalf("level 1 is %v, want middle1 first", got)
+	}
+}
+
+func TestMembershipConn(t *testing.T) {
+	pki := membershipPKI()
+	keys := make(map[string]*BoxKey)
+	for name, info := range pki.Servers {
+		public, _, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info.PublicKey = public
+		keys[name] = public
+	}
+	srv := &MembershipService{PKIStore: StaticPKIStore(pki)}
+	InitMembershipService(srv)
+
+	conn := &MembershipConn{Service: srv, PeerKey: keys["middle1"]}
+	m := new(Membership)
+	if err := conn.Register(&MemberArgs{Server: "middle2"}, m); err == nil {
+		t.Fatalf("middle1 registered as middle2")
+	}
+	if err := conn.Register(&MemberArgs{Server: "middle1"}, m); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+	if err := conn.Heartbeat(&MemberArgs{Server: "middle1"}, m); err != nil {
+		t.Fatalf("Heartbeat: %s", err)
+	}
+	srv.Register(&MemberArgs{Server: "middle2"}, m)
+	if err := conn.Heartbeat(&MemberArgs{Server: "middle2"}, m); err == nil {
+		t.Fatalf("middle1 sent a heartbeat for middle2")
+	}
+	if err := conn.Register(&MemberArgs{Server: "middle3"}, m); err == nil {
+		t.Fatalf("registered a server that is not in the PKI")
+	}
+
+	// Without a peer key, as without -secure, any server may register.
+	open := &MembershipConn{Service: srv}
+	if err := open.Register(&MemberArgs{Server: "last"}, m); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+}
@@ -4,9 +4,9 @@ package vuvuzela
 
 import "fmt"
 
-const _MsgType_name = "MsgConvoRequestMsgDialRequestMsgBadRequestErrorMsgConvoErrorMsgConvoResponseMsgDialErrorMsgDialBucketMsgAnnounceConvoRoundMsgAnnounceDialRound"
+const _MsgType_name = "MsgConvoRequestMsgDialRequestMsgDialFetchMsgBadRequestErrorMsgConvoErrorMsgConvoResponseMsgDialErrorMsgDialBucketMsgAnnounceConvoRoundMsgAnnounceDialRoundMsgAnnounceConvoRetryMsgAnnounceMembershipMsgDialFilterMsgPrivacyLoss"
 
-var _MsgType_index = [...]uint8{0, 15, 29, 47, 60, 76, 88, 101, 122, 142}
+var _MsgType_index = [...]uint8{0, 15, 29, 41, 59, 72, 88, 100, 113, 134, 154, 175, 196, 209, 223}
 
 func (i MsgType) String() string {
 	if i >= MsgType(len(_MsgType_index)-1) {
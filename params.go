@@ -7,13 +7,54 @@ import (
 const (
 	SizeMessage = 240
 
-	// Eventually this might be dynamic, but one bucket is usually
-	// sufficient if users don't dial very often.
-	TotalDialBuckets = 1
+	// The entry server picks the number of dial buckets each round so
+	// that a bucket holds about DialBucketIntros introductions, but it
+	// never has fewer than DialBucketClients clients share a bucket.
+	// The noise every server adds to a bucket counts towards its size,
+	// so DialBucketIntros must be well above it.
+	DialBucketIntros  = 10000
+	DialBucketClients = 1000
+
+	// The Laplace noise new mix servers are configured with.  The
+	// entry server accounts for privacy with these unless told
+	// otherwise.
+	DefaultConvoMu = 1000
+	DefaultConvoB  = 4
+	DefaultDialMu  = 100
+	DefaultDialB   = 4
+
+	// The δ' the entry server's privacy accountant trades for a
+	// smaller ε.
+	DefaultDeltaSlack = 1e-4
 
 	DialWait           = 10 * time.Second
 	DefaultReceiveWait = 5 * time.Second
 
+	// How long a server waits on the next server in the chain
+	// before giving up on a round.
+	DefaultRoundTimeout = 60 * time.Second
+
+	// How long a server keeps a round before aborting it as abandoned.
+	// This must be longer than a round normally takes, including the
+	// round timeout.
+	DefaultRoundLifetime = 5 * time.Minute
+
+	// How many deleted dial rounds the last server keeps for clients
+	// that fetch their buckets late.
+	DefaultDialRetainRounds = 10
+
+	// How many PKI epochs before the current one a PKIStore keeps, so
+	// that rounds started before a reload can finish.
+	DefaultKeepEpochs = 4
+
+	// How often a watched PKI file is checked for changes.
+	DefaultPKIPollInterval = 10 * time.Second
+
+	// How often mix servers send heartbeats to the membership service,
+	// and how long it waits for one before evicting a server.
+	DefaultHeartbeatInterval = 2 * time.Second
+	DefaultHeartbeatTimeout  = 10 * time.Second
+
 	DefaultServerAddr = ":2718"
 	DefaultServerPort = "2718"
 )
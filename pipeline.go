@@ -0,0 +1,59 @@
+package vuvuzela
+
+import (
+	"context"
+	"sync"
+)
+
+// Pipeline limits how many rounds a server works on at once.  A round
+// takes a slot in NewRound and gives it back once the next server has
+// accepted the round (or, at the last server, once the round is mixed),
+// so with a depth of d a server can collect round N+d-1 while rounds N
+// to N+d-2 are still further down the chain.  A depth of 1 runs one
+// round at a time.
+type Pipeline struct {
+	slots chan struct{}
+}
+
+func NewPipeline(depth int) *Pipeline {
+	if depth < 1 {
+		depth = 1
+	}
+	return &Pipeline{
+		slots: make(chan struct{}, depth),
+	}
+}
+
+// Depth returns the number of rounds that may be in flight.
+func (p *Pipeline) Depth() int {
+	return cap(p.slots)
+}
+
+// InFlight returns the number of slots that are taken.
+func (p *Pipeline) InFlight() int {
+	return len(p.slots)
+}
+
+// Acquire waits for a free slot.  The returned function gives the slot
+// back; calling it more than once has no further effect.
+func (p *Pipeline) Acquire() (release func()) {
+	p.slots <- struct{}{}
+	return p.release()
+}
+
+// AcquireContext is like Acquire, but gives up when ctx is done.
+func (p *Pipeline) AcquireContext(ctx context.Context) (release func(), err error) {
+	select {
+	case p.slots <- struct{}{}:
+		return p.release(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pipeline) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-p.slots })
+	}
+}
@@ -0,0 +1,133 @@
+package vuvuzela
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestPipeline(t *testing.T) {
+	p := NewPipeline(2)
+	release1 := p.Acquire()
+	release2 := p.Acquire()
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- p.Acquire()
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("acquired a third slot with a depth of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Releasing twice gives back one slot, not two.
+	release1()
+	release1()
+	release3 := <-acquired
+	if n := p.InFlight(); n != 2 {
+		t.Fatalf("%d slots in flight, want 2", n)
+	}
+
+	release2()
+	release3()
+	if n := p.InFlight(); n != 0 {
+		t.Fatalf("%d slots in flight after releasing all, want 0", n)
+	}
+}
+
+func TestPipelineAcquireContext(t *testing.T) {
+	p := NewPipeline(1)
+	release, err := p.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.AcquireContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("AcquireContext with no free slot: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := p.InFlight(); n != 1 {
+		t.Fatalf("%d slots in flight, want 1", n)
+	}
+
+	release()
+	if _, err := p.AcquireContext(context.Background()); err != nil {
+		t.Fatalf("AcquireContext after release: %s", err)
+	}
+}
+
+// TestNewRoundSlotTimeout checks that NewRound gives up on a full
+// pipeline after Timeout instead of starting the round late.
+func TestNewRoundSlotTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	public, private, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := []string{"last"}
+	convo := &ConvoService{
+		Pipeline: NewPipeline(1),
+		PKI: &PKI{
+			Servers:     map[string]*ServerInfo{"last": {PublicKey: public}},
+			ServerOrder: route,
+		},
+		ServerName: "last",
+		PrivateKey: private,
+		LastServer: true,
+		Timeout:    timeout,
+	}
+	InitConvoService(convo)
+	_, dials, _ := newDialServers(t, route, 1)
+	dial := dials[0]
+	dial.Timeout = timeout
+
+	newRound := map[string]func(round uint32) error{
+		"convo": func(round uint32) error {
+			return convo.NewRound(&ConvoNewRoundArgs{Round: round, Route: route}, nil)
+		},
+		"dial": func(round uint32) error {
+			return dial.NewRound(&DialNewRoundArgs{Round: round, Route: route, Buckets: 1}, nil)
+		},
+	}
+	exists := map[string]func(round uint32) bool{
+		"convo": func(round uint32) bool {
+			convo.roundsMu.RLock()
+			defer convo.roundsMu.RUnlock()
+			return convo.rounds[round] != nil
+		},
+		"dial": func(round uint32) bool {
+			dial.roundsMu.RLock()
+			defer dial.roundsMu.RUnlock()
+			return dial.rounds[round] != nil
+		},
+	}
+	for _, service := range []string{"convo", "dial"} {
+		if err := newRound[service](1); err != nil {
+			t.Fatalf("%s: NewRound: %s", service, err)
+		}
+		start := time.Now()
+		err := newRound[service](2)
+		if err == nil || !strings.Contains(err.Error(), "no free pipeline slot") {
+			t.Fatalf("%s: NewRound with a full pipeline: got %v", service, err)
+		}
+		if d := time.Since(start); d < timeout {
+			t.Fatalf("%s: NewRound gave up after %s, want %s", service, d, timeout)
+		}
+		if exists[service](2) {
+			t.Fatalf("%s: round 2 was created", service)
+		}
+	}
+
+	// Once the slot is free, the round starts.
+	if err := convo.Delete(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := newRound["convo"](2); err != nil {
+		t.Fatalf("convo: NewRound after Delete: %s", err)
+	}
+}
@@ -1,51 +1,219 @@
 package vuvuzela
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sort"
 	"strings"
 
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 
 	"vuvuzela.io/crypto/onionbox"
-	. "vuvuzela.io/vuvuzela/internal"
 )
 
 type ServerInfo struct {
 	Address   string
 	PublicKey *BoxKey
-  Level     int `json:",string"`
+	Level     int `json:",string"`
+
+	// Capacity is the server's share of rounds, relative to the other
+	// servers at its level, when routes are weighted.  Zero counts as one.
+	Capacity int `json:",omitempty"`
+}
+
+func (info *ServerInfo) weight() int {
+	if info.Capacity == 0 {
+		return 1
+	}
+	return info.Capacity
 }
 
 type PKI struct {
-	People      map[string]*BoxKey
-	Servers     map[string]*ServerInfo
-  ServerLevels map[int][]string
-	ServerOrder []string
-	EntryServer string
+	// Epoch numbers versions of the PKI; every new version must have a
+	// higher epoch than the one it replaces.
+	Epoch uint64 `json:",omitempty"`
+
+	People       map[string]*BoxKey
+	Servers      map[string]*ServerInfo
+	ServerLevels map[int][]string
+	ServerOrder  []string
+	EntryServer  string
+
+	// EntryServerKey identifies the entry server to the mix servers
+	// when they use the secure transport.
+	EntryServerKey *BoxKey `json:",omitempty"`
+
+	// MembershipServer is the address of the membership service that
+	// mix servers register with.  It is usually run by the entry server.
+	MembershipServer string `json:",omitempty"`
+}
+
+// ReadPKI reads and validates a PKI file, signed or not, without
+// checking the signature.  Use a PKIStore to verify it and pick up
+// changes.
+func ReadPKI(jsonPath string) (*PKI, error) {
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	pki, err := DecodePKI(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", jsonPath, err)
+	}
+	return pki, nil
 }
 
-func ReadPKI(jsonPath string) *PKI {
-	pki := new(PKI)
-	ReadJSONFile(jsonPath, pki)
+// check validates the PKI and fills in the default port of servers
+// that do not give one.
+func (pki *PKI) check() error {
+	if err := pki.Validate(); err != nil {
+		return err
+	}
+	for _, info := range pki.Servers {
+		if strings.IndexByte(info.Address, ':') == -1 {
+			info.Address = net.JoinHostPort(info.Address, DefaultServerPort)
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem with the PKI, one per line:
+//
+//   - servers without an address or public key;
+//   - ServerOrder entries that are unknown;
+//   - ServerLevels entries that are unknown, gaps between levels, and
+//     servers whose Level does not match the level that lists them;
+//   - replicas at the same level with different public keys;
+//   - servers that share a public key with a server at another level.
+//
+// All servers at a level are replicas that run the level's key, so
+// that a round can go through any of them.  A PKI without ServerLevels
+// is a plain chain, and its levels are not checked.
+func (pki *PKI) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	names := make([]string, 0, len(pki.Servers))
+	for name := range pki.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := pki.Servers[name]
+		if info == nil {
+			fail("server %q: no ServerInfo", name)
+			continue
+		}
+		if info.Address == "" {
+			fail("server %q does not specify an Address", name)
+		}
+		if info.PublicKey == nil {
+			fail("server %q does not specify a PublicKey", name)
+		}
+		if info.Capacity < 0 {
+			fail("server %q has a negative Capacity", name)
+		}
+	}
+
 	if len(pki.ServerOrder) == 0 {
-		log.Fatalf("%q: ServerOrder must contain at least one server", jsonPath)
+		fail("ServerOrder must contain at least one server")
 	}
 	for _, s := range pki.ServerOrder {
-		info, ok := pki.Servers[s]
-		if !ok {
-			log.Fatalf("%q: server %q not found", jsonPath, s)
+		if pki.Servers[s] == nil {
+			fail("ServerOrder: server %q not found", s)
+		}
+	}
+
+	// levelOf is where ServerLevels puts each server, or for a plain
+	// chain, where ServerOrder puts it.
+	levelOf := make(map[string]int)
+	if len(pki.ServerLevels) == 0 {
+		for i, s := range pki.ServerOrder {
+			levelOf[s] = i
+		}
+	} else {
+		for level := range pki.ServerLevels {
+			if level < 0 || level >= len(pki.ServerLevels) {
+				fail("ServerLevels: level %d is out of range; levels must be numbered 0 to %d with no gaps", level, len(pki.ServerLevels)-1)
+			}
+		}
+		for level := 0; level < len(pki.ServerLevels); level++ {
+			servers, ok := pki.ServerLevels[level]
+			if !ok {
+				fail("ServerLevels: level %d is missing", level)
+				continue
+			}
+			if len(servers) == 0 {
+				fail("ServerLevels: level %d has no servers", level)
+			}
+			// keyOf is the first server at the level with a key, which
+			// the level's other replicas must share.
+			keyOf := ""
+			for _, s := range servers {
+				if prev, ok := levelOf[s]; ok {
+					fail("ServerLevels: server %q is listed at levels %d and %d", s, prev, level)
+					continue
+				}
+				levelOf[s] = level
+				info := pki.Servers[s]
+				if info == nil {
+					fail("ServerLevels: server %q at level %d not found", s, level)
+				} else if info.Level != level {
+					fail("server %q has Level %d but ServerLevels lists it at level %d", s, info.Level, level)
+				}
+				if info == nil || info.PublicKey == nil {
+					continue
+				}
+				if keyOf == "" {
+					keyOf = s
+				} else if *info.PublicKey != *pki.Servers[keyOf].PublicKey {
+					fail("servers %q and %q are replicas at level %d but do not have the same PublicKey", keyOf, s, level)
+				}
+			}
 		}
-		addr := info.Address
-		if addr == "" {
-			log.Fatalf("%q: server %q does not specify an Address", jsonPath, s)
+		for _, name := range names {
+			if _, ok := levelOf[name]; !ok && pki.Servers[name] != nil {
+				fail("server %q (Level %d) is not listed in ServerLevels", name, pki.Servers[name].Level)
+			}
 		}
+		if len(pki.ServerOrder) != len(pki.ServerLevels) {
+			fail("ServerOrder has %d servers but there are %d levels", len(pki.ServerOrder), len(pki.ServerLevels))
+		}
+		for i, s := range pki.ServerOrder {
+			if level, ok := levelOf[s]; ok && level != i {
+				fail("ServerOrder: server %q is at position %d but at level %d", s, i, level)
+			}
+		}
+	}
 
-		if strings.IndexByte(addr, ':') == -1 {
-			info.Address = net.JoinHostPort(addr, DefaultServerPort)
+	keyOwner := make(map[BoxKey]string)
+	for _, name := range names {
+		info := pki.Servers[name]
+		if info == nil || info.PublicKey == nil {
+			continue
+		}
+		other, ok := keyOwner[*info.PublicKey]
+		if !ok {
+			keyOwner[*info.PublicKey] = name
+			continue
+		}
+		level, ok1 := levelOf[name]
+		otherLevel, ok2 := levelOf[other]
+		if !ok1 || !ok2 || level != otherLevel {
+			fail("servers %q and %q have the same PublicKey but are not at the same level", other, name)
+		}
+	}
+	if pki.EntryServerKey != nil {
+		if owner, ok := keyOwner[*pki.EntryServerKey]; ok {
+			fail("EntryServerKey is also the PublicKey of server %q", owner)
 		}
 	}
-	return pki
+
+	return errors.Join(errs...)
 }
 
 func (pki *PKI) ServerKeys(route []string) BoxKeys {
@@ -79,6 +247,24 @@ func (pki *PKI) Index(serverName string, route []string) int {
 	return -1
 }
 
+// checkPosition returns an error unless serverName is on route, and is
+// at its end exactly when last is set: a server that is not on the route
+// cannot tell where to forward, and one that does not know the next
+// server's key cannot add noise for it.
+func (pki *PKI) checkPosition(serverName string, route []string, last bool) error {
+	i := pki.Index(serverName, route)
+	if i == -1 {
+		return fmt.Errorf("server %q is not on the route %v", serverName, route)
+	}
+	if last != (i == len(route)-1) {
+		if last {
+			return fmt.Errorf("last server %q is not at the end of the route %v", serverName, route)
+		}
+		return fmt.Errorf("server %q is at the end of the route %v, but it is not the last server", serverName, route)
+	}
+	return nil
+}
+
 func (pki *PKI) NextServerName(serverName string, route []string) string {
 	// What if the server is not in the route?
 	i := pki.Index(serverName, route)
@@ -116,17 +302,110 @@ func (pki *PKI) NextServers(serverName string) []string {
 
 
 }
-func (pki *PKI) SkipServer(serverName string, route []string) string {
-	i := pki.Index(serverName, route)
-  if i == -1{
-    return ""
-  }
-	if i < len(route)-2 {
-		s:= route[i+2]
-		return pki.Servers[s].Address		
-	} else {
-		return ""
+
+// RepairRoute replaces the server at failed's level in route with
+// another server at that level.  The server in route may differ from
+// failed when the round failed over to it.  levels lists the servers
+// that are up at each level, healthiest first, as Membership.Levels
+// does; nil means the PKI's ServerLevels.  It returns an error if no
+// other server is up at that level, since a route that leaves a level
+// out gives up that level's noise.
+func (pki *PKI) RepairRoute(route []string, failed string, levels map[int][]string) ([]string, error) {
+	if levels == nil {
+		levels = pki.ServerLevels
+	}
+	info := pki.Servers[failed]
+	if info == nil || len(pki.ServerLevels) == 0 {
+		return nil, fmt.Errorf("no other server can take the place of %q", failed)
+	}
+	var others []string
+	for _, s := range levels[info.Level] {
+		if s != failed && pki.Servers[s] != nil {
+			others = append(others, s)
+		}
+	}
+	if len(others) == 0 {
+		return nil, fmt.Errorf("no other server is up at level %d", info.Level)
+	}
+
+	repaired := make([]string, 0, len(route))
+	for _, s := range route {
+		hop := pki.Servers[s]
+		if s != failed && (hop == nil || hop.Level != info.Level) {
+			repaired = append(repaired, s)
+		} else {
+			repaired = append(repaired, others[0])
+		}
+	}
+	return repaired, nil
+}
+
+// AnnounceRoute describes route for clients.
+func (pki *PKI) AnnounceRoute(route []string) []RouteHop {
+	hops := make([]RouteHop, len(route))
+	for i, s := range route {
+		hops[i] = RouteHop{
+			Server: s,
+			Key:    pki.Servers[s].PublicKey.Fingerprint(),
+		}
+	}
+	return hops
+}
+
+// VerifyRoute checks an announced route against the PKI and returns the
+// names of its servers.
+func (pki *PKI) VerifyRoute(hops []RouteHop) ([]string, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("empty route")
 	}
+	route := make([]string, len(hops))
+	for i, hop := range hops {
+		info, ok := pki.Servers[hop.Server]
+		if !ok {
+			return nil, fmt.Errorf("unknown server %q in route", hop.Server)
+		}
+		if info.PublicKey.Fingerprint() != hop.Key {
+			return nil, fmt.Errorf("server %q: key fingerprint %s does not match the PKI", hop.Server, hop.Key)
+		}
+		route[i] = hop.Server
+	}
+	return route, nil
+}
+
+// UpstreamKeys returns the keys of the peers that may call serverName:
+// the servers at the level before it, and the entry server at the first
+// level, where it starts rounds, and at the last, where it fetches dial
+// buckets.  In a plain chain, ServerOrder gives the levels.
+func (pki *PKI) UpstreamKeys(serverName string) BoxKeys {
+	levels := pki.ServerLevels
+	if len(levels) == 0 {
+		levels = make(map[int][]string, len(pki.ServerOrder))
+		for i, s := range pki.ServerOrder {
+			levels[i] = []string{s}
+		}
+	}
+	level := -1
+	for l, servers := range levels {
+		for _, s := range servers {
+			if s == serverName {
+				level = l
+			}
+		}
+	}
+	if level == -1 {
+		return nil
+	}
+
+	var keys BoxKeys
+	for _, s := range levels[level-1] {
+		if info := pki.Servers[s]; info != nil {
+			keys = append(keys, info.PublicKey)
+		}
+	}
+	if pki.EntryServerKey != nil && (level == 0 || level == len(levels)-1) {
+		keys = append(keys, pki.EntryServerKey)
+	}
+	return keys
 }
 
 func (pki *PKI) NextServerKeys(serverName string, route []string) BoxKeys {
@@ -0,0 +1,251 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignedPKI is a PKI document signed by the operator:
+//
+//	{"PKI": {...}, "Signature": "<base32 ed25519 signature>"}
+//
+// The signature covers the exact bytes of the PKI value, so the
+// document needs no canonical encoding.
+type SignedPKI struct {
+	PKI       json.RawMessage
+	Signature string
+}
+
+// SignPKI encodes pki and signs it with the operator's key.
+func SignPKI(pki *PKI, operatorKey ed25519.PrivateKey) (*SignedPKI, error) {
+	body, err := json.MarshalIndent(pki, "  ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPKI{
+		PKI:       body,
+		Signature: base32.EncodeToString(ed25519.Sign(operatorKey, body)),
+	}, nil
+}
+
+// ParseOperatorKey decodes an operator's base32 ed25519 public key.
+func ParseOperatorKey(s string) (ed25519.PublicKey, error) {
+	b, err := base32.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("base32 decode error: %s", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("operator key is %d bytes, want %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// DecodePKI decodes a PKI file, signed or not.  If operatorKey is set,
+// the file must be signed with it.
+func DecodePKI(data []byte, operatorKey ed25519.PublicKey) (*PKI, error) {
+	var signed SignedPKI
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+
+	body := data
+	if signed.Signature != "" {
+		sig, err := base32.DecodeString(signed.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("signature: base32 decode error: %s", err)
+		}
+		if operatorKey != nil && !ed25519.Verify(operatorKey, signed.PKI, sig) {
+			return nil, fmt.Errorf("bad signature")
+		}
+		body = signed.PKI
+	} else if operatorKey != nil {
+		return nil, fmt.Errorf("PKI is not signed")
+	}
+
+	pki := new(PKI)
+	if err := json.Unmarshal(body, pki); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if err := pki.check(); err != nil {
+		return nil, err
+	}
+	return pki, nil
+}
+
+// PKIStore holds the PKI of the current epoch along with those of the
+// few epochs before it, so that rounds started before a reload can
+// finish with the PKI they started with.
+type PKIStore struct {
+	Path        string
+	OperatorKey ed25519.PublicKey
+
+	// KeepEpochs is how many epochs before the current one are kept.
+	KeepEpochs int
+
+	mu      sync.RWMutex
+	current *PKI
+	data    []byte
+	epochs  map[uint64]*PKI
+	modTime time.Time
+}
+
+// LoadPKIStore reads the PKI at path.  If operatorKey is set, the PKI
+// must be signed with it, now and on every reload.
+func LoadPKIStore(path string, operatorKey ed25519.PublicKey) (*PKIStore, error) {
+	s := &PKIStore{
+		Path:        path,
+		OperatorKey: operatorKey,
+		KeepEpochs:  DefaultKeepEpochs,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// StaticPKIStore returns a store that holds pki and has no file to
+// reload from.
+func StaticPKIStore(pki *PKI) *PKIStore {
+	return &PKIStore{
+		current: pki,
+		epochs:  map[uint64]*PKI{pki.Epoch: pki},
+	}
+}
+
+// Current returns the PKI of the latest epoch.
+func (s *PKIStore) Current() *PKI {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Epoch returns the PKI of the given epoch.  An epoch newer than the
+// current one means the file has changed under us (another server
+// reloaded first), so the store reloads once before giving up.
+func (s *PKIStore) Epoch(epoch uint64) (*PKI, error) {
+	s.mu.RLock()
+	pki, ok := s.epochs[epoch]
+	current := s.current.Epoch
+	s.mu.RUnlock()
+	if ok {
+		return pki, nil
+	}
+
+	if epoch > current && s.Path != "" {
+		if err := s.Reload(); err != nil {
+			return nil, fmt.Errorf("epoch %d: reload: %s", epoch, err)
+		}
+		s.mu.RLock()
+		pki, ok = s.epochs[epoch]
+		s.mu.RUnlock()
+		if ok {
+			return pki, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown PKI epoch %d (current epoch is %d)", epoch, current)
+}
+
+// Reload reads the file again.  A PKI with the same epoch must be
+// unchanged, and one with an older epoch is refused.
+func (s *PKIStore) Reload() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	pki, err := DecodePKI(data, s.OperatorKey)
+	if err != nil {
+		return fmt.Errorf("%q: %s", s.Path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modTime = info.ModTime()
+	if s.current != nil {
+		switch {
+		case pki.Epoch < s.current.Epoch:
+			return fmt.Errorf("%q: epoch %d is older than the current epoch %d", s.Path, pki.Epoch, s.current.Epoch)
+		case pki.Epoch == s.current.Epoch:
+			if !bytes.Equal(data, s.data) {
+				return fmt.Errorf("%q: epoch %d changed without a new epoch number", s.Path, pki.Epoch)
+			}
+			return nil
+		}
+	}
+
+	if s.epochs == nil {
+		s.epochs = make(map[uint64]*PKI)
+	}
+	s.current = pki
+	s.data = data
+	s.epochs[pki.Epoch] = pki
+	for epoch := range s.epochs {
+		if epoch+uint64(s.KeepEpochs) < pki.Epoch {
+			delete(s.epochs, epoch)
+		}
+	}
+	return nil
+}
+
+// roundPKI returns the PKI for a round started in epoch: the store's
+// PKI of that epoch, or pki if there is no store.
+func roundPKI(pki *PKI, store *PKIStore, epoch uint64) (*PKI, error) {
+	if store == nil {
+		return pki, nil
+	}
+	return store.Epoch(epoch)
+}
+
+// Watch reloads the store on SIGHUP and whenever the file's
+// modification time changes, checking every interval.  onReload, if not
+// nil, is called with each new PKI.  A PKI that fails to load is logged
+// and the current one is kept.
+func (s *PKIStore) Watch(interval time.Duration, onReload func(*PKI)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(s.Path)
+			if err != nil {
+				log.WithFields(log.Fields{"pki": s.Path, "call": "Stat"}).Error(err)
+				continue
+			}
+			s.mu.RLock()
+			changed := !info.ModTime().Equal(s.modTime)
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+
+		old := s.Current()
+		if err := s.Reload(); err != nil {
+			log.WithFields(log.Fields{"pki": s.Path, "call": "Reload"}).Error(err)
+			continue
+		}
+		if pki := s.Current(); pki != old {
+			log.WithFields(log.Fields{"pki": s.Path, "epoch": pki.Epoch}).Info("reloaded PKI")
+			if onReload != nil {
+				onReload(pki)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package vuvuzela
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func epochPKI(epoch uint64) *PKI {
+	pki := *testPKI
+	pki.Epoch = epoch
+	return &pki
+}
+
+func writePKI(t *testing.T, path string, pki *PKI, key ed25519.PrivateKey) {
+	var v interface{} = pki
+	if key != nil {
+		signed, err := SignPKI(pki, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v = signed
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignedPKI(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pki.conf")
+
+	writePKI(t, path, epochPKI(1), private)
+	s, err := LoadPKIStore(path, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pki := s.Current(); pki.Epoch != 1 || pki.Servers["openstack2"] == nil {
+		t.Fatalf("wrong PKI: %#v", pki)
+	}
+	if _, err := LoadPKIStore(path, otherPublic); err == nil {
+		t.Fatalf("accepted a PKI signed with another key")
+	}
+
+	writePKI(t, path, epochPKI(1), nil)
+	if _, err := LoadPKIStore(path, public); err == nil {
+		t.Fatalf("accepted an unsigned PKI")
+	}
+	if _, err := LoadPKIStore(path, nil); err != nil {
+		t.Fatalf("unsigned PKI without an operator key: %s", err)
+	}
+}
+
+func TestPKIStoreEpochs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pki.conf")
+	writePKI(t, path, epochPKI(5), nil)
+	s, err := LoadPKIStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.KeepEpochs = 1
+
+	// Another server has moved on to epoch 6; asking for it reloads.
+	writePKI(t, path, epochPKI(6), nil)
+	pki, err := s.Epoch(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pki.Epoch != 6 || s.Current() != pki {
+		t.Fatalf("epoch 6 is not current")
+	}
+	if _, err := s.Epoch(5); err != nil {
+		t.Fatalf("epoch 5 was dropped: %s", err)
+	}
+
+	writePKI(t, path, epochPKI(4), nil)
+	if err := s.Reload(); err == nil {
+		t.Fatalf("rolled back to epoch 4")
+	}
+	changed := epochPKI(6)
+	changed.ServerOrder = []string{"openstack1"}
+	writePKI(t, path, changed, nil)
+	if err := s.Reload(); err == nil {
+		t.Fatalf("accepted a changed PKI with the same epoch")
+	}
+
+	writePKI(t, path, epochPKI(7), nil)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Epoch(5); err == nil {
+		t.Fatalf("epoch 5 is still kept")
+	}
+	if _, err := s.Epoch(6); err != nil {
+		t.Fatalf("epoch 6 was dropped: %s", err)
+	}
+	if _, err := s.Epoch(8); err == nil {
+		t.Fatalf("found an epoch that does not exist")
+	}
+}
@@ -1,6 +1,7 @@
 package vuvuzela
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -49,3 +50,146 @@ func TestRemoveServer(t *testing.T) {
 //		t.Fatalf("fail to remove a server that exist")
 //	}
 }
+
+func TestVerifyRoute(t *testing.T) {
+	hops := testPKI.AnnounceRoute(testPKI.ServerOrder)
+	route, err := testPKI.VerifyRoute(hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(route) != 2 || route[0] != "openstack1" || route[1] != "openstack2" {
+		t.Fatalf("wrong route: %v", route)
+	}
+
+	hops[1].Key = testPKI.Servers["openstack1"].PublicKey.Fingerprint()
+	if _, err := testPKI.VerifyRoute(hops); err == nil {
+		t.Fatalf("accepted a route with the wrong key")
+	}
+	if _, err := testPKI.VerifyRoute([]RouteHop{{Server: "openstack3"}}); err == nil {
+		t.Fatalf("accepted a route with an unknown server")
+	}
+	if _, err := testPKI.VerifyRoute(nil); err == nil {
+		t.Fatalf("accepted an empty route")
+	}
+}
+
+func TestValidatePKI(t *testing.T) {
+	middleKey := Key("349bs143gvm7n0kxwhsaayeta2ptjrybwf37s4j7sj0yfrc3dxs0")
+	leveled := func() *PKI {
+		return &PKI{
+			Servers: map[string]*ServerInfo{
+				"first":   {Address: "localhost:2718", PublicKey: Key("pd04y1ryrfxtrayjg9f4cfsw1ayfhwrcfd7g7emhfjrsc4cd20f0"), Level: 0},
+				"middle1": {Address: "localhost:3719", PublicKey: middleKey, Level: 1},
+				"middle2": {Address: "localhost:3720", PublicKey: middleKey, Level: 1},
+				"last":    {Address: "localhost:2720", PublicKey: Key("fkaf8ds0a4fmdsztqzpcn4em9npyv722bxv2683n9fdydzdjwgy0"), Level: 2},
+			},
+			ServerLevels: map[int][]string{
+				0: {"first"},
+				1: {"middle1", "middle2"},
+				2: {"last"},
+			},
+			ServerOrder: []string{"first", "middle1", "last"},
+		}
+	}
+	if err := leveled().Validate(); err != nil {
+		t.Fatalf("valid PKI: %s", err)
+	}
+	if err := testPKI.Validate(); err != nil {
+		t.Fatalf("valid chain: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(pki *PKI)
+		want   string
+	}{
+		{"unknown server", func(pki *PKI) {
+			pki.ServerLevels[1] = append(pki.ServerLevels[1], "middle3")
+		}, `server "middle3" at level 1 not found`},
+		{"gap", func(pki *PKI) {
+			pki.ServerLevels[3] = pki.ServerLevels[2]
+			delete(pki.ServerLevels, 2)
+		}, "level 2 is missing"},
+		{"wrong level", func(pki *PKI) {
+			pki.Servers["middle2"].Level = 2
+		}, `server "middle2" has Level 2 but ServerLevels lists it at level 1`},
+		{"unlisted server", func(pki *PKI) {
+			pki.Servers["middle0"] = &ServerInfo{Address: "localhost:3718", PublicKey: middleKey}
+		}, `server "middle0" (Level 0) is not listed in ServerLevels`},
+		{"replica key", func(pki *PKI) {
+			pki.Servers["middle2"].PublicKey = pki.Servers["first"].PublicKey
+		}, `servers "middle1" and "middle2" are replicas at level 1 but do not have the same PublicKey`},
+		{"shared key", func(pki *PKI) {
+			pki.Servers["last"].PublicKey = middleKey
+		}, `servers "last" and "middle1" have the same PublicKey`},
+	}
+	for _, tt := range tests {
+		pki := leveled()
+		tt.change(pki)
+		err := pki.Validate()
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUpstreamKeys(t *testing.T) {
+	names := []string{"first", "middle0", "middle1", "second", "last", "entry"}
+	keys := make(map[string]*BoxKey)
+	for i, name := range names {
+		var k BoxKey
+		k[0] = byte(i + 1)
+		keys[name] = &k
+	}
+	pki := &PKI{
+		Servers: map[string]*ServerInfo{
+			"first":   {PublicKey: keys["first"], Level: 0},
+			"middle0": {PublicKey: keys["middle0"], Level: 1},
+			"middle1": {PublicKey: keys["middle0"], Level: 1},
+			"second":  {PublicKey: keys["second"], Level: 2},
+			"last":    {PublicKey: keys["last"], Level: 3},
+		},
+		ServerLevels: map[int][]string{
+			0: {"first"},
+			1: {"middle0", "middle1"},
+			2: {"second"},
+			3: {"last"},
+		},
+		ServerOrder:    []string{"first", "middle0", "second", "last"},
+		EntryServerKey: keys["entry"],
+	}
+
+	tests := []struct {
+		server string
+		want   []string
+	}{
+		{"first", []string{"entry"}},
+		{"middle0", []string{"first"}},
+		{"second", []string{"middle0", "middle0"}},
+		{"last", []string{"second", "entry"}},
+		{"nobody", nil},
+	}
+	check := func(pki *PKI, server string, want []string) {
+		got := pki.UpstreamKeys(server)
+		if len(got) != len(want) {
+			t.Fatalf("UpstreamKeys(%q) has %d keys, want %d", server, len(got), len(want))
+		}
+		for i, name := range want {
+			if *got[i] != *keys[name] {
+				t.Fatalf("UpstreamKeys(%q)[%d] is not %s's key", server, i, name)
+			}
+		}
+	}
+	for _, test := range tests {
+		check(pki, test.server, test.want)
+	}
+
+	// In a plain chain, ServerOrder gives the levels.
+	pki.ServerLevels = nil
+	check(pki, "second", []string{"middle0"})
+	check(pki, "last", []string{"second", "entry"})
+}
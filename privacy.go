@@ -0,0 +1,122 @@
+package vuvuzela
+
+import (
+	"math"
+	"sync"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+// Privacy is an (ε, δ) differential privacy guarantee.
+type Privacy struct {
+	Epsilon float64
+	Delta   float64
+}
+
+// ConvoPrivacy is what one convo round costs a user when an honest
+// server adds noise drawn from l.  A user changes the counts of single
+// and double accesses by at most 2 each.
+func ConvoPrivacy(l rand.Laplace) Privacy {
+	return Privacy{
+		Epsilon: 4 / l.B,
+		Delta:   math.Exp((2-l.Mu)/l.B) / 2,
+	}
+}
+
+// DialPrivacy is what one dial round costs a user when an honest server
+// adds noise drawn from l to each bucket.  A user changes the size of
+// one bucket by at most 1.
+func DialPrivacy(l rand.Laplace) Privacy {
+	return Privacy{
+		Epsilon: 1 / l.B,
+		Delta:   math.Exp((1-l.Mu)/l.B) / 2,
+	}
+}
+
+// A PrivacyAccountant tracks the privacy each user has spent over the
+// convo and dial rounds they took part in.
+type PrivacyAccountant struct {
+	// Convo and Dial are the costs of one round.
+	Convo Privacy
+	Dial  Privacy
+	// DeltaSlack is the δ' the advanced composition theorem adds to
+	// the rounds' δs in exchange for a smaller ε.
+	DeltaSlack float64
+
+	mu    sync.Mutex
+	users map[BoxKey]*PrivacyLoss
+}
+
+// PrivacyLoss is the privacy a user has spent so far.
+type PrivacyLoss struct {
+	ConvoRounds int
+	DialRounds  int
+	Epsilon     float64
+	Delta       float64
+}
+
+func InitPrivacyAccountant(a *PrivacyAccountant) {
+	a.users = make(map[BoxKey]*PrivacyLoss)
+}
+
+func (a *PrivacyAccountant) AddConvoRound(users []*BoxKey) {
+	a.add(users, func(l *PrivacyLoss) { l.ConvoRounds++ })
+}
+
+func (a *PrivacyAccountant) AddDialRound(users []*BoxKey) {
+	a.add(users, func(l *PrivacyLoss) { l.DialRounds++ })
+}
+
+func (a *PrivacyAccountant) add(users []*BoxKey, count func(*PrivacyLoss)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, u := range users {
+		l := a.users[*u]
+		if l == nil {
+			l = new(PrivacyLoss)
+			a.users[*u] = l
+		}
+		count(l)
+		l.Epsilon, l.Delta = a.compose(l.ConvoRounds, l.DialRounds)
+	}
+}
+
+// Loss returns what user has spent.
+func (a *PrivacyAccountant) Loss(user *BoxKey) PrivacyLoss {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if l := a.users[*user]; l != nil {
+		return *l
+	}
+	return PrivacyLoss{}
+}
+
+// Losses returns what every user has spent, by public key.
+func (a *PrivacyAccountant) Losses() map[string]PrivacyLoss {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	losses := make(map[string]PrivacyLoss, len(a.users))
+	for u, l := range a.users {
+		losses[u.String()] = *l
+	}
+	return losses
+}
+
+// compose returns the privacy of convo convo rounds and dial dial
+// rounds together: the better of basic composition and the advanced
+// composition theorem for rounds with different guarantees.
+func (a *PrivacyAccountant) compose(convo, dial int) (epsilon, delta float64) {
+	c, d := float64(convo), float64(dial)
+	ec, ed := a.Convo.Epsilon, a.Dial.Epsilon
+	basic := c*ec + d*ed
+	delta = c*a.Convo.Delta + d*a.Dial.Delta
+	if a.DeltaSlack <= 0 {
+		return basic, delta
+	}
+	advanced := math.Sqrt(2*math.Log(1/a.DeltaSlack)*(c*ec*ec+d*ed*ed)) +
+		c*ec*(math.Exp(ec)-1) + d*ed*(math.Exp(ed)-1)
+	if advanced < basic {
+		return advanced, delta + a.DeltaSlack
+	}
+	return basic, delta
+}
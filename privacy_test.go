@@ -0,0 +1,111 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"math"
+	"testing"
+
+	vrand "vuvuzela.io/crypto/rand"
+)
+
+func TestRoundPrivacy(t *testing.T) {
+	convo := ConvoPrivacy(vrand.Laplace{Mu: 1000, B: 4})
+	if convo.Epsilon != 1 || convo.Delta != math.Exp(-249.5)/2 {
+		t.Fatalf("convo round: %+v", convo)
+	}
+	dial := DialPrivacy(vrand.Laplace{Mu: 100, B: 4})
+	if dial.Epsilon != 0.25 || dial.Delta != math.Exp(-24.75)/2 {
+		t.Fatalf("dial round: %+v", dial)
+	}
+}
+
+func TestPrivacyAccountant(t *testing.T) {
+	a := &PrivacyAccountant{
+		Convo:      Privacy{Epsilon: 0.01, Delta: 1e-10},
+		Dial:       Privacy{Epsilon: 0.02, Delta: 1e-9},
+		DeltaSlack: 1e-4,
+	}
+	InitPrivacyAccountant(a)
+	alice, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Over a few rounds, basic composition is tighter.
+	a.AddConvoRound([]*BoxKey{alice, bob})
+	a.AddDialRound([]*BoxKey{alice})
+	l := a.Loss(alice)
+	if l.ConvoRounds != 1 || l.DialRounds != 1 {
+		t.Fatalf("alice took part in %d convo and %d dial rounds, want 1 and 1", l.ConvoRounds, l.DialRounds)
+	}
+	if math.Abs(l.Epsilon-0.03) > 1e-12 || math.Abs(l.Delta-1.1e-9) > 1e-20 {
+		t.Fatalf("alice spent %+v, want epsilon 0.03 and delta 1.1e-9", l)
+	}
+	if l := a.Loss(bob); l.DialRounds != 0 || math.Abs(l.Epsilon-0.01) > 1e-12 {
+		t.Fatalf("bob spent %+v", l)
+	}
+
+	// Over many rounds, advanced composition is, at the cost of DeltaSlack.
+	for i := 0; i < 10000; i++ {
+		a.AddConvoRound([]*BoxKey{bob})
+	}
+	l = a.Loss(bob)
+	if basic := 10001 * 0.01; l.Epsilon >= basic/2 {
+		t.Fatalf("bob spent epsilon %v, want well under %v", l.Epsilon, basic)
+	}
+	if l.Delta < a.DeltaSlack {
+		t.Fatalf("bob's delta %v does not include the slack", l.Delta)
+	}
+
+	losses := a.Losses()
+	if len(losses) != 2 || losses[alice.String()].DialRounds != 1 {
+		t.Fatalf("Losses: %+v", losses)
+	}
+}
+
+// TestPrivacyRetries checks that a retried round costs as much as two
+// rounds, since the retry's onions go through the servers again.
+func TestPrivacyRetries(t *testing.T) {
+	a := &PrivacyAccountant{
+		Convo:      Privacy{Epsilon: 0.01, Delta: 1e-10},
+		DeltaSlack: 1e-4,
+	}
+	InitPrivacyAccountant(a)
+	alice, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice takes part in 100 rounds, one of which is retried; bob
+	// takes part in 101 rounds.
+	for i := 0; i < 100; i++ {
+		a.AddConvoRound([]*BoxKey{alice})
+		a.AddConvoRound([]*BoxKey{bob})
+	}
+	a.AddConvoRound([]*BoxKey{alice})
+	a.AddConvoRound([]*BoxKey{bob})
+	if a.Loss(alice) != a.Loss(bob) {
+		t.Fatalf("alice spent %+v with a retry, bob spent %+v in as many rounds", a.Loss(alice), a.Loss(bob))
+	}
+
+	// Retries compose like any other round: with enough of them,
+	// advanced composition takes over.
+	for i := 0; i < 10000; i++ {
+		a.AddConvoRound([]*BoxKey{alice})
+	}
+	l := a.Loss(alice)
+	if l.ConvoRounds != 10101 {
+		t.Fatalf("alice took part in %d rounds, want 10101", l.ConvoRounds)
+	}
+	if l.Epsilon >= 10101*0.01 || l.Delta < a.DeltaSlack {
+		t.Fatalf("alice spent %+v, want advanced composition", l)
+	}
+}
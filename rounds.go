@@ -0,0 +1,25 @@
+package vuvuzela
+
+import (
+	"time"
+)
+
+// collectRounds calls abort every so often with the creation time before
+// which rounds have outlived lifetime.
+func collectRounds(lifetime time.Duration, abort func(deadline time.Time)) {
+	interval := lifetime / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		abort(now.Add(-lifetime))
+	}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
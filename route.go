@@ -0,0 +1,155 @@
+package vuvuzela
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// A RouteSelector picks the route of a convo round: one server from
+// each level of the PKI.  m is the current membership view; servers it
+// does not list are down.  If a level has no live server, SelectRoute
+// returns an error: the round must be skipped, since a shorter route
+// mixes with fewer servers.
+type RouteSelector interface {
+	SelectRoute(pki *PKI, m *Membership) ([]string, error)
+}
+
+// RouteSelectors maps the names used in command-line flags to the
+// route selectors.
+var RouteSelectors = map[string]RouteSelector{
+	"fixed":    FixedRoute{},
+	"random":   RandomRoute{},
+	"weighted": WeightedRoute{},
+	"healthy":  HealthyRoute{},
+}
+
+// ParseRouteSelector parses the name of a route selector, as used in
+// command-line flags.
+func ParseRouteSelector(name string) (RouteSelector, error) {
+	if rs, ok := RouteSelectors[name]; ok {
+		return rs, nil
+	}
+	names := make([]string, 0, len(RouteSelectors))
+	for n := range RouteSelectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown route selector %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+// liveLevels lists the live servers at each level of pki, in m's order
+// when m is a view of the same PKI.  A nil m counts every server as live.
+// A PKI without ServerLevels is a plain chain, which has one server at
+// each level and no membership.
+func liveLevels(pki *PKI, m *Membership) [][]string {
+	levels := make([][]string, 0, len(pki.ServerOrder))
+	if len(pki.ServerLevels) == 0 {
+		for _, s := range pki.ServerOrder {
+			levels = append(levels, []string{s})
+		}
+		return levels
+	}
+	for level := 0; level < len(pki.ServerLevels); level++ {
+		servers := pki.ServerLevels[level]
+		if m != nil {
+			if m.PKIEpoch == pki.Epoch {
+				servers = m.Levels[level]
+			}
+			live := make([]string, 0, len(servers))
+			for _, s := range servers {
+				// membership may briefly be behind a PKI that was just reloaded
+				if pki.Servers[s] != nil && m.Live(s) {
+					live = append(live, s)
+				}
+			}
+			servers = live
+		}
+		levels = append(levels, servers)
+	}
+	return levels
+}
+
+// checkLevels makes sure every level has a live server.
+func checkLevels(levels [][]string) error {
+	for level, servers := range levels {
+		if len(servers) == 0 {
+			return fmt.Errorf("no live server at level %d", level)
+		}
+	}
+	return nil
+}
+
+// FixedRoute always uses the PKI's ServerOrder, so every round takes
+// the same route.  It ignores membership: if a server is down, the
+// server before it fails over to another replica of its level.
+type FixedRoute struct{}
+
+func (FixedRoute) SelectRoute(pki *PKI, m *Membership) ([]string, error) {
+	return append([]string(nil), pki.ServerOrder...), nil
+}
+
+// RandomRoute picks a live server uniformly at random from each level.
+type RandomRoute struct{}
+
+func (RandomRoute) SelectRoute(pki *PKI, m *Membership) ([]string, error) {
+	levels := liveLevels(pki, m)
+	if err := checkLevels(levels); err != nil {
+		return nil, err
+	}
+	route := make([]string, 0, len(levels))
+	for _, servers := range levels {
+		route = append(route, servers[rand.Intn(len(servers))])
+	}
+	return route, nil
+}
+
+// WeightedRoute picks a live server from each level at random, in
+// proportion to its Capacity.
+type WeightedRoute struct{}
+
+func (WeightedRoute) SelectRoute(pki *PKI, m *Membership) ([]string, error) {
+	levels := liveLevels(pki, m)
+	if err := checkLevels(levels); err != nil {
+		return nil, err
+	}
+	route := make([]string, 0, len(levels))
+	for _, servers := range levels {
+		total := 0
+		for _, s := range servers {
+			total += pki.Servers[s].weight()
+		}
+		n := rand.Intn(total)
+		for _, s := range servers {
+			if n -= pki.Servers[s].weight(); n < 0 {
+				route = append(route, s)
+				break
+			}
+		}
+	}
+	return route, nil
+}
+
+// HealthyRoute picks the healthiest live server from each level, which
+// is the first one the membership view lists.  Rounds stay on one
+// replica of a level until it fails.
+type HealthyRoute struct{}
+
+func (HealthyRoute) SelectRoute(pki *PKI, m *Membership) ([]string, error) {
+	levels := liveLevels(pki, m)
+	if err := checkLevels(levels); err != nil {
+		return nil, err
+	}
+	route := make([]string, 0, len(levels))
+	for level, servers := range levels {
+		s := servers[0]
+		if m == nil && level < len(pki.ServerOrder) {
+			// without a view, the ServerOrder server is the healthiest
+			// one we know of
+			s = pki.ServerOrder[level]
+		}
+		route = append(route, s)
+	}
+	return route, nil
+}
@@ -0,0 +1,94 @@
+package vuvuzela
+
+import (
+	"fmt"
+	"testing"
+)
+
+// checkRoute fails unless route has exactly one server from each level
+// of pki, in order.
+func checkRoute(t *testing.T, name string, pki *PKI, route []string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if len(route) != len(pki.ServerLevels) {
+		t.Fatalf("%s: route %q has %d servers, want %d", name, route, len(route), len(pki.ServerLevels))
+	}
+	for level, s := range route {
+		info := pki.Servers[s]
+		if info == nil || info.Level != level {
+			t.Fatalf("%s: route %q has %q at position %d", name, route, s, level)
+		}
+	}
+}
+
+func TestRouteSelectors(t *testing.T) {
+	pki := membershipPKI()
+	for name, rs := range RouteSelectors {
+		for i := 0; i < 20; i++ {
+			route, err := rs.SelectRoute(pki, nil)
+			checkRoute(t, name, pki, route, err)
+		}
+	}
+
+	// Once middle1 is down, only fixed routes go through it.
+	m := &Membership{Levels: map[int][]string{0: {"first"}, 1: {"middle2"}, 2: {"last"}}}
+	for name, rs := range RouteSelectors {
+		route, err := rs.SelectRoute(pki, m)
+		checkRoute(t, name, pki, route, err)
+		if name != "fixed" && route[1] != "middle2" {
+			t.Fatalf("%s: route %q goes through a server that is down", name, route)
+		}
+	}
+
+	// With no live server at the last level, there is no route.  Fixed
+	// routes still try ServerOrder.
+	m = &Membership{Levels: map[int][]string{0: {"first"}, 1: {"middle1", "middle2"}, 2: {}}}
+	for name, rs := range RouteSelectors {
+		route, err := rs.SelectRoute(pki, m)
+		if name == "fixed" {
+			checkRoute(t, name, pki, route, err)
+		} else if err == nil {
+			t.Fatalf("%s: got route %q without a live last server", name, route)
+		}
+	}
+
+	if _, err := ParseRouteSelector("shortest"); err == nil {
+		t.Fatalf("ParseRouteSelector accepted an unknown name")
+	}
+}
+
+func TestHealthyRoute(t *testing.T) {
+	pki := membershipPKI()
+	route, err := HealthyRoute{}.SelectRoute(pki, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(route) != fmt.Sprint(pki.ServerOrder) {
+		t.Fatalf("route is %q, want ServerOrder %q", route, pki.ServerOrder)
+	}
+
+	// The view lists the healthiest server first.
+	m := &Membership{Levels: map[int][]string{0: {"first"}, 1: {"middle2", "middle1"}, 2: {"last"}}}
+	if route, _ := (HealthyRoute{}).SelectRoute(pki, m); route[1] != "middle2" {
+		t.Fatalf("route is %q, want middle2 at level 1", route)
+	}
+}
+
+func TestWeightedRoute(t *testing.T) {
+	pki := membershipPKI()
+	pki.Servers["middle1"].Capacity = 3
+
+	counts := make(map[string]int)
+	const n = 4000
+	for i := 0; i < n; i++ {
+		route, err := WeightedRoute{}.SelectRoute(pki, nil)
+		checkRoute(t, "weighted", pki, route, err)
+		counts[route[1]]++
+	}
+	// middle1 should get about 3/4 of the rounds.
+	if c := counts["middle1"]; c < n*2/3 || c > n*5/6 {
+		t.Fatalf("middle1 got %d of %d rounds, want about %d", c, n, n*3/4)
+	}
+}
@@ -1,29 +1,210 @@
 package vrpc
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/rpc"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type Client struct {
-	rpcClients []*rpc.Client
+	network string
+	address string
+	dialer  *Dialer
+
+	conns []*conn
+	next  uint32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ErrUnavailable is returned when every connection to the server is
+// down and waiting to be redialed.
+var ErrUnavailable = errors.New("vrpc: no healthy connections")
+
+// A Dialer contains options for connecting to a vrpc server.
+type Dialer struct {
+	// Connections is the number of connections to open.
+	Connections int
+
+	// Transport, if not nil, secures each connection after it is dialed.
+	Transport Transport
+
+	// Codec must match the codec the server uses.
+	Codec Codec
+
+	// BatchInFlight limits how many calls from one CallMany batch may be
+	// outstanding on each connection.  A small limit means that a
+	// failure stops most of the batch from being sent, at the cost of a
+	// round trip per window.  Zero means no limit.
+	BatchInFlight int
 }
 
+// Dial opens the given number of plain connections to address.
 func Dial(network, address string, connections int) (*Client, error) {
-	rpcClients := make([]*rpc.Client, connections)
-	for i := range rpcClients {
-		c, err := rpc.Dial(network, address)
+	d := &Dialer{
+		Connections: connections,
+	}
+	return d.Dial(network, address)
+}
+
+// Dial opens d.Connections connections to address.  Connections that
+// break later are redialed in the background until the client is closed.
+func (d *Dialer) Dial(network, address string) (*Client, error) {
+	c := &Client{
+		network: network,
+		address: address,
+		dialer:  d,
+		conns:   make([]*conn, d.Connections),
+		closed:  make(chan struct{}),
+	}
+	for i := range c.conns {
+		rc, nc, err := c.dial()
 		if err != nil {
+			c.Close()
 			return nil, err
 		}
-		rpcClients[i] = c
+		c.conns[i] = &conn{client: c, rpcClient: rc, netConn: nc}
+	}
+	go c.healthLoop()
+	return c, nil
+}
+
+// dialConn opens a connection to the server, secured by the dialer's
+// transport.
+func (c *Client) dialConn(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	if c.dialer.Transport != nil {
+		conn, err = c.dialer.Transport.Client(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) dial() (*rpc.Client, net.Conn, error) {
+	conn, err := c.dialConn(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write([]byte{prefaceRPC}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return newClient(conn, c.dialer.Codec), conn, nil
+}
+
+// Close closes every connection and stops redialing.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, cn := range c.conns {
+			if cn != nil {
+				cn.close()
+			}
+		}
+	})
+	return nil
+}
+
+// Healthy reports whether at least one connection is usable.
+func (c *Client) Healthy() bool {
+	for _, cn := range c.conns {
+		if cn.get() != nil {
+			return true
+		}
 	}
-	return &Client{
-		rpcClients: rpcClients,
-	}, nil
+	return false
+}
+
+// pick returns the healthy connection with the fewest calls in flight,
+// or nil if no connection is healthy.  The scan starts at a rotating
+// offset so that ties are broken round-robin.
+func (c *Client) pick() *conn {
+	n := uint32(len(c.conns))
+	start := atomic.AddUint32(&c.next, 1)
+	var best *conn
+	for i := uint32(0); i < n; i++ {
+		cn := c.conns[(start+i)%n]
+		if cn.get() == nil {
+			continue
+		}
+		if best == nil || atomic.LoadInt64(&cn.inFlight) < atomic.LoadInt64(&best.inFlight) {
+			best = cn
+		}
+	}
+	return best
+}
+
+// InFlight returns the number of outstanding calls on each connection.
+func (c *Client) InFlight() []int64 {
+	counts := make([]int64, len(c.conns))
+	for i, cn := range c.conns {
+		counts[i] = atomic.LoadInt64(&cn.inFlight)
+	}
+	return counts
+}
+
+// TimeoutError is returned when a call does not complete before the
+// deadline of its context.  The call itself may still be running on the
+// remote server; its reply is discarded.
+type TimeoutError struct {
+	Method string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("vrpc: %s: deadline exceeded", e.Method)
+}
+
+// Timeout lets TimeoutError satisfy net.Error-style checks.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func contextError(ctx context.Context, method string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Method: method}
+	}
+	return ctx.Err()
 }
 
 func (c *Client) Call(method string, args interface{}, reply interface{}) error {
-	return c.rpcClients[0].Call(method, args, reply)
+	return c.CallContext(context.Background(), method, args, reply)
+}
+
+// CallContext is like Call, but gives up when ctx is done.  An abandoned
+// call is left to finish in the background.
+func (c *Client) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if ctx.Err() != nil {
+		return contextError(ctx, method)
+	}
+
+	// A call that fails with ErrShutdown, or that finds its connection
+	// already down, was never sent (see conn), so it is safe to retry it
+	// on another connection.  A call that was sent is never retried,
+	// since the server may have run it.
+	for attempt := 0; ; attempt++ {
+		cn := c.pick()
+		if cn == nil {
+			return ErrUnavailable
+		}
+		err := cn.callContext(ctx, method, args, reply)
+		if (err == rpc.ErrShutdown || err == ErrUnavailable) && attempt < len(c.conns) {
+			continue
+		}
+		return err
+	}
 }
 
 type Call struct {
@@ -32,50 +213,174 @@ type Call struct {
 	Reply  interface{}
 }
 
+// CallError describes one failed call in a CallMany batch.
+type CallError struct {
+	Index  int
+	Method string
+	Err    error
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call %d (%s): %s", e.Index, e.Method, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// ManyError is returned by CallMany when some calls in a batch fail.
+// Calls after the first failure are not sent.
+type ManyError struct {
+	Errors []*CallError // sorted by Index
+	Total  int
+	Sent   int
+}
+
+func (e *ManyError) Error() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "vrpc: %d of %d calls failed (%d not sent): ", len(e.Errors), e.Total, e.Total-e.Sent)
+	for i, ce := range e.Errors {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(ce.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap lets errors.Is and errors.As look at the individual failures.
+func (e *ManyError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, ce := range e.Errors {
+		errs[i] = ce
+	}
+	return errs
+}
+
 func (c *Client) CallMany(calls []*Call) error {
+	return c.CallManyContext(context.Background(), calls)
+}
+
+// CallManyContext sends calls spread over the client's connections.  On
+// the first failure it stops sending, waits for the calls already in
+// flight, and returns a *ManyError listing every call that failed.  If
+// ctx is done first, it stops waiting and returns ctx's error; replies
+// to abandoned calls are discarded.
+func (c *Client) CallManyContext(ctx context.Context, calls []*Call) error {
 	if len(calls) == 0 {
 		return nil
 	}
+	if ctx.Err() != nil {
+		return contextError(ctx, calls[0].Method)
+	}
 
-	done := make(chan struct{})
-	callChan := make(chan *Call, 4)
+	var conns []*conn
+	for _, cn := range c.conns {
+		if cn.get() != nil {
+			conns = append(conns, cn)
+		}
+	}
+	if len(conns) == 0 {
+		return ErrUnavailable
+	}
 
+	// sending is cancelled on the first failure; ctx is only used to
+	// give up waiting.
+	sending, stopSending := context.WithCancel(ctx)
+	defer stopSending()
+
+	indexes := make(chan int)
 	go func() {
-		for _, c := range calls {
+		defer close(indexes)
+		for i := range calls {
 			select {
-			case callChan <- c:
-				// ok
-			case <-done:
-				break
+			case indexes <- i:
+			case <-sending.Done():
+				return
 			}
 		}
-		close(callChan)
 	}()
 
-	results := make(chan *rpc.Call, len(calls))
-	for _, rc := range c.rpcClients {
-		go func(rc *rpc.Client) {
-			for call := range callChan {
-				rc.Go(call.Method, call.Args, call.Reply, results)
+	type result struct {
+		index int
+		call  *rpc.Call
+	}
+	// results has room for every call, so nothing ever blocks on it,
+	// even after we stop reading.
+	results := make(chan result, len(calls))
+
+	var sent int64
+	var workers sync.WaitGroup
+	for _, cn := range conns {
+		workers.Add(1)
+		go func(cn *conn) {
+			defer workers.Done()
+			var window chan struct{}
+			if n := c.dialer.BatchInFlight; n > 0 {
+				window = make(chan struct{}, n)
+			}
+			for i := range indexes {
+				if window != nil {
+					select {
+					case window <- struct{}{}:
+					case <-sending.Done():
+						continue
+					}
+				}
+				if sending.Err() != nil {
+					continue
+				}
+				atomic.AddInt64(&sent, 1)
+				i := i
+				call := calls[i]
+				cn.start(call.Method, call.Args, call.Reply, func(rc *rpc.Call) {
+					if window != nil {
+						<-window
+					}
+					results <- result{i, rc}
+				})
 			}
-		}(rc)
+		}(cn)
 	}
+	allSent := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(allSent)
+	}()
 
-	var err error
-	var received int
-	for call := range results {
-		err = call.Error
-		if err != nil {
+	var errs []*CallError
+	received := 0
+	for {
+		if allSent == nil && int64(received) == atomic.LoadInt64(&sent) {
 			break
 		}
-
-		received++
-		if received == len(calls) {
-			close(results)
-			break
+		select {
+		case r := <-results:
+			received++
+			if r.call.Error != nil {
+				errs = append(errs, &CallError{
+					Index:  r.index,
+					Method: calls[r.index].Method,
+					Err:    r.call.Error,
+				})
+				stopSending()
+			}
+		case <-allSent:
+			allSent = nil
+		case <-ctx.Done():
+			return contextError(ctx, calls[0].Method)
 		}
 	}
 
-	close(done)
-	return err
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Index < errs[j].Index
+	})
+	return &ManyError{
+		Errors: errs,
+		Total:  len(calls),
+		Sent:   int(atomic.LoadInt64(&sent)),
+	}
 }
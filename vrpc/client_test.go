@@ -0,0 +1,250 @@
+package vrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fake is a net/rpc service that fails the calls listed in fail.
+type fake struct {
+	fail     map[int]bool
+	delay    time.Duration
+	received int64
+
+	// active and maxActive count the calls running at once.
+	active    int64
+	maxActive int64
+}
+
+func (f *fake) Do(i int, reply *int) error {
+	atomic.AddInt64(&f.received, 1)
+	active := atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+	for {
+		max := atomic.LoadInt64(&f.maxActive)
+		if active <= max || atomic.CompareAndSwapInt64(&f.maxActive, max, active) {
+			break
+		}
+	}
+	if f.fail[i] {
+		return fmt.Errorf("injected failure %d", i)
+	}
+	time.Sleep(f.delay)
+	*reply = i
+	return nil
+}
+
+func serveFake(t *testing.T, f *fake) string {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Fake", f); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(new(Health)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewServer(srv, GobCodec).Accept(l)
+	return l.Addr().String()
+}
+
+func fakeCalls(n int) []*Call {
+	calls := make([]*Call, n)
+	for i := range calls {
+		calls[i] = &Call{
+			Method: "Fake.Do",
+			Args:   i,
+			Reply:  new(int),
+		}
+	}
+	return calls
+}
+
+// waitGoroutines fails the test if the number of goroutines does not drop
+// back to n, allowing a moment for finished goroutines to exit.
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked goroutines: have %d, started with %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCallMany(t *testing.T) {
+	addr := serveFake(t, &fake{})
+	c, err := Dial("tcp", addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	calls := fakeCalls(100)
+	if err := c.CallMany(calls); err != nil {
+		t.Fatalf("CallMany: %s", err)
+	}
+	for i, call := range calls {
+		if *call.Reply.(*int) != i {
+			t.Fatalf("call %d: got reply %d", i, *call.Reply.(*int))
+		}
+	}
+}
+
+func TestCallManyFailures(t *testing.T) {
+	f := &fake{
+		fail:  map[int]bool{0: true, 1: true},
+		delay: 5 * time.Millisecond,
+	}
+	addr := serveFake(t, f)
+	d := &Dialer{Connections: 1, BatchInFlight: 2}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	before := runtime.NumGoroutine()
+	calls := fakeCalls(50)
+	err = c.CallMany(calls)
+
+	var me *ManyError
+	if !errors.As(err, &me) {
+		t.Fatalf("expecting *ManyError, got %v", err)
+	}
+	if len(me.Errors) == 0 {
+		t.Fatalf("no failed calls reported")
+	}
+	for _, ce := range me.Errors {
+		if !f.fail[ce.Index] {
+			t.Fatalf("call %d reported as failed: %s", ce.Index, ce.Err)
+		}
+	}
+	if me.Sent == me.Total {
+		t.Fatalf("all %d calls were sent despite failures", me.Total)
+	}
+	if n := atomic.LoadInt64(&f.received); n != int64(me.Sent) {
+		t.Fatalf("server received %d calls, client sent %d", n, me.Sent)
+	}
+	for i, n := range c.InFlight() {
+		if n != 0 {
+			t.Fatalf("connection %d has %d calls in flight after CallMany returned", i, n)
+		}
+	}
+	waitGoroutines(t, before)
+}
+
+func TestCallManyBatchInFlight(t *testing.T) {
+	for _, limit := range []int{0, 1, 3} {
+		f := &fake{delay: 10 * time.Millisecond}
+		addr := serveFake(t, f)
+		d := &Dialer{Connections: 1, BatchInFlight: limit}
+		c, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CallMany(fakeCalls(20)); err != nil {
+			t.Fatalf("BatchInFlight=%d: CallMany: %s", limit, err)
+		}
+		c.Close()
+
+		max := atomic.LoadInt64(&f.maxActive)
+		if limit > 0 && max > int64(limit) {
+			t.Fatalf("BatchInFlight=%d: %d calls ran at once", limit, max)
+		}
+		if limit == 0 && max <= 3 {
+			t.Fatalf("BatchInFlight=0: only %d calls ran at once, want no limit", max)
+		}
+	}
+}
+
+func TestPickLeastInFlight(t *testing.T) {
+	f := &fake{delay: 300 * time.Millisecond}
+	addr := serveFake(t, f)
+	c, err := Dial("tcp", addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Park calls on connection 0, and one on connection 1.
+	parked := make(chan *rpc.Call, 3)
+	for i := 0; i < 2; i++ {
+		c.conns[0].start("Fake.Do", i, new(int), func(call *rpc.Call) { parked <- call })
+	}
+	c.conns[1].start("Fake.Do", 2, new(int), func(call *rpc.Call) { parked <- call })
+	if got := c.InFlight(); got[0] != 2 || got[1] != 1 || got[2] != 0 {
+		t.Fatalf("InFlight = %v, want [2 1 0]", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if cn := c.pick(); cn != c.conns[2] {
+			t.Fatalf("picked connection %d, want the idle one", indexOf(c, cn))
+		}
+	}
+	// A call goes to the idle connection, and the next one to the
+	// connection with one call parked, which then ties with it.
+	done := make(chan error, 1)
+	go func() { done <- c.Call("Fake.Do", 3, new(int)) }()
+	waitInFlight(t, c, []int64{2, 1, 1})
+	if cn := c.pick(); cn == c.conns[0] {
+		t.Fatalf("picked the connection with the most calls in flight")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if call := <-parked; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if got := c.InFlight(); got[0] != 0 || got[1] != 0 || got[2] != 0 {
+		t.Fatalf("InFlight = %v after every call finished", got)
+	}
+}
+
+func indexOf(c *Client, cn *conn) int {
+	for i := range c.conns {
+		if c.conns[i] == cn {
+			return i
+		}
+	}
+	return -1
+}
+
+func waitInFlight(t *testing.T, c *Client, want []int64) {
+	deadline := time.Now().Add(time.Second)
+	for fmt.Sprint(c.InFlight()) != fmt.Sprint(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("InFlight = %v, want %v", c.InFlight(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallManyTimeout(t *testing.T) {
+	addr := serveFake(t, &fake{delay: time.Second})
+	c, err := Dial("tcp", addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.CallManyContext(ctx, fakeCalls(10))
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("expecting *TimeoutError, got %v", err)
+	}
+}
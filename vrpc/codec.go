@@ -0,0 +1,301 @@
+package vrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+)
+
+// Codec selects how calls are encoded on the wire.  Both ends of a
+// connection must use the same codec.
+type Codec int
+
+const (
+	// GobCodec is net/rpc's default encoding.
+	GobCodec Codec = iota
+
+	// BinaryCodec sends arguments and replies that implement Marshaler
+	// and Unmarshaler in their own compact format, and everything else
+	// as a self-contained gob.
+	BinaryCodec
+)
+
+func (c Codec) String() string {
+	switch c {
+	case GobCodec:
+		return "gob"
+	case BinaryCodec:
+		return "binary"
+	default:
+		return fmt.Sprintf("Codec(%d)", int(c))
+	}
+}
+
+// ParseCodec parses the name of a codec, as used in command-line flags.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "gob":
+		return GobCodec, nil
+	case "binary":
+		return BinaryCodec, nil
+	default:
+		return 0, fmt.Errorf("unknown codec: %q", name)
+	}
+}
+
+// Marshaler is implemented by arguments and replies that have a compact
+// encoding for the binary codec.  AppendVRPC appends the encoding to buf.
+type Marshaler interface {
+	AppendVRPC(buf []byte) []byte
+}
+
+// Unmarshaler decodes what the corresponding Marshaler encoded.  data is
+// not reused by the codec, so the decoded value may alias it.
+type Unmarshaler interface {
+	UnmarshalVRPC(data []byte) error
+}
+
+// AppendBatch appends a batch of onions as a count followed by
+// length-prefixed onions.
+func AppendBatch(buf []byte, onions [][]byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(onions)))
+	for _, onion := range onions {
+		buf = binary.AppendUvarint(buf, uint64(len(onion)))
+		buf = append(buf, onion...)
+	}
+	return buf
+}
+
+// ReadBatch decodes a batch written by AppendBatch.  The onions alias
+// data.  ReadBatch returns the remainder of data after the batch.
+func ReadBatch(data []byte) (onions [][]byte, rest []byte, err error) {
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n > uint64(len(data)) {
+		return nil, nil, errShortBatch
+	}
+	onions = make([][]byte, n)
+	for i := range onions {
+		var size uint64
+		size, data, err = readUvarint(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if size > uint64(len(data)) {
+			return nil, nil, errShortBatch
+		}
+		if size > 0 {
+			onions[i] = data[:size:size]
+		}
+		data = data[size:]
+	}
+	return onions, data, nil
+}
+
+var errShortBatch = errors.New("vrpc: short batch")
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errShortBatch
+	}
+	return x, data[n:], nil
+}
+
+func serveConn(srv *rpc.Server, conn io.ReadWriteCloser, codec Codec) {
+	if codec == BinaryCodec {
+		srv.ServeCodec(newBinaryCodec(conn))
+	} else {
+		srv.ServeConn(conn)
+	}
+}
+
+func newClient(conn io.ReadWriteCloser, codec Codec) *rpc.Client {
+	if codec == BinaryCodec {
+		return rpc.NewClientWithCodec(newBinaryCodec(conn))
+	}
+	return rpc.NewClient(conn)
+}
+
+// Each message of the binary codec is a header followed by a body:
+//
+//	header: uvarint seq, uvarint-prefixed method, uvarint-prefixed error
+//	body:   kind byte, uvarint-prefixed payload
+const (
+	bodyNone byte = iota
+	bodyGob
+	bodyBinary
+)
+
+// maxBodySize bounds what a peer can make us allocate for one message.
+// The largest messages are the batches of a round: a call carries up to
+// 4000 onions of well under a kilobyte each.  Results that are not
+// batched, such as a dial round's buckets, stay under this for rounds of
+// about a million introductions.
+const maxBodySize = 128 << 20
+
+// maxStringSize bounds method names and error strings.
+const maxStringSize = 64 << 10
+
+// binaryCodec implements both rpc.ClientCodec and rpc.ServerCodec.
+type binaryCodec struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newBinaryCodec(rwc io.ReadWriteCloser) *binaryCodec {
+	return &binaryCodec{
+		rwc: rwc,
+		r:   bufio.NewReader(rwc),
+		w:   bufio.NewWriter(rwc),
+	}
+}
+
+func (c *binaryCodec) writeMessage(seq uint64, method string, errStr string, body interface{}) error {
+	buf := c.buf[:0]
+	buf = binary.AppendUvarint(buf, seq)
+	buf = binary.AppendUvarint(buf, uint64(len(method)))
+	buf = append(buf, method...)
+	buf = binary.AppendUvarint(buf, uint64(len(errStr)))
+	buf = append(buf, errStr...)
+
+	kindAt := len(buf)
+	buf = append(buf, bodyNone)
+	var payload []byte
+	switch body := body.(type) {
+	case nil:
+	case Marshaler:
+		buf[kindAt] = bodyBinary
+		payload = body.AppendVRPC(nil)
+	default:
+		buf[kindAt] = bodyGob
+		gb := new(bytes.Buffer)
+		if err := gob.NewEncoder(gb).Encode(body); err != nil {
+			return err
+		}
+		payload = gb.Bytes()
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	c.buf = buf
+
+	if _, err := c.w.Write(buf); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *binaryCodec) readString() (string, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxStringSize {
+		return "", fmt.Errorf("vrpc: string too large (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (c *binaryCodec) readHeader() (seq uint64, method string, errStr string, err error) {
+	if seq, err = binary.ReadUvarint(c.r); err != nil {
+		return
+	}
+	if method, err = c.readString(); err != nil {
+		return
+	}
+	errStr, err = c.readString()
+	return
+}
+
+func (c *binaryCodec) readBody(v interface{}) error {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if n > maxBodySize {
+		return fmt.Errorf("vrpc: body too large (%d bytes)", n)
+	}
+	if v == nil {
+		_, err := c.r.Discard(int(n))
+		return err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch kind {
+	case bodyNone:
+		return nil
+	case bodyGob:
+		return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+	case bodyBinary:
+		u, ok := v.(Unmarshaler)
+		if !ok {
+			return fmt.Errorf("vrpc: %T does not implement Unmarshaler", v)
+		}
+		return u.UnmarshalVRPC(payload)
+	default:
+		return fmt.Errorf("vrpc: unknown body kind %d", kind)
+	}
+}
+
+func (c *binaryCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.writeMessage(r.Seq, r.ServiceMethod, "", body)
+}
+
+func (c *binaryCodec) ReadResponseHeader(r *rpc.Response) error {
+	seq, method, errStr, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	r.Seq, r.ServiceMethod, r.Error = seq, method, errStr
+	return nil
+}
+
+func (c *binaryCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *binaryCodec) ReadRequestHeader(r *rpc.Request) error {
+	seq, method, _, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	r.Seq, r.ServiceMethod = seq, method
+	return nil
+}
+
+func (c *binaryCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *binaryCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		body = nil
+	}
+	return c.writeMessage(r.Seq, r.ServiceMethod, r.Error, body)
+}
+
+func (c *binaryCodec) Close() error {
+	return c.rwc.Close()
+}
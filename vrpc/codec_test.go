@@ -0,0 +1,191 @@
+package vrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+// Batch mimics the onion-carrying arguments in the vuvuzela package.
+type Batch struct {
+	Round  uint32
+	Onions [][]byte
+}
+
+func (b Batch) AppendVRPC(buf []byte) []byte {
+	buf = append(buf, byte(b.Round>>24), byte(b.Round>>16), byte(b.Round>>8), byte(b.Round))
+	return AppendBatch(buf, b.Onions)
+}
+
+func (b *Batch) UnmarshalVRPC(data []byte) error {
+	if len(data) < 4 {
+		return errShortBatch
+	}
+	b.Round = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	onions, _, err := ReadBatch(data[4:])
+	b.Onions = onions
+	return err
+}
+
+type batches struct{}
+
+func (*batches) Echo(args *Batch, reply *Batch) error {
+	*reply = *args
+	return nil
+}
+
+func (*batches) Count(args *Batch, reply *int) error {
+	*reply = len(args.Onions)
+	return nil
+}
+
+func (*batches) Fail(args *Batch, reply *Batch) error {
+	return errors.New("no thanks")
+}
+
+func serveCodec(tb testing.TB, codec Codec) string {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Batches", new(batches)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := srv.RegisterName("Fake", new(fake)); err != nil {
+		tb.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go NewServer(srv, codec).Accept(l)
+	return l.Addr().String()
+}
+
+func dialCodec(tb testing.TB, addr string, codec Codec) *Client {
+	d := &Dialer{
+		Connections: 1,
+		Codec:       codec,
+	}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+func randomOnions(n, size int) [][]byte {
+	buf := make([]byte, n*size)
+	rand.Read(buf)
+	onions := make([][]byte, n)
+	for i := range onions {
+		onions[i] = buf[i*size : (i+1)*size]
+	}
+	return onions
+}
+
+func TestBinaryCodec(t *testing.T) {
+	c := dialCodec(t, serveCodec(t, BinaryCodec), BinaryCodec)
+
+	args := &Batch{Round: 42, Onions: randomOnions(100, 432)}
+	args.Onions[7] = nil
+	reply := new(Batch)
+	if err := c.Call("Batches.Echo", args, reply); err != nil {
+		t.Fatalf("Echo: %s", err)
+	}
+	if reply.Round != args.Round || len(reply.Onions) != len(args.Onions) {
+		t.Fatalf("Echo: got round %d with %d onions", reply.Round, len(reply.Onions))
+	}
+	for i := range args.Onions {
+		if !bytes.Equal(args.Onions[i], reply.Onions[i]) {
+			t.Fatalf("Echo: onion %d does not match", i)
+		}
+	}
+
+	// Plain values fall back to gob.
+	var n int
+	if err := c.Call("Fake.Do", 7, &n); err != nil || n != 7 {
+		t.Fatalf("Fake.Do: got %d, %v", n, err)
+	}
+
+	err := c.Call("Batches.Fail", args, reply)
+	if _, ok := err.(rpc.ServerError); !ok || !strings.Contains(err.Error(), "no thanks") {
+		t.Fatalf("Fail: expecting server error, got %v", err)
+	}
+
+	// The connection is still usable after an error.
+	if err := c.Call("Batches.Count", args, &n); err != nil || n != len(args.Onions) {
+		t.Fatalf("Count: got %d, %v", n, err)
+	}
+}
+
+func TestReadBatchShort(t *testing.T) {
+	buf := AppendBatch(nil, randomOnions(3, 16))
+	for i := 0; i < len(buf); i++ {
+		if _, _, err := ReadBatch(buf[:i]); err == nil {
+			t.Fatalf("ReadBatch accepted a batch truncated to %d of %d bytes", i, len(buf))
+		}
+	}
+}
+
+// rwBuffer is a connection that reads from a buffer and discards what
+// is written.
+type rwBuffer struct {
+	*bytes.Buffer
+}
+
+func (rwBuffer) Close() error { return nil }
+
+func TestBinaryCodecLimits(t *testing.T) {
+	header := func(method string) []byte {
+		buf := binary.AppendUvarint(nil, 1)
+		buf = binary.AppendUvarint(buf, uint64(len(method)))
+		buf = append(buf, method...)
+		return binary.AppendUvarint(buf, 0)
+	}
+
+	// A body larger than the limit is refused before it is read.
+	msg := append(header("Batches.Echo"), bodyBinary)
+	msg = binary.AppendUvarint(msg, maxBodySize+1)
+	c := newBinaryCodec(rwBuffer{bytes.NewBuffer(msg)})
+	var r rpc.Request
+	if err := c.ReadRequestHeader(&r); err != nil {
+		t.Fatalf("ReadRequestHeader: %s", err)
+	}
+	if err := c.ReadRequestBody(new(Batch)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("ReadRequestBody of an oversized body: got %v", err)
+	}
+
+	// So is a method name larger than its limit.
+	msg = binary.AppendUvarint(nil, 1)
+	msg = binary.AppendUvarint(msg, maxStringSize+1)
+	c = newBinaryCodec(rwBuffer{bytes.NewBuffer(msg)})
+	if err := c.ReadRequestHeader(&r); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("ReadRequestHeader of an oversized method: got %v", err)
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	c := dialCodec(b, serveCodec(b, codec), codec)
+	args := &Batch{Round: 1, Onions: randomOnions(100000, 432)}
+	b.SetBytes(int64(100000 * 432))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		if err := c.Call("Batches.Count", args, &n); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGobCodec(b *testing.B) {
+	benchmarkCodec(b, GobCodec)
+}
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	benchmarkCodec(b, BinaryCodec)
+}
@@ -0,0 +1,155 @@
+package vrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minRedialBackoff = 100 * time.Millisecond
+	maxRedialBackoff = 10 * time.Second
+)
+
+// conn is one of the connections held by a Client.  Its rpcClient is nil
+// while the connection is down and being redialed.
+//
+// A broken connection is hung up by closing netConn rather than
+// rpcClient: then calls that were written fail with the read or write
+// error, and rpc.ErrShutdown only ever means that a call was not sent.
+type conn struct {
+	client *Client
+
+	mu        sync.Mutex
+	rpcClient *rpc.Client
+	netConn   net.Conn
+
+	inFlight int64
+}
+
+func (cn *conn) get() *rpc.Client {
+	cn.mu.Lock()
+	rc := cn.rpcClient
+	cn.mu.Unlock()
+	return rc
+}
+
+func (cn *conn) close() {
+	cn.mu.Lock()
+	nc := cn.netConn
+	cn.rpcClient = nil
+	cn.netConn = nil
+	cn.mu.Unlock()
+	if nc != nil {
+		nc.Close()
+	}
+}
+
+// start sends an asynchronous call on cn.  finish is called with the
+// finished call after the in-flight count drops; it must not block.
+func (cn *conn) start(method string, args interface{}, reply interface{}, finish func(*rpc.Call)) {
+	rc := cn.get()
+	if rc == nil {
+		finish(&rpc.Call{ServiceMethod: method, Args: args, Reply: reply, Error: ErrUnavailable})
+		return
+	}
+
+	atomic.AddInt64(&cn.inFlight, 1)
+	ch := make(chan *rpc.Call, 1)
+	rc.Go(method, args, reply, ch)
+	go func() {
+		call := <-ch
+		atomic.AddInt64(&cn.inFlight, -1)
+		if isConnError(call.Error) {
+			cn.fail(rc)
+		}
+		finish(call)
+	}()
+}
+
+// callContext sends a call on cn and waits for it until ctx is done.
+func (cn *conn) callContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	done := make(chan *rpc.Call, 1)
+	cn.start(method, args, reply, func(call *rpc.Call) { done <- call })
+	select {
+	case call := <-done:
+		return call.Error
+	case <-ctx.Done():
+		return contextError(ctx, method)
+	}
+}
+
+// fail takes rc out of service and starts redialing, unless another
+// call already noticed that rc is broken.
+func (cn *conn) fail(rc *rpc.Client) {
+	cn.mu.Lock()
+	if cn.rpcClient != rc {
+		cn.mu.Unlock()
+		return
+	}
+	nc := cn.netConn
+	cn.rpcClient = nil
+	cn.netConn = nil
+	cn.mu.Unlock()
+
+	nc.Close()
+	log.WithFields(log.Fields{"call": "vrpc.redial", "address": cn.client.address}).Warn("connection lost")
+	go cn.redial()
+	// The other connections to the same server are likely broken too.
+	go cn.client.pingAll()
+}
+
+func (cn *conn) redial() {
+	c := cn.client
+	backoff := minRedialBackoff
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(backoff):
+		}
+
+		rc, nc, err := c.dial()
+		if err != nil {
+			backoff *= 2
+			if backoff > maxRedialBackoff {
+				backoff = maxRedialBackoff
+			}
+			continue
+		}
+
+		cn.mu.Lock()
+		select {
+		case <-c.closed:
+			cn.mu.Unlock()
+			nc.Close()
+			return
+		default:
+		}
+		cn.rpcClient = rc
+		cn.netConn = nc
+		cn.mu.Unlock()
+		log.WithFields(log.Fields{"call": "vrpc.redial", "address": c.address}).Info("reconnected")
+		return
+	}
+}
+
+// isConnError reports whether err means the connection itself is broken,
+// as opposed to an error returned by the remote method.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
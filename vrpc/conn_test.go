@@ -0,0 +1,170 @@
+package vrpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails every connection while it is down, and records
+// when each was dialed.
+type flakyTransport struct {
+	mu      sync.Mutex
+	down    bool
+	attempt []time.Time
+}
+
+func (ft *flakyTransport) Client(conn net.Conn) (net.Conn, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.attempt = append(ft.attempt, time.Now())
+	if ft.down {
+		conn.Close()
+		return nil, errors.New("transport is down")
+	}
+	return conn, nil
+}
+
+func (ft *flakyTransport) setDown(down bool) {
+	ft.mu.Lock()
+	ft.down = down
+	ft.attempt = nil
+	ft.mu.Unlock()
+}
+
+func (ft *flakyTransport) attempts() []time.Time {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append([]time.Time(nil), ft.attempt...)
+}
+
+// breakConn takes a connection out of service as a failed call would.
+func breakConn(cn *conn) {
+	if rc := cn.get(); rc != nil {
+		cn.fail(rc)
+	}
+}
+
+func waitHealthy(t *testing.T, c *Client, healthy bool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for c.Healthy() != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("client is not healthy=%t after %s", healthy, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedialBackoff(t *testing.T) {
+	addr := serveFake(t, &fake{})
+	ft := new(flakyTransport)
+	d := &Dialer{Connections: 1, Transport: ft}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ft.setDown(true)
+	breakConn(c.conns[0])
+	if c.Healthy() {
+		t.Fatalf("client is healthy with its only connection down")
+	}
+	if err := c.Call("Fake.Do", 1, new(int)); err != ErrUnavailable {
+		t.Fatalf("call with every connection down: got %v, want ErrUnavailable", err)
+	}
+
+	// Redials after 100ms, 200ms and 400ms fail.
+	time.Sleep(800 * time.Millisecond)
+	attempts := ft.attempts()
+	if len(attempts) < 3 || len(attempts) > 4 {
+		t.Fatalf("%d redials in 800ms, want 3 with backoff", len(attempts))
+	}
+	for i := 2; i < len(attempts); i++ {
+		prev := attempts[i-1].Sub(attempts[i-2])
+		if gap := attempts[i].Sub(attempts[i-1]); gap < prev*3/2 {
+			t.Fatalf("redial %d came %s after the last, which came %s after the one before", i, gap, prev)
+		}
+	}
+
+	ft.setDown(false)
+	waitHealthy(t, c, true, 2*time.Second)
+	var reply int
+	if err := c.Call("Fake.Do", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("call after redial: got %d, %v", reply, err)
+	}
+}
+
+func TestRedialStopsOnClose(t *testing.T) {
+	addr := serveFake(t, &fake{})
+	ft := new(flakyTransport)
+	d := &Dialer{Connections: 1, Transport: ft}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.setDown(true)
+	breakConn(c.conns[0])
+	c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	if n := len(ft.attempts()); n > 1 {
+		t.Fatalf("%d redials after Close", n)
+	}
+}
+
+// TestRetryUnsent checks that a call is retried on another connection
+// only when it was never sent.
+func TestRetryUnsent(t *testing.T) {
+	f := &fake{delay: 200 * time.Millisecond}
+	addr := serveFake(t, f)
+	c, err := Dial("tcp", addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A call on a connection that has broken, but that nobody has
+	// noticed yet, fails without being sent and goes to the other one.
+	c.conns[0].netConn.Close()
+	time.Sleep(50 * time.Millisecond)
+	// make connection 0 look least busy, so the call goes there first
+	atomic.StoreInt64(&c.conns[1].inFlight, 1)
+	var reply int
+	if err := c.Call("Fake.Do", 3, &reply); err != nil || reply != 3 {
+		t.Fatalf("unsent call: got %d, %v", reply, err)
+	}
+	if n := atomic.LoadInt64(&f.received); n != 1 {
+		t.Fatalf("server received %d calls, want 1", n)
+	}
+	atomic.StoreInt64(&c.conns[1].inFlight, 0)
+
+	// A call whose connection breaks after it was sent is not retried:
+	// the server may have run it.
+	d := &Dialer{Connections: 2}
+	c2, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	done := make(chan error, 1)
+	go func() { done <- c2.Call("Fake.Do", 4, new(int)) }()
+	for atomic.LoadInt64(&f.received) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, cn := range c2.conns {
+		if atomic.LoadInt64(&cn.inFlight) > 0 {
+			breakConn(cn)
+		}
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("call on a broken connection succeeded")
+	}
+	time.Sleep(2 * f.delay)
+	if n := atomic.LoadInt64(&f.received); n != 2 {
+		t.Fatalf("server received %d calls, want 2: a sent call was retried", n)
+	}
+}
@@ -0,0 +1,81 @@
+package vrpc
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// How often idle connections are pinged, so that a restarted server is
+// noticed before the next round needs it.
+const healthInterval = 5 * time.Second
+
+// How long a connection may take to answer a ping before it is taken
+// out of service.  It is a variable for tests.
+var pingTimeout = 5 * time.Second
+
+// Health answers pings from vrpc clients.  Servers should register it
+// alongside their other services:
+//
+//	rpc.Register(new(vrpc.Health))
+type Health struct{}
+
+func (*Health) Ping(seq uint64, reply *uint64) error {
+	*reply = seq
+	return nil
+}
+
+var pingSeq uint64
+
+// Ping checks that the server is reachable and answering calls.
+func (c *Client) Ping(ctx context.Context) error {
+	seq := atomic.AddUint64(&pingSeq, 1)
+	var reply uint64
+	if err := c.CallContext(ctx, "Health.Ping", seq, &reply); err != nil {
+		return err
+	}
+	if reply != seq {
+		return fmt.Errorf("vrpc: ping reply %d, expecting %d", reply, seq)
+	}
+	return nil
+}
+
+// healthLoop pings every live connection periodically.
+func (c *Client) healthLoop() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.pingAll()
+	}
+}
+
+// pingAll pings every live connection that is idle; the calls on a busy
+// connection find out soon enough if it is broken.  A ping that fails
+// with a connection error, or that is not answered within pingTimeout,
+// takes the connection out of service and starts redialing it.
+func (c *Client) pingAll() {
+	for _, cn := range c.conns {
+		if rc := cn.get(); rc != nil && atomic.LoadInt64(&cn.inFlight) == 0 {
+			go cn.ping(rc)
+		}
+	}
+}
+
+func (cn *conn) ping(rc *rpc.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	var reply uint64
+	err := cn.callContext(ctx, "Health.Ping", atomic.AddUint64(&pingSeq, 1), &reply)
+	if _, ok := err.(*TimeoutError); ok {
+		// start only notices connection errors; a server that has
+		// stopped answering looks the same as a slow one.
+		cn.fail(rc)
+	}
+}
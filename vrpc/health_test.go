@@ -0,0 +1,82 @@
+package vrpc
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestHealthy(t *testing.T) {
+	addr := serveFake(t, &fake{})
+	ft := new(flakyTransport)
+	d := &Dialer{Connections: 2, Transport: ft}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Healthy() {
+		t.Fatalf("new client is not healthy")
+	}
+
+	ft.setDown(true)
+	breakConn(c.conns[0])
+	if !c.Healthy() {
+		t.Fatalf("client with one live connection is not healthy")
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping on the live connection: %s", err)
+	}
+	breakConn(c.conns[1])
+	if c.Healthy() {
+		t.Fatalf("client with no live connection is healthy")
+	}
+
+	ft.setDown(false)
+	waitHealthy(t, c, true, 2*time.Second)
+}
+
+// stuckHealth never answers pings until it is released.
+type stuckHealth struct {
+	release chan struct{}
+}
+
+func (h *stuckHealth) Ping(seq uint64, reply *uint64) error {
+	<-h.release
+	*reply = seq
+	return nil
+}
+
+func TestPingTimeout(t *testing.T) {
+	defer func(d time.Duration) { pingTimeout = d }(pingTimeout)
+	pingTimeout = 50 * time.Millisecond
+
+	h := &stuckHealth{release: make(chan struct{})}
+	defer close(h.release)
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Health", h); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer(srv, GobCodec).Accept(l)
+
+	ft := new(flakyTransport)
+	d := &Dialer{Connections: 1, Transport: ft}
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The server is up but does not answer, so the connection is taken
+	// out of service.
+	ft.setDown(true)
+	c.pingAll()
+	waitHealthy(t, c, false, time.Second)
+}
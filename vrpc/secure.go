@@ -0,0 +1,318 @@
+package vrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The secure transport authenticates both ends of a connection by their
+// static Curve25519 keys (the same keys servers use to peel onions) and
+// encrypts everything after the handshake.  The handshake is:
+//
+//	client -> server: client static public key, client ephemeral public key
+//	server -> client: server ephemeral public key
+//
+// Both sides then derive a key for each direction from the three
+// Diffie-Hellman results ee, es and se, so only a client holding the
+// private half of its static key and a server holding the private half of
+// the static key the client expects can compute them.  Each side's first
+// record is a fixed confirmation message; a side that cannot decrypt it
+// closes the connection.
+
+const (
+	handshakeTimeout = 10 * time.Second
+	maxRecordSize    = 64 * 1024
+)
+
+var confirmMessage = []byte("vrpc secure transport v1")
+
+// ErrUnauthorized is returned when the peer's static key is not one that
+// the handshake was told to accept.
+var ErrUnauthorized = errors.New("vrpc: peer not authorized")
+
+// Transport secures connections as they are dialed.
+type Transport interface {
+	Client(conn net.Conn) (net.Conn, error)
+}
+
+// SecureTransport authenticates the server as the holder of PeerKey and
+// itself as the holder of PublicKey.
+type SecureTransport struct {
+	PublicKey  *[32]byte
+	PrivateKey *[32]byte
+	PeerKey    *[32]byte
+}
+
+func (t *SecureTransport) Client(conn net.Conn) (net.Conn, error) {
+	sc := &secureConn{Conn: conn}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := sc.clientHandshake(t.PublicKey, t.PrivateKey, t.PeerKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return sc, nil
+}
+
+// SecureListener wraps l so that every accepted connection performs the
+// server side of the handshake.  authorize is called with the client's
+// static key and decides whether the client may connect.  As with TLS,
+// the handshake happens on the connection's first Read or Write so that
+// a slow client cannot stall Accept.
+func SecureListener(l net.Listener, publicKey, privateKey *[32]byte, authorize func(peer *[32]byte) bool) net.Listener {
+	return &secureListener{
+		Listener:   l,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		authorize:  authorize,
+	}
+}
+
+type secureListener struct {
+	net.Listener
+	publicKey  *[32]byte
+	privateKey *[32]byte
+	authorize  func(*[32]byte) bool
+}
+
+func (l *secureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &secureConn{Conn: conn}
+	sc.handshake = func() error {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+		return sc.serverHandshake(l.publicKey, l.privateKey, l.authorize)
+	}
+	return sc, nil
+}
+
+type secureConn struct {
+	net.Conn
+
+	// peerKey is the static key the peer proved it holds.
+	peerKey [32]byte
+
+	handshakeOnce sync.Once
+	handshake     func() error
+	handshakeErr  error
+
+	readMu    sync.Mutex
+	readKey   [32]byte
+	readSeq   uint64
+	readBuf   []byte
+	writeMu   sync.Mutex
+	writeKey  [32]byte
+	writeSeq  uint64
+	recordBuf []byte
+}
+
+// PeerKey returns the static key of conn's peer, if conn was accepted by
+// a SecureListener or made by a SecureTransport.  It finishes the
+// handshake first.
+func PeerKey(conn net.Conn) (*[32]byte, error) {
+	sc, ok := conn.(*secureConn)
+	if !ok {
+		return nil, errors.New("vrpc: connection is not secure")
+	}
+	if err := sc.doHandshake(); err != nil {
+		return nil, err
+	}
+	key := sc.peerKey
+	return &key, nil
+}
+
+func (sc *secureConn) doHandshake() error {
+	sc.handshakeOnce.Do(func() {
+		if sc.handshake != nil {
+			sc.handshakeErr = sc.handshake()
+		}
+	})
+	return sc.handshakeErr
+}
+
+func (sc *secureConn) clientHandshake(public, private, serverStatic *[32]byte) error {
+	ephPublic, ephPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	hello := make([]byte, 64)
+	copy(hello[0:32], public[:])
+	copy(hello[32:64], ephPublic[:])
+	if _, err := sc.Conn.Write(hello); err != nil {
+		return err
+	}
+
+	var serverEph [32]byte
+	if _, err := io.ReadFull(sc.Conn, serverEph[:]); err != nil {
+		return fmt.Errorf("vrpc: handshake: %s", err)
+	}
+
+	var ee, es, se [32]byte
+	box.Precompute(&ee, &serverEph, ephPrivate)
+	box.Precompute(&es, serverStatic, ephPrivate)
+	box.Precompute(&se, &serverEph, private)
+
+	c2s, s2c := deriveKeys(public, ephPublic, serverStatic, &serverEph, &ee, &es, &se)
+	sc.peerKey = *serverStatic
+	sc.writeKey = *c2s
+	sc.readKey = *s2c
+	return sc.confirm()
+}
+
+func (sc *secureConn) serverHandshake(public, private *[32]byte, authorize func(*[32]byte) bool) error {
+	hello := make([]byte, 64)
+	if _, err := io.ReadFull(sc.Conn, hello); err != nil {
+		return fmt.Errorf("vrpc: handshake: %s", err)
+	}
+	var clientStatic, clientEph [32]byte
+	copy(clientStatic[:], hello[0:32])
+	copy(clientEph[:], hello[32:64])
+	if !authorize(&clientStatic) {
+		return ErrUnauthorized
+	}
+
+	ephPublic, ephPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := sc.Conn.Write(ephPublic[:]); err != nil {
+		return err
+	}
+
+	var ee, es, se [32]byte
+	box.Precompute(&ee, &clientEph, ephPrivate)
+	box.Precompute(&es, &clientEph, private)
+	box.Precompute(&se, &clientStatic, ephPrivate)
+
+	c2s, s2c := deriveKeys(&clientStatic, &clientEph, public, ephPublic, &ee, &es, &se)
+	sc.peerKey = clientStatic
+	sc.readKey = *c2s
+	sc.writeKey = *s2c
+	return sc.confirm()
+}
+
+func deriveKeys(clientStatic, clientEph, serverStatic, serverEph, ee, es, se *[32]byte) (c2s, s2c *[32]byte) {
+	salt := sha256.New()
+	salt.Write(confirmMessage)
+	salt.Write(clientStatic[:])
+	salt.Write(clientEph[:])
+	salt.Write(serverStatic[:])
+	salt.Write(serverEph[:])
+
+	secret := make([]byte, 0, 96)
+	secret = append(secret, ee[:]...)
+	secret = append(secret, es[:]...)
+	secret = append(secret, se[:]...)
+
+	kdf := hkdf.New(sha256.New, secret, salt.Sum(nil), nil)
+	c2s, s2c = new([32]byte), new([32]byte)
+	io.ReadFull(kdf, c2s[:])
+	io.ReadFull(kdf, s2c[:])
+	return
+}
+
+// confirm sends the confirmation record and checks the peer's.
+func (sc *secureConn) confirm() error {
+	if err := sc.writeRecord(confirmMessage); err != nil {
+		return err
+	}
+	msg, err := sc.readRecord()
+	if err != nil {
+		return ErrUnauthorized
+	}
+	if !bytes.Equal(msg, confirmMessage) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func recordNonce(seq uint64) *[24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[0:8], seq)
+	return &nonce
+}
+
+func (sc *secureConn) writeRecord(p []byte) error {
+	sc.recordBuf = append(sc.recordBuf[:0], 0, 0, 0, 0)
+	sc.recordBuf = secretbox.Seal(sc.recordBuf, p, recordNonce(sc.writeSeq), &sc.writeKey)
+	sc.writeSeq++
+	binary.BigEndian.PutUint32(sc.recordBuf[0:4], uint32(len(sc.recordBuf)-4))
+	_, err := sc.Conn.Write(sc.recordBuf)
+	return err
+}
+
+func (sc *secureConn) readRecord() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(sc.Conn, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxRecordSize+secretbox.Overhead {
+		return nil, fmt.Errorf("vrpc: record too large (%d bytes)", n)
+	}
+	ctxt := make([]byte, n)
+	if _, err := io.ReadFull(sc.Conn, ctxt); err != nil {
+		return nil, err
+	}
+	msg, ok := secretbox.Open(nil, ctxt, recordNonce(sc.readSeq), &sc.readKey)
+	if !ok {
+		return nil, errors.New("vrpc: record authentication failed")
+	}
+	sc.readSeq++
+	return msg, nil
+}
+
+func (sc *secureConn) Read(p []byte) (int, error) {
+	if err := sc.doHandshake(); err != nil {
+		return 0, err
+	}
+	sc.readMu.Lock()
+	defer sc.readMu.Unlock()
+	for len(sc.readBuf) == 0 {
+		msg, err := sc.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		sc.readBuf = msg
+	}
+	n := copy(p, sc.readBuf)
+	sc.readBuf = sc.readBuf[n:]
+	return n, nil
+}
+
+func (sc *secureConn) Write(p []byte) (int, error) {
+	if err := sc.doHandshake(); err != nil {
+		return 0, err
+	}
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		if err := sc.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+package vrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+type keypair struct {
+	public, private *[32]byte
+}
+
+func genKeypair(t *testing.T) keypair {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keypair{pub, priv}
+}
+
+type echo struct{}
+
+func (*echo) Echo(args []byte, reply *[]byte) error {
+	*reply = args
+	return nil
+}
+
+func serveSecure(t *testing.T, server keypair, allowed *[32]byte) string {
+	srv := rpc.NewServer()
+	if err := srv.Register(new(Health)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterName("Echo", new(echo)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sl := SecureListener(l, server.public, server.private, func(peer *[32]byte) bool {
+		return *peer == *allowed
+	})
+	go NewServer(srv, GobCodec).Accept(sl)
+	return l.Addr().String()
+}
+
+func dialSecure(addr string, client keypair, serverKey *[32]byte) (*Client, error) {
+	d := &Dialer{
+		Connections: 2,
+		Transport: &SecureTransport{
+			PublicKey:  client.public,
+			PrivateKey: client.private,
+			PeerKey:    serverKey,
+		},
+	}
+	return d.Dial("tcp", addr)
+}
+
+func TestSecureTransport(t *testing.T) {
+	server := genKeypair(t)
+	client := genKeypair(t)
+	addr := serveSecure(t, server, client.public)
+
+	c, err := dialSecure(addr, client, server.public)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer c.Close()
+
+	// Large enough to span several records.
+	args := make([]byte, 3*maxRecordSize)
+	rand.Read(args)
+	var reply []byte
+	if err := c.Call("Echo.Echo", args, &reply); err != nil {
+		t.Fatalf("Echo: %s", err)
+	}
+	if !bytes.Equal(args, reply) {
+		t.Fatalf("echo reply does not match")
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %s", err)
+	}
+}
+
+func TestSecureTransportWrongServer(t *testing.T) {
+	server := genKeypair(t)
+	client := genKeypair(t)
+	impostor := genKeypair(t)
+	addr := serveSecure(t, impostor, client.public)
+
+	if _, err := dialSecure(addr, client, server.public); err == nil {
+		t.Fatalf("connected to a server with the wrong key")
+	}
+}
+
+func TestSecureTransportUnauthorizedClient(t *testing.T) {
+	server := genKeypair(t)
+	client := genKeypair(t)
+	stranger := genKeypair(t)
+	addr := serveSecure(t, server, client.public)
+
+	if _, err := dialSecure(addr, stranger, server.public); err == nil {
+		t.Fatalf("server accepted an unauthorized client")
+	}
+}
+
+func TestPeerKey(t *testing.T) {
+	server := genKeypair(t)
+	client := genKeypair(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sl := SecureListener(l, server.public, server.private, func(peer *[32]byte) bool { return true })
+
+	peers := make(chan *[32]byte, 1)
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			peers <- nil
+			return
+		}
+		defer conn.Close()
+		key, err := PeerKey(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		peers <- key
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SecureTransport{PublicKey: client.public, PrivateKey: client.private, PeerKey: server.public}
+	sc, err := st.Client(conn)
+	if err != nil {
+		t.Fatalf("handshake: %s", err)
+	}
+	defer sc.Close()
+	if key, err := PeerKey(sc); err != nil || *key != *server.public {
+		t.Fatalf("client sees peer key %v (%v), want the server's", key, err)
+	}
+	if key := <-peers; key == nil || *key != *client.public {
+		t.Fatalf("server sees peer key %v, want the client's", key)
+	}
+	if _, err := PeerKey(conn); err == nil {
+		t.Fatalf("PeerKey of a plain connection succeeded")
+	}
+}
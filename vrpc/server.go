@@ -0,0 +1,168 @@
+package vrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Every connection starts with a preface byte that says what it carries:
+// RPCs for the rest of its life, or a single stream.  A stream preface is
+// followed by the length of the stream's name and the name, and the
+// server answers with one status byte before handing the connection to
+// the stream's handler.
+const (
+	prefaceRPC    byte = 'R'
+	prefaceStream byte = 'S'
+
+	streamOK      byte = 0
+	streamUnknown byte = 1
+)
+
+// ErrUnknownStream is returned by Stream when the server has no handler
+// for the stream.
+var ErrUnknownStream = errors.New("vrpc: unknown stream")
+
+// A StreamHandler takes over a connection opened with Client.Stream.
+// The connection is closed when the handler returns.
+type StreamHandler func(conn net.Conn)
+
+// Server serves the connections made by vrpc clients: RPCs on an
+// rpc.Server, and streams on the handlers registered with HandleStream.
+type Server struct {
+	rpc   *rpc.Server
+	codec Codec
+
+	mu      sync.RWMutex
+	streams map[string]StreamHandler
+}
+
+func NewServer(rpcServer *rpc.Server, codec Codec) *Server {
+	return &Server{
+		rpc:     rpcServer,
+		codec:   codec,
+		streams: make(map[string]StreamHandler),
+	}
+}
+
+// HandleStream registers the handler for streams opened under name.
+func (s *Server) HandleStream(name string, handler StreamHandler) {
+	if len(name) > 255 {
+		panic("vrpc: stream name too long")
+	}
+	s.mu.Lock()
+	s.streams[name] = handler
+	s.mu.Unlock()
+}
+
+// Accept serves connections from l until l is closed.
+func (s *Server) Accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection.
+func (s *Server) ServeConn(conn net.Conn) {
+	var preface [1]byte
+	if _, err := io.ReadFull(conn, preface[:]); err != nil {
+		conn.Close()
+		return
+	}
+	switch preface[0] {
+	case prefaceRPC:
+		serveConn(s.rpc, conn, s.codec)
+	case prefaceStream:
+		s.serveStream(conn)
+	default:
+		log.WithFields(log.Fields{"remote": conn.RemoteAddr(), "preface": preface[0]}).Warn("vrpc: bad connection preface")
+		conn.Close()
+	}
+}
+
+func (s *Server) serveStream(conn net.Conn) {
+	defer conn.Close()
+
+	var size [1]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	name := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return
+	}
+
+	s.mu.RLock()
+	handler := s.streams[string(name)]
+	s.mu.RUnlock()
+	if handler == nil {
+		conn.Write([]byte{streamUnknown})
+		return
+	}
+	if _, err := conn.Write([]byte{streamOK}); err != nil {
+		return
+	}
+	handler(conn)
+}
+
+// Stream opens a new connection to the handler registered under name on
+// the server.  The stream is closed when ctx is done, and its deadline
+// is ctx's deadline.  The caller must close the stream.
+func (c *Client) Stream(ctx context.Context, name string) (net.Conn, error) {
+	if len(name) > 255 {
+		return nil, fmt.Errorf("vrpc: stream name too long: %q", name)
+	}
+	conn, err := c.dialConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	hello := append([]byte{prefaceStream, byte(len(name))}, name...)
+	if _, err := conn.Write(hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if status[0] != streamOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStream, name)
+	}
+
+	sc := &streamConn{Conn: conn, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-sc.done:
+		}
+	}()
+	return sc, nil
+}
+
+type streamConn struct {
+	net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (sc *streamConn) Close() error {
+	sc.closeOnce.Do(func() { close(sc.done) })
+	return sc.Conn.Close()
+}
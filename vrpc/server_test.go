@@ -0,0 +1,123 @@
+package vrpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func serveStreams(t *testing.T) string {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Fake", new(fake)); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(srv, GobCodec)
+	s.HandleStream("Upper", func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			for i, b := range line {
+				if 'a' <= b && b <= 'z' {
+					line[i] = b - 'a' + 'A'
+				}
+			}
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Accept(l)
+	return l.Addr().String()
+}
+
+func TestStream(t *testing.T) {
+	c, err := Dial("tcp", serveStreams(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stream, err := c.Stream(context.Background(), "Upper")
+	if err != nil {
+		t.Fatalf("Stream: %s", err)
+	}
+	defer stream.Close()
+
+	r := bufio.NewReader(stream)
+	for _, tt := range []struct{ in, out string }{
+		{"hello\n", "HELLO\n"},
+		{"vuvuzela\n", "VUVUZELA\n"},
+	} {
+		if _, err := io.WriteString(stream, tt.in); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != tt.out {
+			t.Fatalf("got %q, want %q", line, tt.out)
+		}
+	}
+
+	// RPCs keep working alongside the stream.
+	var n int
+	if err := c.Call("Fake.Do", 3, &n); err != nil || n != 3 {
+		t.Fatalf("Fake.Do: got %d, %v", n, err)
+	}
+}
+
+func TestStreamUnknown(t *testing.T) {
+	c, err := Dial("tcp", serveStreams(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Stream(context.Background(), "Lower"); !errors.Is(err, ErrUnknownStream) {
+		t.Fatalf("expecting ErrUnknownStream, got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	c, err := Dial("tcp", serveStreams(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.Stream(ctx, "Upper")
+	if err != nil {
+		t.Fatalf("Stream: %s", err)
+	}
+	defer stream.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("read succeeded after cancel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("read still blocked after cancel")
+	}
+}
@@ -24,16 +24,26 @@ type Client struct {
 	roundHandlers map[uint32]ConvoHandler
 	convoHandler  ConvoHandler
 	dialHandler   DialHandler
+
+	// membership is the entry server's latest view of which mix
+	// servers are up.
+	membership *Membership
+	// lastConvoRound is the latest convo round announced.
+	lastConvoRound uint32
+	// privacy is what the entry server last said we have spent.
+	privacy PrivacyLoss
 }
 
 type ConvoHandler interface {
-	NextConvoRequest(round uint32) *ConvoRequest
+	NextConvoRequest(round uint32, epoch uint64, route []RouteHop) *ConvoRequest
 	HandleConvoResponse(response *ConvoResponse)
 	HandleConvoError(error *ConvoError)
+	RetryConvoRequest(retry *AnnounceConvoRetry) *ConvoRequest
 }
 
 type DialHandler interface {
-	NextDialRequest(round uint32, buckets uint32) *DialRequest
+	NextDialRequest(round uint32, buckets uint32, epoch uint64, route []RouteHop, bloom bool) *DialRequest
+	MatchDialFilter(f *DialFilter) bool
 	HandleDialBucket(db *DialBucket)
 }
 
@@ -77,6 +87,9 @@ func (c *Client) Connect() error {
 		return err
 	}
 	c.ws = ws
+	c.Lock()
+	c.membership = nil
+	c.Unlock()
 	go c.readLoop()
 	return nil
 }
@@ -131,26 +144,110 @@ func (c *Client) handleResponse(v interface{}) {
 	case *AnnounceConvoRound:
 		// As long as the client is connected to the entry server
 		// It will send ConvoRequest, no matter fake or authentic
-		c.Send(c.nextConvoRequest(v.Round))
+		if r := c.nextConvoRequest(v); r != nil {
+			c.Send(r)
+		}
 	case *AnnounceDialRound:
-		c.Send(c.dialHandler.NextDialRequest(v.Round, v.Buckets))
+		if r := c.nextDialRequest(v); r != nil {
+			c.Send(r)
+		}
 	case *ConvoResponse:
 		c.deliverConvoResponse(v)
 	case *DialBucket:
 		c.dialHandler.HandleDialBucket(v)
+	case *DialFilter:
+		c.handleDialFilter(v)
 	// TODO: Error Message can be more detailed
 	case *ConvoError:
 		c.handleConvoError(v)
-		
+	case *AnnounceConvoRetry:
+		c.retryConvoRequest(v)
+	case *Membership:
+		c.setMembership(v)
+	case *PrivacyLoss:
+		c.Lock()
+		c.privacy = *v
+		c.Unlock()
+	}
+}
+
+// handleDialFilter fetches our bucket in a dial round if its filter
+// may hold an introduction for us.
+func (c *Client) handleDialFilter(f *DialFilter) {
+	if c.dialHandler.MatchDialFilter(f) {
+		c.Send(&DialFetch{Round: f.Round})
+	}
+}
+
+// setMembership keeps the newest view; responses are handled
+// concurrently, so an older one may arrive last.
+func (c *Client) setMembership(m *Membership) {
+	c.Lock()
+	defer c.Unlock()
+	if c.membership == nil || m.Epoch > c.membership.Epoch {
+		c.membership = m
 	}
 }
 
-func (c *Client) nextConvoRequest(round uint32) *ConvoRequest {
+// checkRoute makes sure every server on an announced route is up, as far
+// as the membership view drawn from the same PKI epoch knows.
+func (c *Client) checkRoute(epoch uint64, route []RouteHop) error {
+	c.Lock()
+	m := c.membership
+	c.Unlock()
+	if m == nil || m.PKIEpoch != epoch {
+		return nil
+	}
+	for _, hop := range route {
+		if !m.Live(hop.Server) {
+			return fmt.Errorf("server %q on the route has been evicted (membership epoch %d)", hop.Server, m.Epoch)
+		}
+	}
+	return nil
+}
+
+func (c *Client) nextConvoRequest(announcement *AnnounceConvoRound) *ConvoRequest {
+	round := announcement.Round
+	if err := c.checkRoute(announcement.Epoch, announcement.Route); err != nil {
+		log.WithFields(log.Fields{"round": round, "call": "checkRoute"}).Error(err)
+		return nil
+	}
 	// TODO: Why lock is needed here?
 	c.Lock()
 	c.roundHandlers[round] = c.convoHandler
+	if round > c.lastConvoRound {
+		c.lastConvoRound = round
+	}
 	c.Unlock()
-	return c.convoHandler.NextConvoRequest(round)
+	return c.convoHandler.NextConvoRequest(round, announcement.Epoch, announcement.Route)
+}
+
+// LastConvoRound returns the latest convo round the entry server has
+// announced.
+func (c *Client) LastConvoRound() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.lastConvoRound
+}
+
+// PrivacyLoss returns the privacy we have spent, as of the last dial
+// round.
+func (c *Client) PrivacyLoss() PrivacyLoss {
+	c.Lock()
+	defer c.Unlock()
+	return c.privacy
+}
+
+func (c *Client) nextDialRequest(announcement *AnnounceDialRound) *DialRequest {
+	if announcement.Buckets == 0 {
+		log.WithFields(log.Fields{"round": announcement.Round}).Error("dial round has no buckets")
+		return nil
+	}
+	if err := c.checkRoute(announcement.Epoch, announcement.Route); err != nil {
+		log.WithFields(log.Fields{"round": announcement.Round, "call": "checkRoute"}).Error(err)
+		return nil
+	}
+	return c.dialHandler.NextDialRequest(announcement.Round, announcement.Buckets, announcement.Epoch, announcement.Route, announcement.Bloom)
 }
 
 func (c *Client) deliverConvoResponse(r *ConvoResponse) {
@@ -165,6 +262,26 @@ func (c *Client) deliverConvoResponse(r *ConvoResponse) {
 
 	convo.HandleConvoResponse(r)
 }
+// retryConvoRequest sends the round's message again on the repaired
+// route.  The round keeps its handler, since the replies still come
+// back for the original round.
+func (c *Client) retryConvoRequest(retry *AnnounceConvoRetry) {
+	c.Lock()
+	convo, ok := c.roundHandlers[retry.Round]
+	c.Unlock()
+	if !ok {
+		log.WithFields(log.Fields{"round": retry.Round}).Error("round not found")
+		return
+	}
+	if err := c.checkRoute(retry.Epoch, retry.Route); err != nil {
+		log.WithFields(log.Fields{"round": retry.Round, "call": "checkRoute"}).Error(err)
+		return
+	}
+	if r := convo.RetryConvoRequest(retry); r != nil {
+		c.Send(r)
+	}
+}
+
 func (c *Client) handleConvoError(e *ConvoError) {
 	c.Lock()
 	convo, ok := c.roundHandlers[e.Round]
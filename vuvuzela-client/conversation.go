@@ -24,7 +24,7 @@ type Conversation struct {
 	// Represents a valid route
 	route         []string
 
-	pki           *PKI
+	pkis          *PKIStore
 	peerName      string
 	peerPublicKey *BoxKey
 	myPublicKey   *BoxKey
@@ -37,6 +37,11 @@ type Conversation struct {
 	lastPeerResponding bool
 	lastLatency        time.Duration
 	lastRound          uint32
+
+	// startRound is the first round in which the conversation talks to
+	// its peer, such as the rendezvous round of an introduction.  Until
+	// then it sends nothing the peer could read and holds messages back.
+	startRound uint32
 }
 
 func (c *Conversation) Init() {
@@ -50,6 +55,15 @@ func (c *Conversation) Init() {
 type pendingRound struct {
 	onionSharedKeys []*[32]byte
 	sentMessage     [SizeEncryptedMessage]byte
+	message         []byte
+
+	// onionRound is the round whose nonces sealed the onion and the
+	// message, and that picked the dead drop; it differs from the round
+	// when the round was retried.
+	onionRound uint32
+
+	// waiting is set for rounds before the conversation's startRound.
+	waiting bool
 }
 
 type ConvoMessage struct {
@@ -98,22 +112,37 @@ func (c *Conversation) QueueTextMessage(msg []byte) {
 	c.outQueue <- msg
 }
 
-func (c *Conversation) NextConvoRequest(round uint32) *ConvoRequest {
+// NextConvoRequest seals the next message for the round's route.  It
+// returns nil if the route does not match the PKI of the round's epoch.
+func (c *Conversation) NextConvoRequest(round uint32, epoch uint64, hops []RouteHop) *ConvoRequest {
+	pki, err := c.pkis.Epoch(epoch)
+	if err != nil {
+		log.WithFields(log.Fields{"round": round, "call": "Epoch"}).Error(err)
+		return nil
+	}
+	route, err := pki.VerifyRoute(hops)
+	if err != nil {
+		log.WithFields(log.Fields{"round": round, "call": "VerifyRoute"}).Error(err)
+		return nil
+	}
+
 	c.Lock()
 	c.lastRound = round
+	c.route = route
+	waiting := round < c.startRound
 	c.Unlock()
 	go c.gui.redraw()
 
-	var body interface{}
-
-	select {
-	// m is plaintext
-	case m := <-c.outQueue:
-		body = &TextMessage{Message: m}
-	default:
-		// Is timestampmessage distinguishable?
-		body = &TimestampMessage{
-			Timestamp: time.Now(),
+	// Is timestampmessage distinguishable?
+	var body interface{} = &TimestampMessage{
+		Timestamp: time.Now(),
+	}
+	if !waiting {
+		select {
+		// m is plaintext
+		case m := <-c.outQueue:
+			body = &TextMessage{Message: m}
+		default:
 		}
 	}
 	msg := &ConvoMessage{
@@ -131,13 +160,20 @@ func (c *Conversation) NextConvoRequest(round uint32) *ConvoRequest {
 		DeadDrop:         c.deadDrop(round),
 		EncryptedMessage: encmsg,
 	}
+	if waiting {
+		// the peer is not here yet
+		rand.Read(exchange.DeadDrop[:])
+	}
 
 	// TODO: Use onion to transimit?
-	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), c.pki.ServerKeys(c.route).Keys())
+	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), pki.ServerKeys(route).Keys())
 
 	pr := &pendingRound{
 		onionSharedKeys: sharedKeys,
 		sentMessage:     encmsg,
+		message:         msgdata[:],
+		onionRound:      round,
+		waiting:         waiting,
 	}
 	c.Lock()
 	// What is pendingRounds used for?
@@ -170,17 +206,17 @@ func (c *Conversation) HandleConvoResponse(r *ConvoResponse) {
 		return
 	}
 
-	encmsg, ok := onionbox.Open(r.Onion, BackwardNonce(r.Round), pr.onionSharedKeys)
+	encmsg, ok := onionbox.Open(r.Onion, BackwardNonce(pr.onionRound), pr.onionSharedKeys)
 	if !ok {
 		rlog.Error("decrypting onion failed", len(pr.onionSharedKeys))
 		return
 	}
 
-	if bytes.Compare(encmsg, pr.sentMessage[:]) == 0 && !c.Solo() {
+	if pr.waiting || (bytes.Compare(encmsg, pr.sentMessage[:]) == 0 && !c.Solo()) {
 		return
 	}
 
-	msgdata, ok := c.Open(encmsg, r.Round, c.theirRole())
+	msgdata, ok := c.Open(encmsg, pr.onionRound, c.theirRole())
 	if !ok {
 		rlog.Error("decrypting peer message failed")
 		return
@@ -209,25 +245,65 @@ func (c *Conversation) HandleConvoResponse(r *ConvoResponse) {
 		c.Unlock()
 	}
 }
-// Assume Convo Error only represents server chain broken so far
-// Let client decided router or entry server?
-// Entry Server for now
+// RetryConvoRequest seals the message sent in a failed round again for
+// the repaired route, so the queued message goes out without the user
+// sending it again.
+func (c *Conversation) RetryConvoRequest(retry *AnnounceConvoRetry) *ConvoRequest {
+	pki, err := c.pkis.Epoch(retry.Epoch)
+	if err != nil {
+		log.WithFields(log.Fields{"round": retry.Round, "call": "Epoch"}).Error(err)
+		return nil
+	}
+	route, err := pki.VerifyRoute(retry.Route)
+	if err != nil {
+		log.WithFields(log.Fields{"round": retry.Round, "call": "VerifyRoute"}).Error(err)
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	pr, ok := c.pendingRounds[retry.Round]
+	if !ok {
+		return nil
+	}
+
+	// The last server may have seen the failed round's exchange, so the
+	// retry uses the retry round's dead drop and nonce.  The peer does the
+	// same, since it gets the same announcement.
+	var encmsg [SizeEncryptedMessage]byte
+	copy(encmsg[:], c.Seal(pr.message, retry.RetryRound, c.myRole()))
+	exchange := &ConvoExchange{
+		DeadDrop:         c.deadDrop(retry.RetryRound),
+		EncryptedMessage: encmsg,
+	}
+	if pr.waiting {
+		rand.Read(exchange.DeadDrop[:])
+	}
+	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(retry.RetryRound), pki.ServerKeys(route).Keys())
+	pr.onionSharedKeys = sharedKeys
+	pr.sentMessage = encmsg
+	pr.onionRound = retry.RetryRound
+	c.route = route
+
+	return &ConvoRequest{
+		Round: retry.RetryRound,
+		Onion: onion,
+	}
+}
+
+// HandleConvoError reports a round that could not be delivered.  The
+// entry server routes later rounds around a failed server, so there is
+// nothing to change here.
 func (c *Conversation) HandleConvoError(e *ConvoError) {
+	if e.Hop == nil {
+		c.gui.Printf("round %d failed: %s\n", e.Round, e.Err)
+		return
+	}
 	c.gui.Printf("Middle Server Fault: Please rephrase and enter\n")
-	c.gui.Printf("server chain broken: %s\n", e.Err)
-	c.gui.Printf("Removing %s\n", e.Err)
-	failedServerName := e.Err
-	for i, s := range c.route {
-		if s == failedServerName {
-			c.route = append(
-				c.route[:i],
-				c.route[i+1:]...
-			)
-		}
+	c.gui.Printf("server chain broken at %s (level %d, %s)\n", e.Hop.Server, e.Hop.Level, e.Hop.Stage)
+	if e.Hop.Retryable {
+		c.gui.logRecov()
 	}
-	c.gui.Printf("Updating route to %s\n", c.route)
-	c.gui.logRecov()
-	return
 }
 
 type Status struct {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 
 	"vuvuzela.io/crypto/onionbox"
@@ -11,13 +13,21 @@ import (
 
 type Dialer struct {
 	gui          *GuiClient
-	pki          *PKI
+	pkis         *PKIStore
 	myPublicKey  *BoxKey
 	myPrivateKey *BoxKey
 
+	// fetchRate is the fraction of Bloom-filter dial rounds in which we
+	// fetch our bucket even though no contact's tag is in its filter.
+	fetchRate float64
+
 	userDialRequests chan *BoxKey
 }
 
+// rendezvousRounds is how many convo rounds after the current one an
+// introduction asks its recipient to start talking.
+const rendezvousRounds = 4
+
 func (d *Dialer) Init() {
 	d.userDialRequests = make(chan *BoxKey, 4)
 }
@@ -26,27 +36,50 @@ func (d *Dialer) QueueRequest(publicKey *BoxKey) {
 	d.userDialRequests <- publicKey
 }
 
-func (d *Dialer) NextDialRequest(round uint32, buckets uint32) *DialRequest {
+// NextDialRequest seals the next introduction, or a dummy one, for the
+// round's route.  The introduction is tagged if the round's buckets
+// come as Bloom filters.  It returns nil if the route does not match
+// the PKI of the round's epoch.
+func (d *Dialer) NextDialRequest(round uint32, buckets uint32, epoch uint64, hops []RouteHop, bloom bool) *DialRequest {
+	pki, err := d.pkis.Epoch(epoch)
+	if err != nil {
+		log.WithFields(log.Fields{"round": round, "call": "Epoch"}).Error(err)
+		return nil
+	}
+	route, err := pki.VerifyRoute(hops)
+	if err != nil {
+		log.WithFields(log.Fields{"round": round, "call": "VerifyRoute"}).Error(err)
+		return nil
+	}
+
 	var ex *DialExchange
 	select {
 	case pk := <-d.userDialRequests:
+		rendezvous := d.gui.convoRound() + rendezvousRounds
 		intro := (&Introduction{
-			Rendezvous:  round + 4,
+			Rendezvous:  rendezvous,
 			LongTermKey: *d.myPublicKey,
 		}).Marshal()
+		d.gui.dialed(pk, rendezvous)
 		ctxt, _ := onionbox.Seal(intro, ForwardNonce(round), BoxKeys{pk}.Keys())
 		ex = &DialExchange{
 			Bucket: KeyDialBucket(pk, buckets),
 		}
+		if bloom {
+			ex.Tag = KeyDialTag(pk, d.myPrivateKey, round)
+		} else {
+			rand.Read(ex.Tag[:])
+		}
 		copy(ex.EncryptedIntro[:], ctxt)
 	default:
 		ex = &DialExchange{
 			Bucket: 0,
 		}
+		rand.Read(ex.Tag[:])
 		rand.Read(ex.EncryptedIntro[:])
 	}
 
-	onion, _ := onionbox.Seal(ex.Marshal(), ForwardNonce(round), d.pki.ServerKeys(d.pki.ServerOrder).Keys())
+	onion, _ := onionbox.Seal(ex.Marshal(), ForwardNonce(round), pki.ServerKeys(route).Keys())
 
 	return &DialRequest{
 		Round: round,
@@ -54,10 +87,44 @@ func (d *Dialer) NextDialRequest(round uint32, buckets uint32) *DialRequest {
 	}
 }
 
+// MatchDialFilter reports whether to fetch our bucket: when its filter
+// may hold an introduction from one of our contacts, and otherwise in a
+// fetchRate fraction of rounds.  We cannot compute the tag of a stranger,
+// so introductions from strangers only arrive in those rounds.
+func (d *Dialer) MatchDialFilter(f *DialFilter) bool {
+	if f.Filter == nil || coin(d.fetchRate) {
+		return true
+	}
+	for _, pk := range d.gui.contacts() {
+		if *pk == *d.myPublicKey {
+			continue
+		}
+		tag := KeyDialTag(pk, d.myPrivateKey, f.Round)
+		if f.Filter.Test(&tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// coin returns true with probability p.
+func coin(p float64) bool {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < p
+}
+
 func (d *Dialer) HandleDialBucket(db *DialBucket) {
+	for _, intro := range d.openIntros(db) {
+		d.gui.introduced(intro)
+	}
+}
+
+// openIntros returns the introductions in the bucket that are for us.
+func (d *Dialer) openIntros(db *DialBucket) []*Introduction {
 	nonce := ForwardNonce(db.Round)
 
-OUTER:
+	var intros []*Introduction
 	for _, b := range db.Intros {
 		var pk [32]byte
 		copy(pk[:], b[0:32])
@@ -70,13 +137,7 @@ OUTER:
 		if err := intro.Unmarshal(data); err != nil {
 			continue
 		}
-
-		for name, key := range d.pki.People {
-			if *key == intro.LongTermKey {
-				d.gui.Warnf("Received introduction: %s\n", name)
-				continue OUTER
-			}
-		}
-		d.gui.Warnf("Received introduction: (%s)\n", &intro.LongTermKey)
+		intros = append(intros, intro)
 	}
+	return intros
 }
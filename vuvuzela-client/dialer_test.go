@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/rpc"
+	"testing"
+
+	. "vuvuzela.io/vuvuzela"
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// serveDialChain runs noiseless dial services for pki's ServerOrder,
+// each forwarding to the next, and returns clients connected to the
+// first and last ones.
+func serveDialChain(t *testing.T, pki *PKI, keys map[string]*BoxKey) (first, last *vrpc.Client) {
+	var next *vrpc.Client
+	for i := len(pki.ServerOrder) - 1; i >= 0; i-- {
+		name := pki.ServerOrder[i]
+		to := next
+		srv := &DialService{
+			Pipeline:   NewPipeline(1),
+			PKI:        pki,
+			ServerName: name,
+			PrivateKey: keys[name],
+			NextClient: func(string) (*vrpc.Client, error) { return to, nil },
+			LastServer: i == len(pki.ServerOrder)-1,
+		}
+		InitDialService(srv)
+
+		rpcServer := rpc.NewServer()
+		if err := rpcServer.Register(srv); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go vrpc.NewServer(rpcServer, vrpc.GobCodec).Accept(l)
+
+		client, err := vrpc.Dial("tcp", l.Addr().String(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		if i == len(pki.ServerOrder)-1 {
+			last = client
+		}
+		next = client
+	}
+	return next, last
+}
+
+func newDialer(t *testing.T, pkis *PKIStore) *Dialer {
+	public, private, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := &GuiClient{
+		pkis:          pkis,
+		myPublicKey:   public,
+		myPrivateKey:  private,
+		conversations: make(map[string]*Conversation),
+		introductions: make(map[string]*Introduction),
+	}
+	d := &Dialer{gui: gc, pkis: pkis, myPublicKey: public, myPrivateKey: private}
+	d.Init()
+	gc.dialer = d
+	return d
+}
+
+// newDialChain serves a dial chain of three servers.
+func newDialChain(t *testing.T) (pki *PKI, first, last *vrpc.Client) {
+	pki = &PKI{
+		Servers:      make(map[string]*ServerInfo),
+		ServerLevels: map[int][]string{0: {"first"}, 1: {"middle"}, 2: {"last"}},
+		ServerOrder:  []string{"first", "middle", "last"},
+	}
+	keys := make(map[string]*BoxKey)
+	for level, name := range pki.ServerOrder {
+		public, private, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pki.Servers[name] = &ServerInfo{PublicKey: public, Level: level}
+		keys[name] = private
+	}
+	first, last = serveDialChain(t, pki, keys)
+	return pki, first, last
+}
+
+func TestDialIntroduction(t *testing.T) {
+	pki, first, last := newDialChain(t)
+	pkis := StaticPKIStore(pki)
+
+	alice := newDialer(t, pkis)
+	bob := newDialer(t, pkis)
+	carol := newDialer(t, pkis)
+	pki.People = map[string]*BoxKey{"alice": alice.myPublicKey, "bob": bob.myPublicKey}
+	alice.QueueRequest(bob.myPublicKey)
+
+	// What the entry server and the clients do for one dial round.
+	const round = 7
+	const buckets = 3
+	ctx := context.Background()
+	if err := NewDialRound(ctx, first, round, pki.Epoch, pki.ServerOrder, buckets); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	hops := pki.AnnounceRoute(pki.ServerOrder)
+	var onions [][]byte
+	for _, d := range []*Dialer{alice, bob} {
+		r := d.NextDialRequest(round, buckets, pki.Epoch, hops, true)
+		if r == nil {
+			t.Fatalf("NextDialRequest rejected the route")
+		}
+		onions = append(onions, r.Onion)
+	}
+	if err := RunDialRound(ctx, first, round, onions); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+	result := new(DialBucketsResult)
+	if err := last.Call("DialService.Buckets", &DialBucketsArgs{Round: round}, result); err != nil {
+		t.Fatalf("Buckets: %s", err)
+	}
+
+	b := KeyDialBucket(bob.myPublicKey, buckets)
+	intros := bob.openIntros(&DialBucket{Round: round, Intros: result.Buckets[b-1]})
+	if len(intros) != 1 {
+		t.Fatalf("bob got %d introductions, want 1", len(intros))
+	}
+	if intros[0].LongTermKey != *alice.myPublicKey || intros[0].Rendezvous != rendezvousRounds {
+		t.Fatalf("bob got %+v, want alice's key and rendezvous %d", intros[0], rendezvousRounds)
+	}
+	if n := len(alice.openIntros(&DialBucket{Round: round, Intros: result.Buckets[b-1]})); n != 0 {
+		t.Fatalf("alice opened %d introductions meant for bob", n)
+	}
+
+	// With Bloom filters, bob finds the tag he shares with alice and
+	// fetches his bucket; carol, whom nobody dialed, does not.
+	filters := new(DialFiltersResult)
+	if err := last.Call("DialService.Filters", &DialFiltersArgs{Round: round, FalsePositive: 1e-6}, filters); err != nil {
+		t.Fatalf("Filters: %s", err)
+	}
+	filter := &DialFilter{Round: round, Filter: filters.Filters[b-1]}
+	if !bob.MatchDialFilter(filter) {
+		t.Fatalf("bob does not find alice's tag in the filter of his bucket")
+	}
+	if carol.MatchDialFilter(filter) {
+		t.Fatalf("carol finds a tag in bob's bucket")
+	}
+	fetched := new(DialFetchResult)
+	if err := last.Call("DialService.Fetch", &DialFetchArgs{Round: round, Bucket: b}, fetched); err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if n := len(bob.openIntros(&DialBucket{Round: round, Intros: fetched.Intros})); n != 1 {
+		t.Fatalf("bob opened %d intros in his fetched bucket, want 1", n)
+	}
+
+	// Bob accepts, and both talk to each other from the rendezvous.
+	bob.gui.introduced(intros[0])
+	aliceName := "alice"
+	if err := bob.gui.handleLine("/accept " + aliceName); err != nil {
+		t.Fatal(err)
+	}
+	checkConvo(t, "bob", bob.gui.selectedConvo, alice.myPublicKey)
+	checkConvo(t, "alice", alice.gui.selectedConvo, bob.myPublicKey)
+	if bob.gui.takeIntroduction(aliceName) != nil {
+		t.Fatalf("accepted introduction is still pending")
+	}
+}
+
+// TestDialStranger checks that a client in Bloom-filter rounds gets an
+// introduction from someone who is not one of its contacts.
+func TestDialStranger(t *testing.T) {
+	pki, first, last := newDialChain(t)
+	pkis := StaticPKIStore(pki)
+
+	bob := newDialer(t, pkis)
+	stranger := newDialer(t, pkis)
+	pki.People = map[string]*BoxKey{"bob": bob.myPublicKey}
+	stranger.QueueRequest(bob.myPublicKey)
+
+	const round = 3
+	const buckets = 1
+	ctx := context.Background()
+	if err := NewDialRound(ctx, first, round, pki.Epoch, pki.ServerOrder, buckets); err != nil {
+		t.Fatalf("NewDialRound: %s", err)
+	}
+	hops := pki.AnnounceRoute(pki.ServerOrder)
+	var onions [][]byte
+	for _, d := range []*Dialer{stranger, bob} {
+		onions = append(onions, d.NextDialRequest(round, buckets, pki.Epoch, hops, true).Onion)
+	}
+	if err := RunDialRound(ctx, first, round, onions); err != nil {
+		t.Fatalf("RunDialRound: %s", err)
+	}
+	filters := new(DialFiltersResult)
+	if err := last.Call("DialService.Filters", &DialFiltersArgs{Round: round, FalsePositive: 1e-6}, filters); err != nil {
+		t.Fatalf("Filters: %s", err)
+	}
+	filter := &DialFilter{Round: round, Filter: filters.Filters[0]}
+
+	// Bob's contacts' tags are not in the filter, so he only fetches
+	// his bucket in the rounds he fetches it anyway.
+	if bob.MatchDialFilter(filter) {
+		t.Fatalf("bob fetches his bucket with a fetch rate of 0")
+	}
+	bob.fetchRate = 1
+	if !bob.MatchDialFilter(filter) {
+		t.Fatalf("bob does not fetch his bucket with a fetch rate of 1")
+	}
+
+	fetched := new(DialFetchResult)
+	if err := last.Call("DialService.Fetch", &DialFetchArgs{Round: round, Bucket: 1}, fetched); err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	bob.HandleDialBucket(&DialBucket{Round: round, Intros: fetched.Intros})
+	name := stranger.myPublicKey.String()
+	if err := bob.gui.handleLine("/accept " + name); err != nil {
+		t.Fatal(err)
+	}
+	checkConvo(t, "bob", bob.gui.selectedConvo, stranger.myPublicKey)
+}
+
+// TestDialByKey checks that someone the PKI does not list can be dialed
+// and talked to by their public key.
+func TestDialByKey(t *testing.T) {
+	pki := &PKI{People: map[string]*BoxKey{}}
+	d := newDialer(t, StaticPKIStore(pki))
+	peer, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"/dial nobody", "/dial " + peer.String()} {
+		if err := d.gui.handleLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case pk := <-d.userDialRequests:
+		if *pk != *peer {
+			t.Fatalf("dialing %s, want the peer's key", pk)
+		}
+	default:
+		t.Fatalf("the peer's key was not dialed")
+	}
+	if len(d.userDialRequests) != 0 {
+		t.Fatalf("dialed someone who is neither in the PKI nor a key")
+	}
+
+	if err := d.gui.handleLine("/talk " + peer.String()); err != nil {
+		t.Fatal(err)
+	}
+	if convo := d.gui.selectedConvo; convo == nil || *convo.peerPublicKey != *peer {
+		t.Fatalf("not talking to the peer")
+	}
+}
+
+func checkConvo(t *testing.T, who string, convo *Conversation, peer *BoxKey) {
+	t.Helper()
+	if convo == nil || *convo.peerPublicKey != *peer {
+		t.Fatalf("%s is not talking to the other", who)
+	}
+	if convo.startRound != rendezvousRounds {
+		t.Fatalf("%s starts at round %d, want %d", who, convo.startRound, rendezvousRounds)
+	}
+}
+
+func TestConversationWaitsForRendezvous(t *testing.T) {
+	pki := &PKI{
+		Servers:     map[string]*ServerInfo{},
+		ServerOrder: []string{"last"},
+	}
+	public, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.Servers["last"] = &ServerInfo{PublicKey: public}
+	d := newDialer(t, StaticPKIStore(pki))
+	peer, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.gui.startConversation("peer", peer, 5)
+	convo := d.gui.selectedConvo
+	convo.QueueTextMessage([]byte("hello"))
+
+	hops := pki.AnnounceRoute(pki.ServerOrder)
+	convo.NextConvoRequest(4, 0, hops)
+	if len(convo.outQueue) != 1 || !convo.pendingRounds[4].waiting {
+		t.Fatalf("message sent before the rendezvous round")
+	}
+	convo.NextConvoRequest(5, 0, hops)
+	if len(convo.outQueue) != 0 || convo.pendingRounds[5].waiting {
+		t.Fatalf("message not sent at the rendezvous round")
+	}
+}
@@ -18,7 +18,7 @@ import (
 type GuiClient struct {
 	sync.Mutex
 
-	pki          *PKI
+	pkis         *PKIStore
 	myName       string
 	myPublicKey  *BoxKey
 	myPrivateKey *BoxKey
@@ -29,6 +29,9 @@ type GuiClient struct {
 	selectedConvo *Conversation
 	conversations map[string]*Conversation
 	dialer        *Dialer
+	// introductions holds the introductions waiting for /accept or
+	// /reject, by peer name.  It is guarded by the mutex.
+	introductions map[string]*Introduction
 	
 	
 
@@ -78,7 +81,7 @@ func (gc *GuiClient) switchConversation(peer string) {
 
 	convo, ok := gc.conversations[peer]
 	if !ok {
-		peerPublicKey, ok := gc.pki.People[peer]
+		peerPublicKey, ok := gc.lookup(peer)
 		if !ok {
 			// Temporary hack
 			if peer == gc.myName {
@@ -88,16 +91,7 @@ func (gc *GuiClient) switchConversation(peer string) {
 				return	
 			}
 		}
-		convo = &Conversation{
-			route:         gc.pki.ServerOrder,
-			pki:           gc.pki,
-			peerName:      peer,
-			peerPublicKey: peerPublicKey,
-			myPublicKey:   gc.myPublicKey,
-			myPrivateKey:  gc.myPrivateKey,
-			gui:           gc,
-		}
-		convo.Init()
+		convo = gc.newConversation(peer, peerPublicKey, 0)
 		gc.conversations[peer] = convo
 	}
 
@@ -106,6 +100,106 @@ func (gc *GuiClient) switchConversation(peer string) {
 	gc.Warnf("Now talking to %s\n", peer)
 }
 
+func (gc *GuiClient) newConversation(peer string, peerPublicKey *BoxKey, startRound uint32) *Conversation {
+	convo := &Conversation{
+		route:         gc.pkis.Current().ServerOrder,
+		pkis:          gc.pkis,
+		peerName:      peer,
+		peerPublicKey: peerPublicKey,
+		myPublicKey:   gc.myPublicKey,
+		myPrivateKey:  gc.myPrivateKey,
+		gui:           gc,
+		startRound:    startRound,
+	}
+	convo.Init()
+	return convo
+}
+
+// startConversation switches to a new conversation with peer that
+// begins at the rendezvous round, replacing any earlier one with them.
+func (gc *GuiClient) startConversation(peer string, peerPublicKey *BoxKey, rendezvous uint32) {
+	convo := gc.newConversation(peer, peerPublicKey, rendezvous)
+	gc.Lock()
+	gc.conversations[peer] = convo
+	gc.selectedConvo = convo
+	gc.Unlock()
+	gc.activateConvo(convo)
+	gc.Warnf("Now talking to %s (from round %d)\n", peer, rendezvous)
+}
+
+// nameOf returns the name the PKI gives to key, or the key itself for
+// someone the PKI does not list.
+func (gc *GuiClient) nameOf(key *BoxKey) string {
+	for name, k := range gc.pkis.Current().People {
+		if *k == *key {
+			return name
+		}
+	}
+	return key.String()
+}
+
+// lookup returns the key of peer, who is either named in the PKI or
+// given by their public key, the way nameOf names people the PKI does
+// not list.
+func (gc *GuiClient) lookup(peer string) (*BoxKey, bool) {
+	if key, ok := gc.pkis.Current().People[peer]; ok {
+		return key, true
+	}
+	key, err := KeyFromString(peer)
+	return key, err == nil
+}
+
+// contacts returns the keys of the people we may get introductions
+// from in Bloom-filter dial rounds: the PKI's people and whoever we
+// have talked to.
+func (gc *GuiClient) contacts() []*BoxKey {
+	var keys []*BoxKey
+	for _, k := range gc.pkis.Current().People {
+		keys = append(keys, k)
+	}
+	gc.Lock()
+	for _, convo := range gc.conversations {
+		keys = append(keys, convo.peerPublicKey)
+	}
+	gc.Unlock()
+	return keys
+}
+
+// convoRound returns the latest convo round, from which the rendezvous
+// of our introductions is counted.
+func (gc *GuiClient) convoRound() uint32 {
+	if gc.client == nil {
+		return 0
+	}
+	return gc.client.LastConvoRound()
+}
+
+// dialed is called when an introduction to peerPublicKey is sent; we
+// start talking to them at its rendezvous round.
+func (gc *GuiClient) dialed(peerPublicKey *BoxKey, rendezvous uint32) {
+	gc.startConversation(gc.nameOf(peerPublicKey), peerPublicKey, rendezvous)
+}
+
+// introduced keeps an incoming introduction until the user accepts or
+// rejects it.
+func (gc *GuiClient) introduced(intro *Introduction) {
+	name := gc.nameOf(&intro.LongTermKey)
+	gc.Lock()
+	gc.introductions[name] = intro
+	gc.Unlock()
+	gc.Warnf("Received introduction: %s (/accept %s or /reject %s)\n", name, name, name)
+}
+
+// takeIntroduction removes and returns the pending introduction from
+// peer.
+func (gc *GuiClient) takeIntroduction(peer string) *Introduction {
+	gc.Lock()
+	defer gc.Unlock()
+	intro := gc.introductions[peer]
+	delete(gc.introductions, peer)
+	return intro
+}
+
 func (gc *GuiClient) activateConvo(convo *Conversation) {
 	if gc.client != nil {
 		convo.Lock()
@@ -123,11 +217,33 @@ func (gc *GuiClient) handleLine(line string) error {
 	case strings.HasPrefix(line, "/talk "):
 		peer := line[6:]
 		gc.switchConversation(peer)
+	case strings.HasPrefix(line, "/accept "):
+		peer := line[8:]
+		intro := gc.takeIntroduction(peer)
+		if intro == nil {
+			gc.Warnf("No introduction from %s\n", peer)
+			return nil
+		}
+		gc.startConversation(peer, &intro.LongTermKey, intro.Rendezvous)
+	case strings.HasPrefix(line, "/reject "):
+		peer := line[8:]
+		if gc.takeIntroduction(peer) == nil {
+			gc.Warnf("No introduction from %s\n", peer)
+			return nil
+		}
+		gc.Warnf("Rejected introduction: %s\n", peer)
+	case line == "/privacy":
+		if gc.client == nil {
+			gc.Warnf("Not connected\n")
+			return nil
+		}
+		l := gc.client.PrivacyLoss()
+		gc.Warnf("Privacy spent: epsilon=%.3g delta=%.3g over %d convo and %d dial rounds\n", l.Epsilon, l.Delta, l.ConvoRounds, l.DialRounds)
 	case strings.HasPrefix(line, "/dial "):
 		peer := line[6:]
-		pk, ok := gc.pki.People[peer]
+		pk, ok := gc.lookup(peer)
 		if !ok {
-			gc.Warnf("Unknown user: %q (see %s)\n", peer, *pkiPath)
+			gc.Warnf("Unknown user: %q (not in %s, and not a public key)\n", peer, *pkiPath)
 			return nil
 		}
 		gc.Warnf("Dialing user: %s\n", peer)
@@ -267,7 +383,7 @@ func quit(g *gocui.Gui, v *gocui.View) error {
 
 func (gc *GuiClient) Connect() error {
 	if gc.client == nil {
-		gc.client = NewClient(gc.pki.EntryServer, gc.myPublicKey)
+		gc.client = NewClient(gc.pkis.Current().EntryServer, gc.myPublicKey)
 		gc.client.SetDialHandler(gc.dialer)
 	}
 	gc.activateConvo(gc.selectedConvo)
@@ -297,14 +413,16 @@ func (gc *GuiClient) Run() {
 	
 	*/
 	gc.conversations = make(map[string]*Conversation)
+	gc.introductions = make(map[string]*Introduction)
 	gc.switchConversation(gc.myName)
 
 	
 	gc.dialer = &Dialer{
 		gui:          gc,
-		pki:          gc.pki,
+		pkis:         gc.pkis,
 		myPublicKey:  gc.myPublicKey,
 		myPrivateKey: gc.myPrivateKey,
+		fetchRate:    *fetchRate,
 	}
 	gc.dialer.Init()
 
@@ -313,7 +431,7 @@ func (gc *GuiClient) Run() {
 		if err := gc.Connect(); err != nil {
 			gc.Warnf("Failed to connect: %s\n", err)
 		}
-		gc.Warnf("Connected: %s\n", gc.pki.EntryServer)
+		gc.Warnf("Connected: %s\n", gc.pkis.Current().EntryServer)
 	}()
 
 	for {}
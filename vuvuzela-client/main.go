@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
 	"flag"
@@ -15,20 +16,16 @@ import (
 var doInit = flag.Bool("init", false, "create default config file")
 var confPath = flag.String("conf", "../confs/client.conf", "config file")
 var pkiPath = flag.String("pki", "../confs/pki.conf", "pki file")
+var operatorKey = flag.String("operator", "", "base32 key the PKI must be signed with (if empty, signatures are not checked)")
 var name = flag.String("name", "", "client name")
-
-type Conf struct {
-	MyName       string
-	MyPublicKey  *BoxKey
-	MyPrivateKey *BoxKey
-}
+var fetchRate = flag.Float64("fetch", 0.1, "fraction of Bloom filter dial rounds in which to fetch the whole bucket anyway, so that introductions from strangers arrive")
 
 func WriteDefaultConf(path string, name string) {
 	myPublicKey, myPrivateKey, err := GenerateBoxKey(rand.Reader)
 	if err != nil {
 		log.Fatalf("GenerateBoxKey: %s", err)
 	}
-	conf := &Conf{
+	conf := &ClientConf{
 		MyName: name,
 		MyPublicKey:  myPublicKey,
 		MyPrivateKey: myPrivateKey,
@@ -51,16 +48,28 @@ func main() {
 		return
 	}
 
-	pki := ReadPKI(*pkiPath)
+	var operator ed25519.PublicKey
+	if *operatorKey != "" {
+		var err error
+		operator, err = ParseOperatorKey(*operatorKey)
+		if err != nil {
+			log.Fatalf("-operator: %s", err)
+		}
+	}
+	pkis, err := LoadPKIStore(*pkiPath, operator)
+	if err != nil {
+		log.Fatalf("LoadPKIStore: %s", err)
+	}
+	go pkis.Watch(DefaultPKIPollInterval, nil)
 
-	conf := new(Conf)
+	conf := new(ClientConf)
 	ReadJSONFile(*confPath, conf)
 	if conf.MyName == "" || conf.MyPublicKey == nil || conf.MyPrivateKey == nil {
 		log.Fatalf("missing required fields: %s", *confPath)
 	}
 
 	gc := &GuiClient{
-		pki:          pki,
+		pkis:         pkis,
 		myName:       conf.MyName,
 		myPublicKey:  conf.MyPublicKey,
 		myPrivateKey: conf.MyPrivateKey,
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	. "vuvuzela.io/vuvuzela"
+)
+
+// scheduler starts a round every interval, as long as fewer rounds than
+// the pipeline's depth are in flight.  Ticks that pass while the
+// pipeline is full are skipped rather than made up, so a slow round
+// delays the next one instead of causing a burst of rounds after it.
+type scheduler struct {
+	interval time.Duration
+	// retry is how long to wait after a round fails to start.
+	retry    time.Duration
+	pipeline *Pipeline
+
+	// start starts a round that holds a pipeline slot until it calls
+	// release.  If start fails, the slot is released for it.
+	start func(release func()) error
+}
+
+// run starts rounds until ctx is done.  Rounds that are in flight when
+// it returns carry on and release their slots as usual.
+func (s *scheduler) run(ctx context.Context) {
+	for {
+		release, err := s.pipeline.AcquireContext(ctx)
+		if err != nil {
+			return
+		}
+		began := time.Now()
+		wait := s.interval
+		if err := s.start(release); err != nil {
+			release()
+			wait = s.retry
+		}
+
+		timer := time.NewTimer(time.Until(began.Add(wait)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
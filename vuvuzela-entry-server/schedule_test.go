@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "vuvuzela.io/vuvuzela"
+)
+
+// fakeRounds starts rounds for a scheduler and keeps them in flight
+// until the test releases them.
+type fakeRounds struct {
+	fail    bool
+	started chan func()
+}
+
+func (f *fakeRounds) start(release func()) error {
+	if f.fail {
+		f.started <- func() {}
+		return errors.New("round failed to start")
+	}
+	f.started <- release
+	return nil
+}
+
+func runScheduler(t *testing.T, s *scheduler, fail bool) (*fakeRounds, context.CancelFunc, chan struct{}) {
+	f := &fakeRounds{fail: fail, started: make(chan func(), 100)}
+	s.start = f.start
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return f, cancel, done
+}
+
+func (f *fakeRounds) next(t *testing.T) func() {
+	select {
+	case release := <-f.started:
+		return release
+	case <-time.After(5 * time.Second):
+		t.Fatal("no round started")
+		return nil
+	}
+}
+
+func (f *fakeRounds) none(t *testing.T, wait time.Duration) {
+	select {
+	case <-f.started:
+		t.Fatal("a round started")
+	case <-time.After(wait):
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	s := &scheduler{
+		interval: 10 * time.Millisecond,
+		retry:    time.Hour,
+		pipeline: NewPipeline(2),
+	}
+	f, _, _ := runScheduler(t, s, false)
+
+	release0 := f.next(t)
+	release1 := f.next(t)
+	// both slots are taken, so the ticks go by
+	f.none(t, 100*time.Millisecond)
+	if n := s.pipeline.InFlight(); n != 2 {
+		t.Fatalf("%d rounds in flight, want 2", n)
+	}
+
+	release0()
+	release2 := f.next(t)
+	f.none(t, 50*time.Millisecond)
+	release1()
+	release2()
+	f.next(t)
+}
+
+func TestSchedulerSkipsTicks(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	s := &scheduler{
+		interval: interval,
+		retry:    time.Hour,
+		pipeline: NewPipeline(1),
+	}
+	f, _, _ := runScheduler(t, s, false)
+
+	// The round holds the only slot for several intervals.
+	release := f.next(t)
+	time.Sleep(5 * interval)
+	release()
+
+	// The next round starts right away, and the ticks missed in the
+	// meantime are not made up.
+	released := time.Now()
+	f.next(t)()
+	if d := time.Since(released); d > interval {
+		t.Fatalf("round started %s after the slot was free", d)
+	}
+	f.none(t, interval/2)
+	f.next(t)
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	const retry = 200 * time.Millisecond
+	s := &scheduler{
+		interval: time.Millisecond,
+		retry:    retry,
+		pipeline: NewPipeline(1),
+	}
+	f, _, _ := runScheduler(t, s, true)
+
+	f.next(t)
+	f.none(t, retry/2)
+	f.next(t)
+	if n := s.pipeline.InFlight(); n != 0 {
+		t.Fatalf("a round that failed to start holds %d slots", n)
+	}
+}
+
+func TestSchedulerShutdown(t *testing.T) {
+	wait := func(t *testing.T, done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduler did not stop")
+		}
+	}
+
+	t.Run("waiting for a slot", func(t *testing.T) {
+		s := &scheduler{
+			interval: time.Millisecond,
+			retry:    time.Hour,
+			pipeline: NewPipeline(1),
+		}
+		f, cancel, done := runScheduler(t, s, false)
+		release := f.next(t)
+		cancel()
+		wait(t, done)
+
+		// The round in flight still gives back its slot.
+		release()
+		if n := s.pipeline.InFlight(); n != 0 {
+			t.Fatalf("%d slots in flight after the round finished", n)
+		}
+		f.none(t, 20*time.Millisecond)
+	})
+
+	t.Run("waiting for the next tick", func(t *testing.T) {
+		s := &scheduler{
+			interval: time.Hour,
+			retry:    time.Hour,
+			pipeline: NewPipeline(2),
+		}
+		f, cancel, done := runScheduler(t, s, false)
+		f.next(t)
+		cancel()
+		wait(t, done)
+		f.none(t, 20*time.Millisecond)
+	})
+}
@@ -1,42 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"net/rpc"
 	"runtime"
 	"sync"
 	"time"
-	"strings"
-  "math/rand"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/gorilla/websocket"
 
 	"vuvuzela.io/concurrency"
+	vrand "vuvuzela.io/crypto/rand"
 	. "vuvuzela.io/vuvuzela"
 	. "vuvuzela.io/vuvuzela/internal"
 	"vuvuzela.io/vuvuzela/vrpc"
 )
 
 type server struct {
-	currentRoute []string
-	
 	connectionsMu sync.Mutex
 	connections   map[*connection]bool
 
 	convoMu       sync.Mutex
+	// convoRound is the next convo round to start.  It is only used by
+	// the convo scheduler.
 	convoRound    uint32
-	convoRequests []*convoReq
+	// convoOpen holds the onions of the rounds that are collecting
+	// them, by round.  With -interval shorter than -wait, several
+	// rounds collect at once.
+	convoOpen     map[uint32][]*convoReq
 
 	dialMu       sync.Mutex
 	dialRound    uint32
 	dialRequests []*dialReq
-
+	// dialIntros is a moving average of the number of introductions,
+	// noise included, in recent dial rounds.  It sizes the buckets of
+	// the next round.
+	dialIntros   float64
+	// dialFetches holds the recent dial rounds that clients may fetch
+	// their introductions from, with -bloom.  It is guarded by dialMu.
+	dialFetches  map[uint32]*dialFetch
+	dialFetched  []uint32
+
+	// convoPipeline bounds the number of convo rounds in flight.
+	convoPipeline *Pipeline
+
+	// convoRetries collects the re-sealed onions for rounds being
+	// retried, by retry round.  It is guarded by convoMu.
+	convoRetries map[uint32]*convoRetry
+
+	conf        *EntryConf
 	firstServer *vrpc.Client
 	lastServer  *vrpc.Client
+	// lastReplicas connects to the other servers at the last level,
+	// by name, for dial rounds whose route ends at them.
+	lastReplicasMu sync.Mutex
+	lastReplicas   map[string]*vrpc.Client
   middleServerIdx int
-  PKI         *PKI
+	pkis        *PKIStore
+
+	// members tracks which mix servers are up; routes are drawn from
+	// its live levels.
+	members     *MembershipService
+	// routes picks the route of each convo round.
+	routes      RouteSelector
+	// privacy tracks what each user has spent in the rounds they sent
+	// onions to.
+	privacy     *PrivacyAccountant
+}
+
+// dialFetch is where the introductions of a dial round are fetched.
+type dialFetch struct {
+	last    *vrpc.Client
+	buckets uint32
 }
 
 type convoReq struct {
@@ -44,6 +86,18 @@ type convoReq struct {
 	onion []byte
 }
 
+// convoRetry is a failed round waiting for its clients' new onions.
+type convoRetry struct {
+	index   map[*connection]int
+	onions  [][]byte
+	missing int
+	done    chan struct{}
+}
+
+// retryRoundBit marks retry rounds, so that they never collide with
+// regular rounds at the mix servers.
+const retryRoundBit = 1 << 31
+
 type dialReq struct {
 	conn  *connection
 	onion []byte
@@ -135,16 +189,23 @@ func (c *connection) handleRequest(v interface{}) {
 		c.handleConvoRequest(v)
 	case *DialRequest:
 		c.handleDialRequest(v)
+	case *DialFetch:
+		c.handleDialFetch(v)
 	}
 }
 
 func (c *connection) handleConvoRequest(r *ConvoRequest) {
 	srv := c.srv
 	srv.convoMu.Lock()
-	currRound := srv.convoRound
-	if r.Round != currRound {
+	if retry, ok := srv.convoRetries[r.Round]; ok {
+		retry.add(c, r.Onion)
 		srv.convoMu.Unlock()
-		err := fmt.Sprintf("wrong round (currently %d)", currRound)
+		return
+	}
+	requests, ok := srv.convoOpen[r.Round]
+	if !ok {
+		srv.convoMu.Unlock()
+		err := fmt.Sprintf("round %d is not collecting onions", r.Round)
 		go c.Send(&ConvoError{Round: r.Round, Err: err})
 		return
 	}
@@ -152,7 +213,7 @@ func (c *connection) handleConvoRequest(r *ConvoRequest) {
 		conn:  c,
 		onion: r.Onion,
 	}
-	srv.convoRequests = append(srv.convoRequests, rr)
+	srv.convoOpen[r.Round] = append(requests, rr)
 	srv.convoMu.Unlock()
 }
 
@@ -173,65 +234,195 @@ func (c *connection) handleDialRequest(r *DialRequest) {
 	srv.dialRequests = append(srv.dialRequests, rr)
 	srv.dialMu.Unlock()
 }
+// handleDialFetch sends the client its bucket of a round whose filter
+// matched.
+func (c *connection) handleDialFetch(r *DialFetch) {
+	srv := c.srv
+	srv.dialMu.Lock()
+	f := srv.dialFetches[r.Round]
+	srv.dialMu.Unlock()
+	if f == nil {
+		go c.Send(&DialError{Round: r.Round, Err: "round is gone"})
+		return
+	}
+
+	args := &DialFetchArgs{
+		Round:  r.Round,
+		Bucket: KeyDialBucket(c.publicKey, f.buckets),
+	}
+	result := new(DialFetchResult)
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	defer cancel()
+	if err := f.last.CallContext(ctx, "DialService.Fetch", args, result); err != nil {
+		log.WithFields(log.Fields{"service": "dial", "round": r.Round, "call": "Fetch"}).Error(err)
+		go c.Send(&DialError{Round: r.Round, Err: "server error"})
+		return
+	}
+	c.Send(&DialBucket{Round: r.Round, Intros: result.Intros})
+}
+
 // Only Middle Server will add Cover Traffic
 // Entry server won't
-func (srv *server) convoRoundLoop() {
-	for {
-		if err := NewConvoRound(srv.firstServer, srv.convoRound, srv.currentRoute); err != nil {
-			log.WithFields(log.Fields{"service": "convo", "round": srv.convoRound, "call": "NewConvoRound", "currentRoute": srv.currentRoute}).Error(err)
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		log.WithFields(log.Fields{"service": "convo", "round": srv.convoRound}).Info("Broadcast")
-		broadcast(srv.allConnections(), &AnnounceConvoRound{srv.convoRound})
-		time.Sleep(*receiveWait)
+func (srv *server) convoRoundLoop(ctx context.Context) {
+	interval := *roundInterval
+	if interval == 0 {
+		interval = *receiveWait
+	}
+	s := &scheduler{
+		interval: interval,
+		retry:    10 * time.Second,
+		pipeline: srv.convoPipeline,
+		start:    srv.openConvoRound,
+	}
+	s.run(ctx)
+}
+
+// openConvoRound starts the next convo round and announces it.  The
+// scheduler calls it once fewer than -depth rounds are in flight, and
+// the route is picked then so that it reflects failures in earlier
+// rounds.
+func (srv *server) openConvoRound(release func()) error {
+	pki := srv.pkis.Current()
+	round := srv.convoRound
+	route, err := srv.nextRoute(pki)
+	if err != nil {
+		log.WithFields(log.Fields{"service": "convo", "round": round, "call": "nextRoute"}).Error(err)
+		return err
+	}
+
+	err = srv.newConvoRound(pki, round, route)
+	if err != nil {
+		log.WithFields(log.Fields{"service": "convo", "round": round, "call": "NewConvoRound", "route": route}).Error(err)
+		return err
+	}
 
+	srv.convoMu.Lock()
+	srv.convoOpen[round] = make([]*convoReq, 0, 1000)
+	srv.convoMu.Unlock()
+	srv.convoRound += 1
+
+	log.WithFields(log.Fields{"service": "convo", "round": round}).Info("Broadcast")
+	announcement := &AnnounceConvoRound{
+		Round: round,
+		Epoch: pki.Epoch,
+		Route: pki.AnnounceRoute(route),
+	}
+	broadcast(srv.allConnections(), announcement)
+
+	// The round collects onions for -wait and is then mixed, while
+	// later rounds start every -interval.  Each round keeps its own
+	// requests, so replies go back to the connections they came
+	// from.
+	go func() {
+		time.Sleep(*receiveWait)
 		srv.convoMu.Lock()
-		//go srv.runConvoRound(srv.convoRound, srv.convoRequests)
-		// Middle Server failure will happen here
-		srv.runConvoRound(srv.convoRound, srv.convoRequests)
-
-    route := make([]string, 3)
-    for i:=0; i<len(srv.PKI.ServerLevels); i++ {
-      servers := srv.PKI.ServerLevels[i]
-      length := len(servers)
-      if length == 0 {
-        continue
-      } else if length == 1 {
-        //rnd :=rand.Intn(10)  
-        //if rnd < 5 && i == 1 {
-        //  continue
-        //} else {
-          route = append(route, servers[0])
-        //}
-      } else {
-        selectedIdx  := rand.Intn(length)
-        route = append(route, servers[selectedIdx])
-      }
-    }
-    srv.currentRoute = route
-
-		srv.convoRound += 1
-		srv.convoRequests = make([]*convoReq, 0, len(srv.convoRequests))
+		requests := srv.convoOpen[round]
+		delete(srv.convoOpen, round)
 		srv.convoMu.Unlock()
+
+		// Middle Server failure will happen here
+		srv.runConvoRound(round, pki, route, requests)
+		release()
+	}()
+	return nil
+}
+
+// newConvoRound starts round on the first server.  A failed NewRound,
+// such as one that timed out, may still have created the round there,
+// holding one of the server's pipeline slots until it expires.  So the
+// round is deleted, and its number is not used again in case NewRound
+// is still on its way.
+func (srv *server) newConvoRound(pki *PKI, round uint32, route []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	err := NewConvoRound(ctx, srv.firstServer, round, pki.Epoch, route)
+	cancel()
+	if err == nil {
+		return nil
 	}
+	srv.convoRound = round + 1
+	srv.deleteConvoRound(round)
+	return err
+}
+
+// deleteConvoRound deletes a round that failed from the first server, so
+// that the round gives its pipeline slot back now rather than when it
+// expires.
+func (srv *server) deleteConvoRound(round uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	defer cancel()
+	if err := DeleteConvoRound(ctx, srv.firstServer, round); err != nil {
+		log.WithFields(log.Fields{"service": "convo", "round": round, "call": "DeleteConvoRound"}).Error(err)
+	}
+}
+
+// nextRoute picks the route of the next round with the -route selector.
+// Level 0 is pinned: the entry server only has a connection to the first
+// server in ServerOrder, so every route starts there, and its replicas
+// are not used.  The selector picks from the other levels only.
+func (srv *server) nextRoute(pki *PKI) ([]string, error) {
+	pinned, m := pinFirstLevel(pki, srv.members.Current())
+	return srv.routes.SelectRoute(pinned, m)
+}
+
+// pinFirstLevel returns copies of pki and m in which level 0 holds only
+// the first server in ServerOrder, which counts as live.
+func pinFirstLevel(pki *PKI, m *Membership) (*PKI, *Membership) {
+	first := []string{pki.ServerOrder[0]}
+
+	pinned := *pki
+	if len(pki.ServerLevels) > 0 {
+		pinned.ServerLevels = make(map[int][]string, len(pki.ServerLevels))
+		for level, servers := range pki.ServerLevels {
+			pinned.ServerLevels[level] = servers
+		}
+		pinned.ServerLevels[0] = first
+	}
+	if m == nil {
+		return &pinned, nil
+	}
+
+	view := *m
+	view.Levels = make(map[int][]string, len(m.Levels))
+	for level, servers := range m.Levels {
+		view.Levels[level] = servers
+	}
+	view.Levels[0] = first
+	return &pinned, &view
 }
 
 func (srv *server) dialRoundLoop() {
 	for {
 		time.Sleep(DialWait)
-		if err := NewDialRound(srv.firstServer, srv.dialRound); err != nil {
-			log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound, "call": "NewDialRound"}).Error(err)
+		pki := srv.pkis.Current()
+		route, err := srv.nextRoute(pki)
+		if err != nil {
+			log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound, "call": "nextRoute"}).Error(err)
+			continue
+		}
+		srv.dialMu.Lock()
+		intros := srv.dialIntros
+		srv.dialMu.Unlock()
+		buckets := DialBuckets(len(srv.allConnections()), intros)
+		round := srv.dialRound
+		err = srv.newDialRound(pki, round, route, buckets)
+		if err != nil {
+			log.WithFields(log.Fields{"service": "dial", "round": round, "call": "NewDialRound", "route": route, "buckets": buckets}).Error(err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
-		log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound}).Info("Broadcast")
-
-		broadcast(srv.allConnections(), &AnnounceDialRound{srv.dialRound, TotalDialBuckets})
+		log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound, "buckets": buckets}).Info("Broadcast")
+
+		broadcast(srv.allConnections(), &AnnounceDialRound{
+			Round:   srv.dialRound,
+			Buckets: buckets,
+			Epoch:   pki.Epoch,
+			Route:   pki.AnnounceRoute(route),
+			Bloom:   *bloomRate > 0,
+		})
 		time.Sleep(*receiveWait)
 
 		srv.dialMu.Lock()
-		go srv.runDialRound(srv.dialRound, srv.dialRequests)
+		go srv.runDialRound(srv.dialRound, pki, route, buckets, srv.dialRequests)
 
 		srv.dialRound += 1
 		srv.dialRequests = make([]*dialReq, 0, len(srv.dialRequests))
@@ -239,51 +430,58 @@ func (srv *server) dialRoundLoop() {
 	}
 }
 
-func (srv *server) runConvoRound(round uint32, requests []*convoReq) {
+// newDialRound starts a dial round on the first server, and cleans up
+// after a failed NewRound the way newConvoRound does.
+func (srv *server) newDialRound(pki *PKI, round uint32, route []string, buckets uint32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	err := NewDialRound(ctx, srv.firstServer, round, pki.Epoch, route, buckets)
+	cancel()
+	if err == nil {
+		return nil
+	}
+	srv.dialMu.Lock()
+	srv.dialRound = round + 1
+	srv.dialMu.Unlock()
+	srv.deleteDialRound(round)
+	return err
+}
+
+// deleteDialRound deletes a round from the first server and every server
+// after it that has the round.  The last server retires it instead.
+func (srv *server) deleteDialRound(round uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	defer cancel()
+	if err := DeleteDialRound(ctx, srv.firstServer, round); err != nil {
+		log.WithFields(log.Fields{"service": "dial", "round": round, "call": "DeleteDialRound"}).Error(err)
+	}
+}
+
+func (srv *server) runConvoRound(round uint32, pki *PKI, route []string, requests []*convoReq) {
 	conns := make([]*connection, len(requests))
 	onions := make([][]byte, len(requests))
 	for i, r := range requests {
 		conns[i] = r.conn
 		onions[i] = r.onion
 	}
+	srv.privacy.AddConvoRound(publicKeys(conns))
 
 	rlog := log.WithFields(log.Fields{"service": "convo", "round": round})
 	rlog.WithFields(log.Fields{"call": "RunConvoRound", "onions": len(onions)}).Info()
 
-	replies, err := RunConvoRound(srv.firstServer, round, onions)
-	// If here fails, currentRoute needs to be updated
+	replies, err := srv.mixConvoRound(round, onions)
 	if err != nil {
-		// TODO: Deal with possible middle server failure here
-		// inform client of the server chain update
 		rlog.WithFields(log.Fields{"call": "RunConvoRound"}).Error(err)
-		// Update current Route
-		// E.g. "Close: NewConvoround: local-middle0" --> "local-middle0"
-		errorStrings := strings.Split(err.Error(), ":")
-		failedServerName := strings.Trim(
-			errorStrings[len(errorStrings)-1],
-			" ")
-		broadcast(conns, &ConvoError{Round: round, Err: failedServerName})
-		// TODO: May need lock
-		//for i, s := range srv.currentRoute {
-		//	if s == failedServerName {
-		//		// remove failedservername from currentRoute
-		//		srv.currentRoute = append(
-		//			srv.currentRoute[:i],
-		//			srv.currentRoute[i+1:]...)
-    //  }
-		//}
-    // remove failed servername from ServerLevels list
-    //srv.convoMu.Lock()
-    failedServerLevel := srv.PKI.Servers[failedServerName].Level
-    servers := srv.PKI.ServerLevels[failedServerLevel]
-    for i, s := range servers {
-      if s == failedServerName {
-         servers = append(servers[:i], servers[i+1:]...)
-      }
-    }
-    srv.PKI.ServerLevels[failedServerLevel] = servers
-    //srv.convoMu.Unlock()
-		return
+		srv.deleteConvoRound(round)
+		// firstServer is always connected to the first server in ServerOrder
+		hop := BlameHop(pki, pki.ServerOrder[0], round, err)
+		srv.dropServer(hop)
+
+		conns, replies, err = srv.retryConvoRound(round, pki, route, conns, hop)
+		if err != nil {
+			rlog.WithFields(log.Fields{"call": "retryConvoRound"}).Error(err)
+			broadcast(conns, &ConvoError{Round: round, Err: hop.Error(), Hop: hop})
+			return
+		}
 	}
 
 	rlog.WithFields(log.Fields{"replies": len(replies)}).Info("Success")
@@ -300,51 +498,250 @@ func (srv *server) runConvoRound(round uint32, requests []*convoReq) {
 	})
 }
 
-func (srv *server) runDialRound(round uint32, requests []*dialReq) {
+// mixConvoRound sends a round that has been started with NewConvoRound
+// through the mix servers.
+func (srv *server) mixConvoRound(round uint32, onions [][]byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	defer cancel()
+	if *streaming {
+		return RunConvoRoundStream(ctx, srv.firstServer, round, onions)
+	}
+	return RunConvoRound(ctx, srv.firstServer, round, onions)
+}
+
+// dropServer evicts a server that is down, so that later routes go
+// around it until it registers again.
+func (srv *server) dropServer(hop *HopError) {
+	if !hop.Retryable || hop.Level < 0 {
+		return
+	}
+	srv.members.Evict(hop.Server, hop.Error())
+}
+
+// retryConvoRound runs a failed round again on a route around the failed
+// server.  The clients re-seal the exchanges they sent for the new route,
+// so their messages are delivered without them noticing.  It returns the
+// connections that took part in the retry along with their replies.
+func (srv *server) retryConvoRound(round uint32, pki *PKI, route []string, conns []*connection, hop *HopError) ([]*connection, [][]byte, error) {
+	if !*retry || !hop.Retryable {
+		return conns, nil, hop
+	}
+	if hop.Level == 0 {
+		// the entry server only talks to the first server
+		return conns, nil, hop
+	}
+	newRoute, err := pki.RepairRoute(route, hop.Server, srv.members.Current().Levels)
+	if err != nil {
+		return conns, nil, hop
+	}
+	// The retry is a round of its own: every server draws fresh noise for
+	// it, and the clients seal their messages for it again.
+	retryRound := round | retryRoundBit
+	rlog := log.WithFields(log.Fields{"service": "convo", "round": round, "retryRound": retryRound, "route": newRoute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	err = NewConvoRound(ctx, srv.firstServer, retryRound, pki.Epoch, newRoute)
+	cancel()
+	if err != nil {
+		srv.deleteConvoRound(retryRound)
+		return conns, nil, fmt.Errorf("NewConvoRound: %w", err)
+	}
+
+	retry := &convoRetry{
+		index:   make(map[*connection]int, len(conns)),
+		onions:  make([][]byte, len(conns)),
+		missing: len(conns),
+		done:    make(chan struct{}),
+	}
+	for i, c := range conns {
+		retry.index[c] = i
+	}
+	srv.convoMu.Lock()
+	srv.convoRetries[retryRound] = retry
+	srv.convoMu.Unlock()
+
+	rlog.Info("Broadcast retry")
+	broadcast(conns, &AnnounceConvoRetry{Round: round, RetryRound: retryRound, Epoch: pki.Epoch, Route: pki.AnnounceRoute(newRoute)})
+	select {
+	case <-retry.done:
+	case <-time.After(*receiveWait):
+	}
+
+	srv.convoMu.Lock()
+	delete(srv.convoRetries, retryRound)
+	srv.convoMu.Unlock()
+
+	// Clients that did not answer in time are left out of the retry.
+	var retryConns []*connection
+	var onions [][]byte
+	for i, onion := range retry.onions {
+		if onion != nil {
+			retryConns = append(retryConns, conns[i])
+			onions = append(onions, onion)
+		}
+	}
+	// Each server adds noise for the retry round on its own, and the
+	// retry's onions are new, so it costs its clients another round.
+	srv.privacy.AddConvoRound(publicKeys(retryConns))
+	rlog.WithFields(log.Fields{"call": "RunConvoRound", "onions": len(onions)}).Info()
+
+	replies, err := srv.mixConvoRound(retryRound, onions)
+	if err != nil {
+		srv.deleteConvoRound(retryRound)
+		return conns, nil, err
+	}
+	return retryConns, replies, nil
+}
+
+// add takes a client's onion for the retry.  It is called with convoMu
+// held.
+func (retry *convoRetry) add(c *connection, onion []byte) {
+	i, ok := retry.index[c]
+	if !ok || retry.onions[i] != nil {
+		return
+	}
+	retry.onions[i] = onion
+	retry.missing--
+	if retry.missing == 0 {
+		close(retry.done)
+	}
+}
+
+func (srv *server) runDialRound(round uint32, pki *PKI, route []string, buckets uint32, requests []*dialReq) {
 	conns := make([]*connection, len(requests))
 	onions := make([][]byte, len(requests))
 	for i, r := range requests {
 		conns[i] = r.conn
 		onions[i] = r.onion
 	}
+	srv.privacy.AddDialRound(publicKeys(conns))
 
 	rlog := log.WithFields(log.Fields{"service": "dial", "round": round})
 	rlog.WithFields(log.Fields{"call": "RunDialRound", "onions": len(onions)}).Info()
+	// Whether or not the round succeeds, it is deleted once the clients
+	// have what they can get from it.
+	defer srv.deleteDialRound(round)
 
-	if err := RunDialRound(srv.firstServer, round, onions); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), *roundTimeout)
+	defer cancel()
+	if err := RunDialRound(ctx, srv.firstServer, round, onions); err != nil {
 		rlog.WithFields(log.Fields{"call": "RunDialRound"}).Error(err)
 		broadcast(conns, &DialError{Round: round, Err: "server error"})
 		return
 	}
 
-	args := &DialBucketsArgs{Round: round}
-	result := new(DialBucketsResult)
-	if err := srv.lastServer.Call("DialService.Buckets", args, result); err != nil {
-		rlog.WithFields(log.Fields{"call": "Buckets"}).Error(err)
+	last, err := srv.lastServerOf(pki, route)
+	if err != nil {
+		rlog.WithFields(log.Fields{"call": "lastServerOf"}).Error(err)
+		broadcast(conns, &DialError{Round: round, Err: "server error"})
+		return
+	}
+	var messages func(bi uint32) interface{}
+	var sizes []int
+	if *bloomRate > 0 {
+		args := &DialFiltersArgs{Round: round, FalsePositive: *bloomRate}
+		result := new(DialFiltersResult)
+		if err := last.CallContext(ctx, "DialService.Filters", args, result); err != nil {
+			rlog.WithFields(log.Fields{"call": "Filters"}).Error(err)
+			broadcast(conns, &DialError{Round: round, Err: "server error"})
+			return
+		}
+		sizes = result.Sizes
+		messages = func(bi uint32) interface{} {
+			return &DialFilter{Round: round, Filter: result.Filters[bi-1]}
+		}
+		srv.addDialFetch(round, &dialFetch{last: last, buckets: buckets})
+	} else {
+		args := &DialBucketsArgs{Round: round}
+		result := new(DialBucketsResult)
+		if err := last.CallContext(ctx, "DialService.Buckets", args, result); err != nil {
+			rlog.WithFields(log.Fields{"call": "Buckets"}).Error(err)
+			broadcast(conns, &DialError{Round: round, Err: "server error"})
+			return
+		}
+		for _, b := range result.Buckets {
+			sizes = append(sizes, len(b))
+		}
+		messages = func(bi uint32) interface{} {
+			return &DialBucket{Round: round, Intros: result.Buckets[bi-1]}
+		}
+	}
+	if len(sizes) != int(buckets) {
+		rlog.WithFields(log.Fields{"call": "Buckets"}).Errorf("got %d buckets, want %d", len(sizes), buckets)
 		broadcast(conns, &DialError{Round: round, Err: "server error"})
 		return
 	}
 
 	intros := 0
-	for _, b := range result.Buckets {
-		intros += len(b)
+	for _, n := range sizes {
+		intros += n
 	}
-	rlog.WithFields(log.Fields{"buckets": len(result.Buckets), "intros": intros}).Info("Buckets")
+	rlog.WithFields(log.Fields{"buckets": len(sizes), "intros": intros}).Info("Buckets")
+	srv.dialMu.Lock()
+	srv.dialIntros = (srv.dialIntros + float64(intros)) / 2
+	srv.dialMu.Unlock()
 
 	concurrency.ParallelFor(len(conns), func(p *concurrency.P) {
 		for i, ok := p.Next(); ok; i, ok = p.Next() {
 			c := conns[i]
-			bi := KeyDialBucket(c.publicKey, TotalDialBuckets)
-
-			db := &DialBucket{
-				Round:  round,
-				Intros: result.Buckets[bi-1],
-			}
-			c.Send(db)
+			bi := KeyDialBucket(c.publicKey, buckets)
+			c.Send(messages(bi))
+			loss := srv.privacy.Loss(c.publicKey)
+			c.Send(&loss)
 		}
 	})
 }
 
+func publicKeys(conns []*connection) []*BoxKey {
+	keys := make([]*BoxKey, len(conns))
+	for i, c := range conns {
+		keys[i] = c.publicKey
+	}
+	return keys
+}
+
+// servePrivacy serves what each user has spent, as JSON, for operators.
+func (srv *server) servePrivacy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(srv.privacy.Losses()); err != nil {
+		log.WithFields(log.Fields{"service": "privacy"}).Error(err)
+	}
+}
+
+// addDialFetch lets clients fetch from round, and forgets rounds that
+// the last server no longer keeps.
+func (srv *server) addDialFetch(round uint32, f *dialFetch) {
+	srv.dialMu.Lock()
+	defer srv.dialMu.Unlock()
+	srv.dialFetches[round] = f
+	srv.dialFetched = append(srv.dialFetched, round)
+	for len(srv.dialFetched) > *dialRetain {
+		delete(srv.dialFetches, srv.dialFetched[0])
+		srv.dialFetched = srv.dialFetched[1:]
+	}
+}
+
+// lastServerOf returns a connection to the last server of route, which
+// holds the dial round's buckets.  Servers other than the last one in
+// ServerOrder are dialed the first time a route ends at them.
+func (srv *server) lastServerOf(pki *PKI, route []string) (*vrpc.Client, error) {
+	name := route[len(route)-1]
+	if name == pki.ServerOrder[len(pki.ServerOrder)-1] {
+		return srv.lastServer, nil
+	}
+	srv.lastReplicasMu.Lock()
+	defer srv.lastReplicasMu.Unlock()
+	if client := srv.lastReplicas[name]; client != nil {
+		return client, nil
+	}
+	client, err := dialServer(pki, srv.conf, name, 1)
+	if err != nil {
+		return nil, err
+	}
+	srv.lastReplicas[name] = client
+	return client, nil
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -374,48 +771,218 @@ func (srv *server) wsHandler(w http.ResponseWriter, r *http.Request) {
 		publicKey: pk,
 	}
 	srv.register(c)
+	c.Send(srv.members.Current())
 	c.readLoop()
 }
 
 var addr = flag.String("addr", ":8080", "http service address")
 // TODO: Why ../ is not needed?
 var pkiPath = flag.String("pki", "../confs/pki.conf", "pki file")
+var operatorKey = flag.String("operator", "", "base32 key the PKI must be signed with (if empty, signatures are not checked)")
 var receiveWait = flag.Duration("wait", DefaultReceiveWait, "")
+var roundTimeout = flag.Duration("timeout", DefaultRoundTimeout, "give up on a round after this long")
+var secure = flag.Bool("secure", false, "authenticate and encrypt connections to the mix servers")
+var confPath = flag.String("conf", "../confs/entry.conf", "config file with the entry server's keys (used with -secure)")
+var codecName = flag.String("codec", "gob", "encoding for RPCs between servers (gob or binary)")
+var streaming = flag.Bool("stream", false, "stream convo rounds to the first server instead of using batched RPCs")
+var retry = flag.Bool("retry", true, "rerun a convo round around a failed middle server")
+var membershipListen = flag.String("membership", "", "address to run the membership service on (default: the port of the PKI's MembershipServer)")
+var heartbeatTimeout = flag.Duration("heartbeat-timeout", DefaultHeartbeatTimeout, "evict mix servers that have not sent a heartbeat for this long")
+var routeName = flag.String("route", "healthy", "how to pick the server at each level of a route (fixed, random, weighted or healthy)")
+var pipelineDepth = flag.Int("depth", 1, "number of convo rounds in flight at once (should not exceed the mix servers' -depth)")
+var bloomRate = flag.Float64("bloom", 0, "send clients a Bloom filter of their dial bucket with this false-positive rate, and the introductions only when it matches (0 sends whole buckets)")
+var convoMu = flag.Float64("convo-mu", DefaultConvoMu, "ConvoMu of the mix servers, for privacy accounting")
+var convoB = flag.Float64("convo-b", DefaultConvoB, "ConvoB of the mix servers, for privacy accounting")
+var dialMu = flag.Float64("dial-mu", DefaultDialMu, "DialMu of the mix servers, for privacy accounting")
+var dialB = flag.Float64("dial-b", DefaultDialB, "DialB of the mix servers, for privacy accounting")
+var debugAddr = flag.String("debug", "", "address to serve each user's privacy loss on, at /privacy (empty disables)")
+var dialRetain = flag.Int("retain", DefaultDialRetainRounds, "number of recent dial rounds clients may fetch their buckets from (must not exceed the last server's -retain)")
+var roundInterval = flag.Duration("interval", 0, "time between the starts of convo rounds (default: -wait, so one round collects onions at a time)")
+
+// wireCodec is parsed from -codec.
+var wireCodec vrpc.Codec
+
+// serveMembership runs the membership service for the mix servers.
+// With -secure, only servers in the PKI may connect, and each may only
+// register and send heartbeats as itself.
+func serveMembership(members *MembershipService, pkis *PKIStore, conf *EntryConf, address string) {
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Listen:", err)
+	}
+	if *secure {
+		listen = vrpc.SecureListener(listen, conf.PublicKey.Key(), conf.PrivateKey.Key(), func(peer *[32]byte) bool {
+			for _, info := range pkis.Current().Servers {
+				if *info.PublicKey.Key() == *peer {
+					return true
+				}
+			}
+			log.WithFields(log.Fields{"service": "membership", "peer": (*BoxKey)(peer).String()}).Warn("rejected connection")
+			return false
+		})
+	}
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			log.Fatal("Accept:", err)
+		}
+		go serveMember(members, conn)
+	}
+}
+
+// serveMember serves the membership service on one connection, bound to
+// the key the peer authenticated with.
+func serveMember(members *MembershipService, conn net.Conn) {
+	mc := &MembershipConn{Service: members}
+	if *secure {
+		peer, err := vrpc.PeerKey(conn)
+		if err != nil {
+			log.WithFields(log.Fields{"service": "membership", "call": "PeerKey"}).Warn(err)
+			conn.Close()
+			return
+		}
+		mc.PeerKey = (*BoxKey)(peer)
+	}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("MembershipService", mc); err != nil {
+		log.Fatalf("rpc.Register: %s", err)
+	}
+	if err := rpcServer.Register(new(vrpc.Health)); err != nil {
+		log.Fatalf("rpc.Register: %s", err)
+	}
+	vrpc.NewServer(rpcServer, wireCodec).ServeConn(conn)
+}
+
+// dialServer connects to a mix server.  With -secure, the server must
+// prove it holds the key the PKI lists for it, and the entry server
+// identifies itself with the keys in conf.
+func dialServer(pki *PKI, conf *EntryConf, name string, connections int) (*vrpc.Client, error) {
+	info := pki.Servers[name]
+	dialer := &vrpc.Dialer{
+		Connections: connections,
+		Codec:       wireCodec,
+	}
+	if *secure {
+		dialer.Transport = &vrpc.SecureTransport{
+			PublicKey:  conf.PublicKey.Key(),
+			PrivateKey: conf.PrivateKey.Key(),
+			PeerKey:    info.PublicKey.Key(),
+		}
+	}
+	return dialer.Dial("tcp", info.Address)
+}
 
 func main() {
 	flag.Parse()
 	log.SetFormatter(&ServerFormatter{})
 
-	pki := ReadPKI(*pkiPath)
+	var err error
+	wireCodec, err = vrpc.ParseCodec(*codecName)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	routes, err := ParseRouteSelector(*routeName)
+	if err != nil {
+		log.Fatalf("-route: %s", err)
+	}
+	if *bloomRate < 0 || *bloomRate >= 1 {
+		log.Fatalf("-bloom: false-positive rate must be between 0 and 1")
+	}
+	if *dialRetain < 1 {
+		log.Fatalf("-retain: must keep at least one dial round")
+	}
 
-	firstServer, err := vrpc.Dial("tcp", pki.FirstServer(pki.ServerOrder), runtime.NumCPU())
+	var operator ed25519.PublicKey
+	if *operatorKey != "" {
+		operator, err = ParseOperatorKey(*operatorKey)
+		if err != nil {
+			log.Fatalf("-operator: %s", err)
+		}
+	}
+	pkis, err := LoadPKIStore(*pkiPath, operator)
+	if err != nil {
+		log.Fatalf("LoadPKIStore: %s", err)
+	}
+	pki := pkis.Current()
+
+	conf := new(EntryConf)
+	if *secure {
+		ReadJSONFile(*confPath, conf)
+		if conf.PublicKey == nil || conf.PrivateKey == nil {
+			log.Fatalf("missing required fields: %s", *confPath)
+		}
+	}
+
+	firstServer, err := dialServer(pki, conf, pki.ServerOrder[0], runtime.NumCPU())
 	if err != nil {
 		log.Fatalf("vrpc.Dial: %s", err)
 	}
 
-	lastServer, err := vrpc.Dial("tcp", pki.LastServer(pki.ServerOrder), 1)
+	lastServer, err := dialServer(pki, conf, pki.ServerOrder[len(pki.ServerOrder)-1], 1)
 	if err != nil {
 		log.Fatalf("vrpc.Dial: %s", err)
 	}
 
 	srv := &server{
-		currentRoute:  pki.ServerOrder,
+		convoPipeline: NewPipeline(*pipelineDepth),
+		convoRetries:  make(map[uint32]*convoRetry),
+		conf:          conf,
 		firstServer:   firstServer,
 		lastServer:    lastServer,
+		lastReplicas:  make(map[string]*vrpc.Client),
     middleServerIdx: 0,
-    PKI:            pki,
+    pkis:           pkis,
+		routes:        routes,
 		connections:   make(map[*connection]bool),
 		convoRound:    0,
-		convoRequests: make([]*convoReq, 0, 10000),
+		convoOpen:     make(map[uint32][]*convoReq),
 		dialRound:     0,
 		dialRequests:  make([]*dialReq, 0, 10000),
+		dialFetches:   make(map[uint32]*dialFetch),
+		privacy: &PrivacyAccountant{
+			Convo:      ConvoPrivacy(vrand.Laplace{Mu: *convoMu, B: *convoB}),
+			Dial:       DialPrivacy(vrand.Laplace{Mu: *dialMu, B: *dialB}),
+			DeltaSlack: DefaultDeltaSlack,
+		},
 	}
+	InitPrivacyAccountant(srv.privacy)
+
+	srv.members = &MembershipService{
+		PKIStore:         pkis,
+		HeartbeatTimeout: *heartbeatTimeout,
+		OnChange: func(m *Membership) {
+			log.WithFields(log.Fields{"service": "membership", "epoch": m.Epoch, "levels": m.Levels}).Info("Broadcast")
+			broadcast(srv.allConnections(), m)
+		},
+	}
+	InitMembershipService(srv.members)
+	go pkis.Watch(DefaultPKIPollInterval, srv.members.SetPKI)
 
-	go srv.convoRoundLoop()
-	//go srv.dialRoundLoop()
+	membershipAddr := *membershipListen
+	if membershipAddr == "" && pki.MembershipServer != "" {
+		_, port, err := net.SplitHostPort(pki.MembershipServer)
+		if err != nil {
+			log.Fatalf("MembershipServer: %s", err)
+		}
+		membershipAddr = ":" + port
+	}
+	if membershipAddr != "" {
+		go serveMembership(srv.members, pkis, conf, membershipAddr)
+	}
+
+	go srv.convoRoundLoop(context.Background())
+	go srv.dialRoundLoop()
 
 	http.HandleFunc("/ws", srv.wsHandler)
 
+	if *debugAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/privacy", srv.servePrivacy)
+		go func() {
+			log.Println(http.ListenAndServe(*debugAddr, mux))
+		}()
+	}
+
 	httpServer := &http.Server{
 		Addr: *addr,
 	}
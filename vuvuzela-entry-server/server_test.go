@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"vuvuzela.io/crypto/onionbox"
+	"vuvuzela.io/crypto/rand"
+	. "vuvuzela.io/vuvuzela"
+	"vuvuzela.io/vuvuzela/vrpc"
+)
+
+// mixServer is a convo server running in-process that a test can take
+// down and bring back up at the same address.
+type mixServer struct {
+	t       *testing.T
+	service *ConvoService
+	address string
+
+	mu     sync.Mutex
+	listen net.Listener
+	conns  []net.Conn
+}
+
+func (m *mixServer) Accept() (net.Conn, error) {
+	m.mu.Lock()
+	l := m.listen
+	m.mu.Unlock()
+	conn, err := l.Accept()
+	if err == nil {
+		m.mu.Lock()
+		m.conns = append(m.conns, conn)
+		m.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (m *mixServer) Close() error   { return m.listen.Close() }
+func (m *mixServer) Addr() net.Addr { return m.listen.Addr() }
+
+func (m *mixServer) start() {
+	address := m.address
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.t.Cleanup(func() { l.Close() })
+	m.mu.Lock()
+	m.listen = l
+	m.conns = nil
+	m.mu.Unlock()
+	m.address = l.Addr().String()
+}
+
+func (m *mixServer) serve() {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(m.service); err != nil {
+		m.t.Fatal(err)
+	}
+	go vrpc.NewServer(rpcServer, vrpc.GobCodec).Accept(m)
+}
+
+// kill stops accepting connections and hangs up on the open ones.
+func (m *mixServer) kill() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listen.Close()
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// restart brings a killed server back up.  The servers dial the next
+// server when a round first goes to it, so they find it right away.
+func (m *mixServer) restart() {
+	m.start()
+	m.serve()
+}
+
+// newMixServers starts a convo server for every name in levels.  The
+// servers at a level are replicas with the same key.
+func newMixServers(t *testing.T, levels [][]string) (*PKI, map[string]*mixServer) {
+	pki := &PKI{
+		Servers:      make(map[string]*ServerInfo),
+		ServerLevels: make(map[int][]string),
+	}
+	servers := make(map[string]*mixServer)
+	for level, names := range levels {
+		pki.ServerLevels[level] = names
+		pki.ServerOrder = append(pki.ServerOrder, names[0])
+		public, private, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			m := &mixServer{t: t}
+			m.start()
+			m.service = &ConvoService{
+				Pipeline:   NewPipeline(1),
+				PKI:        pki,
+				ServerName: name,
+				PrivateKey: private,
+				LastServer: level == len(levels)-1,
+				Dial: func(address string) (*vrpc.Client, error) {
+					return vrpc.Dial("tcp", address, 1)
+				},
+			}
+			if !m.service.LastServer {
+				m.service.Laplace = rand.Laplace{Mu: 10, B: 1}
+			}
+			servers[name] = m
+			pki.Servers[name] = &ServerInfo{
+				Address:   m.address,
+				PublicKey: public,
+				Level:     level,
+			}
+		}
+	}
+	for _, m := range servers {
+		InitConvoService(m.service)
+		m.serve()
+	}
+	return pki, servers
+}
+
+// newEntryServer returns an entry server for pki and the URL clients
+// connect to it on.
+func newEntryServer(t *testing.T, pki *PKI, onChange func(*Membership)) (*server, string) {
+	first, err := vrpc.Dial("tcp", pki.Servers[pki.ServerOrder[0]].Address, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+
+	srv := &server{
+		pkis:         StaticPKIStore(pki),
+		firstServer:  first,
+		connections:  make(map[*connection]bool),
+		convoRetries: make(map[uint32]*convoRetry),
+		privacy:      new(PrivacyAccountant),
+	}
+	InitPrivacyAccountant(srv.privacy)
+	srv.members = &MembershipService{
+		PKIStore: srv.pkis,
+		OnChange: onChange,
+	}
+	InitMembershipService(srv.members)
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.wsHandler))
+	t.Cleanup(ts.Close)
+	return srv, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// testClient sends one exchange, and seals it again when the entry
+// server retries the round.
+type testClient struct {
+	pki        *PKI
+	ws         *websocket.Conn
+	publicKey  *BoxKey
+	exchange   *ConvoExchange
+	sharedKeys []*[32]byte
+	onionRound uint32
+	replies    chan interface{}
+}
+
+func connectClient(t *testing.T, pki *PKI, url string) *testClient {
+	public, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?publickey="+public.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	c := &testClient{
+		pki:       pki,
+		ws:        ws,
+		publicKey: public,
+		exchange:  new(ConvoExchange),
+		replies:   make(chan interface{}, 1),
+	}
+	rand.Read(c.exchange.DeadDrop[:])
+	rand.Read(c.exchange.EncryptedMessage[:])
+	go c.readLoop()
+	return c
+}
+
+func (c *testClient) seal(round uint32, route []string) []byte {
+	onion, sharedKeys := onionbox.Seal(c.exchange.Marshal(), ForwardNonce(round), c.pki.ServerKeys(route).Keys())
+	c.sharedKeys = sharedKeys
+	c.onionRound = round
+	return onion
+}
+
+func (c *testClient) readLoop() {
+	for {
+		var e Envelope
+		if err := c.ws.ReadJSON(&e); err != nil {
+			return
+		}
+		v, err := e.Open()
+		if err != nil {
+			continue
+		}
+		switch v := v.(type) {
+		case *AnnounceConvoRetry:
+			route, err := c.pki.VerifyRoute(v.Route)
+			if err != nil {
+				c.replies <- err
+				return
+			}
+			r, _ := Envelop(&ConvoRequest{Round: v.RetryRound, Onion: c.seal(v.RetryRound, route)})
+			c.ws.WriteJSON(r)
+		case *ConvoResponse, *ConvoError:
+			c.replies <- v
+		}
+	}
+}
+
+// startConvoRound connects n clients, starts round on route, and returns
+// the clients with their requests, sealed for route.
+func startConvoRound(t *testing.T, srv *server, url string, round uint32, route []string, n int) ([]*testClient, []*convoReq) {
+	pki := srv.pkis.Current()
+	clients := make(map[BoxKey]*testClient)
+	for i := 0; i < n; i++ {
+		c := connectClient(t, pki, url)
+		clients[*c.publicKey] = c
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.allConnections()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients connected, want %d", len(srv.allConnections()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := NewConvoRound(context.Background(), srv.firstServer, round, pki.Epoch, route); err != nil {
+		t.Fatalf("NewConvoRound: %s", err)
+	}
+	var list []*testClient
+	var requests []*convoReq
+	for _, conn := range srv.allConnections() {
+		c := clients[*conn.publicKey]
+		list = append(list, c)
+		requests = append(requests, &convoReq{conn: conn, onion: c.seal(round, route)})
+	}
+	return list, requests
+}
+
+func (c *testClient) reply(t *testing.T) interface{} {
+	select {
+	case v := <-c.replies:
+		return v
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reply from the entry server")
+		return nil
+	}
+}
+
+// TestRetryConvoRound fails the middle level of a round, and checks that
+// the entry server runs the round again through the replica that comes
+// back, with the clients' re-sealed onions.
+func TestRetryConvoRound(t *testing.T) {
+	levels := [][]string{{"first"}, {"middle0", "middle1"}, {"last"}}
+	pki, servers := newMixServers(t, levels)
+
+	var down bool
+	var back string
+	srv, url := newEntryServer(t, pki, func(m *Membership) {
+		if !down {
+			return
+		}
+		// The evicted server stays down and the other one comes back
+		// before the retry.
+		for _, s := range m.Levels[1] {
+			if back == "" {
+				back = s
+				servers[s].restart()
+			}
+		}
+	})
+
+	const round = 1
+	route := []string{"first", "middle0", "last"}
+	clients, requests := startConvoRound(t, srv, url, round, route, 3)
+	down = true
+	servers["middle0"].kill()
+	servers["middle1"].kill()
+
+	srv.runConvoRound(round, pki, route, requests)
+	if back == "" {
+		t.Fatal("no server was evicted")
+	}
+	for _, c := range clients {
+		r, ok := c.reply(t).(*ConvoResponse)
+		if !ok {
+			t.Fatalf("got %#v, want a reply from the retry", r)
+		}
+		if r.Round != round || c.onionRound != round|retryRoundBit {
+			t.Fatalf("reply for round %d sealed for %d", r.Round, c.onionRound)
+		}
+		msg, ok := onionbox.Open(r.Onion, BackwardNonce(c.onionRound), c.sharedKeys)
+		if !ok {
+			t.Fatal("reply does not open")
+		}
+		if !bytes.Equal(msg, c.exchange.EncryptedMessage[:]) {
+			t.Fatal("reply is not the client's own message")
+		}
+	}
+	for _, c := range clients {
+		if l := srv.privacy.Loss(c.publicKey); l.ConvoRounds != 2 {
+			t.Fatalf("client is charged for %d convo rounds, want 2 with the retry", l.ConvoRounds)
+		}
+	}
+}
+
+// TestRetryConvoRoundLevelDown checks that clients hear about a round
+// that cannot be retried because no server is left at a level.
+func TestRetryConvoRoundLevelDown(t *testing.T) {
+	levels := [][]string{{"first"}, {"middle0", "middle1"}, {"last"}}
+	pki, servers := newMixServers(t, levels)
+	srv, url := newEntryServer(t, pki, nil)
+
+	const round = 1
+	route := []string{"first", "middle0", "last"}
+	clients, requests := startConvoRound(t, srv, url, round, route, 3)
+	servers["middle0"].kill()
+	servers["middle1"].kill()
+	// the other replica is evicted too, as a missed heartbeat would
+	srv.members.Evict("middle0", "test")
+	srv.members.Evict("middle1", "test")
+
+	srv.runConvoRound(round, pki, route, requests)
+	for _, c := range clients {
+		e, ok := c.reply(t).(*ConvoError)
+		if !ok {
+			t.Fatalf("got %#v, want an error", e)
+		}
+		if e.Hop == nil || e.Hop.Level != 1 {
+			t.Fatalf("error %#v does not blame level 1", e)
+		}
+	}
+}
+
+func TestNextRoute(t *testing.T) {
+	pki := &PKI{
+		Servers:      make(map[string]*ServerInfo),
+		ServerLevels: map[int][]string{0: {"first", "first2"}, 1: {"middle0", "middle1"}, 2: {"last"}},
+		ServerOrder:  []string{"first", "middle0", "last"},
+	}
+	for level, names := range pki.ServerLevels {
+		for _, name := range names {
+			pki.Servers[name] = &ServerInfo{Level: level}
+		}
+	}
+	srv := &server{
+		pkis:   StaticPKIStore(pki),
+		routes: RandomRoute{},
+	}
+	srv.members = &MembershipService{PKIStore: srv.pkis}
+	InitMembershipService(srv.members)
+
+	// Level 0 is pinned to the server the entry server is connected
+	// to, whatever the membership view says about it.
+	srv.members.Evict("first", "test")
+	srv.members.Evict("first2", "test")
+	srv.members.Evict("middle0", "test")
+	for i := 0; i < 20; i++ {
+		route, err := srv.nextRoute(pki)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"first", "middle1", "last"}; !reflect.DeepEqual(route, want) {
+			t.Fatalf("route is %v, want %v", route, want)
+		}
+	}
+	if got := pki.ServerLevels[0]; len(got) != 2 {
+		t.Fatalf("nextRoute changed the PKI's level 0 to %v", got)
+	}
+}
+
+// slowRounds creates rounds like a first server that answers NewRound
+// for one round too late.
+type slowRounds struct {
+	slow  uint32
+	delay time.Duration
+
+	mu      sync.Mutex
+	rounds  map[uint32]bool
+	deleted []uint32
+}
+
+func (s *slowRounds) newRound(round uint32) {
+	s.mu.Lock()
+	s.rounds[round] = true
+	s.mu.Unlock()
+	if round == s.slow {
+		time.Sleep(s.delay)
+	}
+}
+
+func (s *slowRounds) Delete(round uint32, _ *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rounds, round)
+	s.deleted = append(s.deleted, round)
+	return nil
+}
+
+func (s *slowRounds) check(t *testing.T, next uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.deleted) != 1 || s.deleted[0] != s.slow || s.rounds[s.slow] {
+		t.Fatalf("round %d was not deleted: rounds %v, deleted %v", s.slow, s.rounds, s.deleted)
+	}
+	if !s.rounds[next] {
+		t.Fatalf("round %d did not start: rounds %v", next, s.rounds)
+	}
+}
+
+type slowConvoService struct {
+	*slowRounds
+}
+
+func (s slowConvoService) NewRound(args *ConvoNewRoundArgs, _ *struct{}) error {
+	s.newRound(args.Round)
+	return nil
+}
+
+type slowDialService struct {
+	*slowRounds
+}
+
+func (s slowDialService) NewRound(args *DialNewRoundArgs, _ *struct{}) error {
+	s.newRound(args.Round)
+	return nil
+}
+
+// serveSlowRounds serves the convo and dial services of a first server
+// that is slow to start round 5, with a short -timeout.
+func serveSlowRounds(t *testing.T) (*server, *slowRounds) {
+	timeout := *roundTimeout
+	*roundTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { *roundTimeout = timeout })
+
+	rounds := &slowRounds{slow: 5, delay: time.Second, rounds: make(map[uint32]bool)}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("ConvoService", slowConvoService{rounds}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rpcServer.RegisterName("DialService", slowDialService{rounds}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go vrpc.NewServer(rpcServer, vrpc.GobCodec).Accept(l)
+
+	first, err := vrpc.Dial("tcp", l.Addr().String(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+	return &server{firstServer: first, convoRound: 5, dialRound: 5}, rounds
+}
+
+func TestNewConvoRoundTimeout(t *testing.T) {
+	srv, rounds := serveSlowRounds(t)
+	pki := &PKI{Epoch: 1}
+	route := []string{"first", "last"}
+
+	err := srv.newConvoRound(pki, srv.convoRound, route)
+	if _, ok := err.(*vrpc.TimeoutError); !ok {
+		t.Fatalf("newConvoRound: got %v, want a timeout", err)
+	}
+	if srv.convoRound != 6 {
+		t.Fatalf("next round is %d, want 6", srv.convoRound)
+	}
+	if err := srv.newConvoRound(pki, srv.convoRound, route); err != nil {
+		t.Fatalf("newConvoRound after a timeout: %s", err)
+	}
+	rounds.check(t, 6)
+}
+
+func TestNewDialRoundTimeout(t *testing.T) {
+	srv, rounds := serveSlowRounds(t)
+	pki := &PKI{Epoch: 1}
+	route := []string{"first", "last"}
+
+	err := srv.newDialRound(pki, srv.dialRound, route, 1)
+	if _, ok := err.(*vrpc.TimeoutError); !ok {
+		t.Fatalf("newDialRound: got %v, want a timeout", err)
+	}
+	if srv.dialRound != 6 {
+		t.Fatalf("next round is %d, want 6", srv.dialRound)
+	}
+	if err := srv.newDialRound(pki, srv.dialRound, route, 1); err != nil {
+		t.Fatalf("newDialRound after a timeout: %s", err)
+	}
+	rounds.check(t, 6)
+}
+
+func TestRunConvoRoundFailure(t *testing.T) {
+	srv, rounds := serveSlowRounds(t)
+	srv.privacy = new(PrivacyAccountant)
+	InitPrivacyAccountant(srv.privacy)
+	public, _, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &PKI{
+		Servers:     map[string]*ServerInfo{"first": {PublicKey: public}, "last": {PublicKey: public, Level: 1}},
+		ServerOrder: []string{"first", "last"},
+	}
+
+	// The first server does not serve Open, so the round fails.
+	srv.runConvoRound(7, pki, pki.ServerOrder, nil)
+	rounds.mu.Lock()
+	defer rounds.mu.Unlock()
+	if len(rounds.deleted) != 1 || rounds.deleted[0] != 7 {
+		t.Fatalf("failed round 7 was not deleted: deleted %v", rounds.deleted)
+	}
+}
+
+func TestRunDialRoundFailure(t *testing.T) {
+	srv, rounds := serveSlowRounds(t)
+	srv.privacy = new(PrivacyAccountant)
+	InitPrivacyAccountant(srv.privacy)
+
+	// The first server does not serve Close, so the round fails.
+	srv.runDialRound(7, &PKI{Epoch: 1}, []string{"first", "last"}, 1, nil)
+	rounds.mu.Lock()
+	defer rounds.mu.Unlock()
+	if len(rounds.deleted) != 1 || rounds.deleted[0] != 7 {
+		t.Fatalf("failed round 7 was not deleted: deleted %v", rounds.deleted)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	. "vuvuzela.io/vuvuzela"
+	. "vuvuzela.io/vuvuzela/internal"
+)
+
+// editor holds the flags every editing command takes, and the PKI
+// being edited.
+type editor struct {
+	pkiPath  *string
+	confDir  *string
+	signPath *string
+
+	pki    *PKI
+	exists bool
+	signed bool
+}
+
+func newEditor(fs *flag.FlagSet) *editor {
+	return &editor{
+		pkiPath:  fs.String("pki", "../confs/pki.conf", "pki file to edit"),
+		confDir:  fs.String("confs", "", "directory for conf files (default: the pki file's directory)"),
+		signPath: fs.String("sign", "", "operator key file to sign the pki with"),
+	}
+}
+
+func (e *editor) confPath(name string) string {
+	dir := *e.confDir
+	if dir == "" {
+		dir = filepath.Dir(*e.pkiPath)
+	}
+	return filepath.Join(dir, name+".conf")
+}
+
+// load reads the PKI without validating it, since it may be half
+// built.  A missing file is an empty PKI.
+func (e *editor) load() error {
+	data, err := os.ReadFile(*e.pkiPath)
+	if errors.Is(err, os.ErrNotExist) {
+		e.pki = &PKI{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.exists = true
+
+	var signed SignedPKI
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("%q: json decoding error: %s", *e.pkiPath, err)
+	}
+	body := data
+	if signed.Signature != "" {
+		e.signed = true
+		body = signed.PKI
+	}
+	e.pki = new(PKI)
+	if err := json.Unmarshal(body, e.pki); err != nil {
+		return fmt.Errorf("%q: json decoding error: %s", *e.pkiPath, err)
+	}
+	return nil
+}
+
+// save puts ServerOrder in line with ServerLevels, moves to a new epoch
+// so running servers pick up the change, checks the result and writes
+// it.
+func (e *editor) save() error {
+	pki := e.pki
+	if pki.People == nil {
+		pki.People = make(map[string]*BoxKey)
+	}
+	if pki.Servers == nil {
+		pki.Servers = make(map[string]*ServerInfo)
+	}
+	if pki.ServerLevels == nil {
+		pki.ServerLevels = make(map[int][]string)
+	}
+	order := make([]string, len(pki.ServerLevels))
+	for level := range order {
+		servers := pki.ServerLevels[level]
+		if level < len(pki.ServerOrder) && contains(servers, pki.ServerOrder[level]) {
+			order[level] = pki.ServerOrder[level]
+		} else if len(servers) > 0 {
+			order[level] = servers[0]
+		}
+	}
+	pki.ServerOrder = order
+	if e.exists {
+		pki.Epoch++
+	}
+
+	if len(pki.Servers) > 0 {
+		if err := pki.Validate(); err != nil {
+			return fmt.Errorf("the edited PKI is not valid:\n%s", err)
+		}
+	}
+
+	var v interface{} = pki
+	if *e.signPath != "" {
+		operator := new(operatorConf)
+		if err := readJSON(*e.signPath, operator); err != nil {
+			return err
+		}
+		signed, err := SignPKI(pki, ed25519.PrivateKey(operator.PrivateKey))
+		if err != nil {
+			return err
+		}
+		v = signed
+	} else if e.signed {
+		return fmt.Errorf("%q is signed; pass -sign to sign the edited PKI", *e.pkiPath)
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(*e.pkiPath, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %q (epoch %d)\n", *e.pkiPath, pki.Epoch)
+	return nil
+}
+
+// confFree makes sure there is no conf file for name, since it would
+// hold someone's private key.  It is called before the PKI is saved, so
+// that a conf file is only written for a PKI that was.
+func (e *editor) confFree(name string) error {
+	path := e.confPath(name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%q already exists", path)
+	}
+	return nil
+}
+
+func (e *editor) writeConf(name string, conf interface{}) error {
+	path := e.confPath(name)
+	if err := WriteJSONFile(path, conf); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %q\n", path)
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func readJSON(path string, val interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, val); err != nil {
+		return fmt.Errorf("%q: json decoding error: %s", path, err)
+	}
+	return nil
+}
+
+func oneName(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected one name, got %d arguments", fs.NArg())
+	}
+	return fs.Arg(0), nil
+}
+
+// addServer adds a mix server at a level and writes its conf file.  A
+// server added with -replica-of shares the key of a server already at
+// that level.
+func addServer(args []string) error {
+	fs := flag.NewFlagSet("add-server", flag.ExitOnError)
+	e := newEditor(fs)
+	level := fs.Int("level", -1, "level to add the server at, as a replica of the servers there (default: a new last level)")
+	addr := fs.String("addr", "", "address the server listens on, as host:port")
+	replicaOf := fs.String("replica-of", "", "add the server as a replica of this server, with the same level and key")
+	convoMu := fs.Float64("convo-mu", DefaultConvoMu, "ConvoMu in the server's conf")
+	convoB := fs.Float64("convo-b", DefaultConvoB, "ConvoB in the server's conf")
+	dialMu := fs.Float64("dial-mu", DefaultDialMu, "DialMu in the server's conf")
+	dialB := fs.Float64("dial-b", DefaultDialB, "DialB in the server's conf")
+	capacity := fs.Int("capacity", 0, "the server's share of rounds at its level when routes are weighted (0 means 1)")
+	fs.Parse(args)
+
+	name, err := oneName(fs)
+	if err != nil {
+		return err
+	}
+	if *addr == "" {
+		return fmt.Errorf("-addr is required")
+	}
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return fmt.Errorf("-addr: %s", err)
+	}
+	if err := e.load(); err != nil {
+		return err
+	}
+	pki := e.pki
+	if pki.Servers[name] != nil {
+		return fmt.Errorf("server %q already exists", name)
+	}
+	if err := e.confFree(name); err != nil {
+		return err
+	}
+
+	conf := &ServerConf{
+		ServerName: name,
+		ListenAddr: ":" + port,
+		ConvoMu:    *convoMu,
+		ConvoB:     *convoB,
+		DialMu:     *dialMu,
+		DialB:      *dialB,
+	}
+	if servers := pki.ServerLevels[*level]; *replicaOf == "" && len(servers) > 0 {
+		// the servers at a level all run the level's key
+		*replicaOf = servers[0]
+	}
+	if *replicaOf != "" {
+		other := pki.Servers[*replicaOf]
+		if other == nil {
+			return fmt.Errorf("-replica-of: server %q not found", *replicaOf)
+		}
+		if *level == -1 {
+			*level = other.Level
+		} else if *level != other.Level {
+			return fmt.Errorf("-replica-of: server %q is at level %d, not %d", *replicaOf, other.Level, *level)
+		}
+		otherConf, err := e.serverConf(*replicaOf)
+		if err != nil {
+			return fmt.Errorf("-replica-of: %s", err)
+		}
+		conf.PublicKey, conf.PrivateKey = otherConf.PublicKey, otherConf.PrivateKey
+	} else {
+		conf.PublicKey, conf.PrivateKey, err = GenerateBoxKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("GenerateBoxKey: %s", err)
+		}
+	}
+
+	if *level == -1 {
+		*level = len(pki.ServerLevels)
+	}
+	if *level < 0 || *level > len(pki.ServerLevels) {
+		return fmt.Errorf("-level %d would leave a gap; there are %d levels", *level, len(pki.ServerLevels))
+	}
+	if pki.Servers == nil {
+		pki.Servers = make(map[string]*ServerInfo)
+	}
+	if pki.ServerLevels == nil {
+		pki.ServerLevels = make(map[int][]string)
+	}
+	pki.Servers[name] = &ServerInfo{
+		Address:   *addr,
+		PublicKey: conf.PublicKey,
+		Level:     *level,
+		Capacity:  *capacity,
+	}
+	pki.ServerLevels[*level] = append(pki.ServerLevels[*level], name)
+
+	if err := e.save(); err != nil {
+		return err
+	}
+	return e.writeConf(name, conf)
+}
+
+// removeServer takes a mix server out of the PKI.  Its conf file is
+// left alone.
+func removeServer(args []string) error {
+	fs := flag.NewFlagSet("remove-server", flag.ExitOnError)
+	e := newEditor(fs)
+	fs.Parse(args)
+
+	name, err := oneName(fs)
+	if err != nil {
+		return err
+	}
+	if err := e.load(); err != nil {
+		return err
+	}
+	pki := e.pki
+	info := pki.Servers[name]
+	if info == nil {
+		return fmt.Errorf("server %q not found", name)
+	}
+
+	if err := e.takeOut(name); err != nil {
+		return err
+	}
+	delete(pki.Servers, name)
+	return e.save()
+}
+
+// moveServer moves a mix server to another level and rewrites its conf
+// file with its new key: the key of the servers already at the level, or
+// a new one for a new last level.
+func moveServer(args []string) error {
+	fs := flag.NewFlagSet("move-server", flag.ExitOnError)
+	e := newEditor(fs)
+	level := fs.Int("level", -1, "level to move the server to (default: a new last level)")
+	fs.Parse(args)
+
+	name, err := oneName(fs)
+	if err != nil {
+		return err
+	}
+	if err := e.load(); err != nil {
+		return err
+	}
+	pki := e.pki
+	info := pki.Servers[name]
+	if info == nil {
+		return fmt.Errorf("server %q not found", name)
+	}
+	if *level == info.Level {
+		return fmt.Errorf("server %q is already at level %d", name, *level)
+	}
+	conf, err := e.serverConf(name)
+	if err != nil {
+		return err
+	}
+	if err := e.takeOut(name); err != nil {
+		return err
+	}
+
+	if *level == -1 {
+		*level = len(pki.ServerLevels)
+	}
+	if *level < 0 || *level > len(pki.ServerLevels) {
+		return fmt.Errorf("-level %d would leave a gap; there are %d levels without %q", *level, len(pki.ServerLevels), name)
+	}
+	if servers := pki.ServerLevels[*level]; len(servers) > 0 {
+		levelConf, err := e.serverConf(servers[0])
+		if err != nil {
+			return err
+		}
+		conf.PublicKey, conf.PrivateKey = levelConf.PublicKey, levelConf.PrivateKey
+	} else {
+		conf.PublicKey, conf.PrivateKey, err = GenerateBoxKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("GenerateBoxKey: %s", err)
+		}
+	}
+	info.Level = *level
+	info.PublicKey = conf.PublicKey
+	pki.ServerLevels[*level] = append(pki.ServerLevels[*level], name)
+
+	if err := e.save(); err != nil {
+		return err
+	}
+	return e.writeConf(name, conf)
+}
+
+// takeOut removes name from its level in ServerLevels.  The level goes
+// away with its last server, which is only allowed for the last level.
+func (e *editor) takeOut(name string) error {
+	pki := e.pki
+	info := pki.Servers[name]
+	var servers []string
+	for _, s := range pki.ServerLevels[info.Level] {
+		if s != name {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		if info.Level != len(pki.ServerLevels)-1 {
+			return fmt.Errorf("server %q is the only one at level %d; removing it would leave a gap", name, info.Level)
+		}
+		delete(pki.ServerLevels, info.Level)
+	} else {
+		pki.ServerLevels[info.Level] = servers
+	}
+	return nil
+}
+
+// serverConf reads the conf file of a server in the PKI and checks that
+// it holds the key the PKI lists for the server.
+func (e *editor) serverConf(name string) (*ServerConf, error) {
+	conf := new(ServerConf)
+	if err := readJSON(e.confPath(name), conf); err != nil {
+		return nil, err
+	}
+	if conf.PrivateKey == nil || conf.PublicKey == nil || *conf.PublicKey != *e.pki.Servers[name].PublicKey {
+		return nil, fmt.Errorf("%q does not hold the key the PKI lists for %q", e.confPath(name), name)
+	}
+	return conf, nil
+}
+
+// addPerson adds a user to the PKI and writes their client conf.
+func addPerson(args []string) error {
+	fs := flag.NewFlagSet("add-person", flag.ExitOnError)
+	e := newEditor(fs)
+	fs.Parse(args)
+
+	name, err := oneName(fs)
+	if err != nil {
+		return err
+	}
+	if err := e.load(); err != nil {
+		return err
+	}
+	if _, ok := e.pki.People[name]; ok {
+		return fmt.Errorf("person %q already exists", name)
+	}
+	if err := e.confFree(name); err != nil {
+		return err
+	}
+
+	publicKey, privateKey, err := GenerateBoxKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("GenerateBoxKey: %s", err)
+	}
+	if e.pki.People == nil {
+		e.pki.People = make(map[string]*BoxKey)
+	}
+	e.pki.People[name] = publicKey
+	conf := &ClientConf{
+		MyName:       name,
+		MyPublicKey:  publicKey,
+		MyPrivateKey: privateKey,
+	}
+	if err := e.save(); err != nil {
+		return err
+	}
+	return e.writeConf(name, conf)
+}
+
+// setEntry sets the entry server's address.  Its key comes from
+// entry.conf, which is created with a new key if it does not exist.
+func setEntry(args []string) error {
+	fs := flag.NewFlagSet("set-entry", flag.ExitOnError)
+	e := newEditor(fs)
+	addr := fs.String("addr", "ws://localhost:8080", "address clients connect to")
+	membership := fs.String("membership", "", "host:port of the entry server's membership service, which mix servers register with")
+	fs.Parse(args)
+
+	if err := e.load(); err != nil {
+		return err
+	}
+
+	conf := new(EntryConf)
+	err := readJSON(e.confPath("entry"), conf)
+	newConf := errors.Is(err, os.ErrNotExist)
+	if newConf {
+		conf.PublicKey, conf.PrivateKey, err = GenerateBoxKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("GenerateBoxKey: %s", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	e.pki.EntryServer = *addr
+	e.pki.EntryServerKey = conf.PublicKey
+	if *membership != "" {
+		e.pki.MembershipServer = *membership
+	}
+	if err := e.save(); err != nil {
+		return err
+	}
+	if newConf {
+		return e.writeConf("entry", conf)
+	}
+	return nil
+}
+
+// operatorConf is an operator's signing key pair.
+type operatorConf struct {
+	PublicKey  base32Bytes
+	PrivateKey base32Bytes
+}
+
+type base32Bytes []byte
+
+func (b base32Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base32.EncodeToString(b))
+}
+
+func (b *base32Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	x, err := base32.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("base32 decode error: %s", err)
+	}
+	*b = x
+	return nil
+}
+
+// newOperator generates a key pair for signing the PKI.  The public key
+// is what the servers and clients take as -operator.
+func newOperator(args []string) error {
+	fs := flag.NewFlagSet("operator", flag.ExitOnError)
+	out := fs.String("out", "operator.conf", "file to write the key pair to")
+	fs.Parse(args)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%q already exists", *out)
+	}
+	conf := &operatorConf{
+		PublicKey:  base32Bytes(publicKey),
+		PrivateKey: base32Bytes(privateKey),
+	}
+	if err := WriteJSONFile(*out, conf); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %q\noperator key: %s\n", *out, base32.EncodeToString(publicKey))
+	return nil
+}
+
+// list prints the servers by level.
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	e := newEditor(fs)
+	fs.Parse(args)
+
+	if err := e.load(); err != nil {
+		return err
+	}
+	pki := e.pki
+	fmt.Printf("epoch %d\n", pki.Epoch)
+	for level := 0; level < len(pki.ServerLevels); level++ {
+		fmt.Printf("level %d:\n", level)
+		for _, name := range pki.ServerLevels[level] {
+			info := pki.Servers[name]
+			if info == nil {
+				fmt.Printf("\t%s (unknown)\n", name)
+				continue
+			}
+			fmt.Printf("\t%s\t%s\t%s\n", name, info.Address, info.PublicKey.Fingerprint())
+		}
+	}
+	people := make([]string, 0, len(pki.People))
+	for name := range pki.People {
+		people = append(people, name)
+	}
+	sort.Strings(people)
+	fmt.Printf("people: %v\n", people)
+	fmt.Printf("entry server: %s\n", pki.EntryServer)
+	return nil
+}
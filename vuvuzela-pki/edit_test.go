@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "vuvuzela.io/vuvuzela"
+	. "vuvuzela.io/vuvuzela/internal"
+)
+
+// newTestPKI builds a signed PKI in a new directory with the servers
+// first; middle1 and middle2; last, and returns the directory.
+func newTestPKI(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"operator", "other"} {
+		if err := newOperator([]string{"-out", filepath.Join(dir, name+".conf")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, edit := range []string{
+		"set-entry -addr ws://localhost:8080",
+		"add-server -addr localhost:2718 first",
+		"add-server -addr localhost:3719 middle1",
+		"add-server -addr localhost:3720 -replica-of middle1 middle2",
+		"add-server -addr localhost:2720 last",
+	} {
+		if err := runEdit(dir, edit, "operator"); err != nil {
+			t.Fatalf("%s: %s", edit, err)
+		}
+	}
+	return dir
+}
+
+// runEdit runs an editing command on the PKI in dir, signing it with
+// the operator conf sign unless sign is empty.
+func runEdit(dir string, edit string, sign string) error {
+	fields := strings.Fields(edit)
+	args := []string{"-pki", filepath.Join(dir, "pki.conf")}
+	if sign != "" {
+		args = append(args, "-sign", filepath.Join(dir, sign+".conf"))
+	}
+	return commands[fields[0]].run(append(args, fields[1:]...))
+}
+
+func readPKI(t *testing.T, dir string, operator string) (*PKI, error) {
+	conf := new(operatorConf)
+	if err := readJSON(filepath.Join(dir, operator+".conf"), conf); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "pki.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DecodePKI(data, ed25519.PublicKey(conf.PublicKey))
+}
+
+func levels(pki *PKI) [][]string {
+	levels := make([][]string, len(pki.ServerLevels))
+	for level := range levels {
+		levels[level] = pki.ServerLevels[level]
+	}
+	return levels
+}
+
+func TestEdit(t *testing.T) {
+	tests := []struct {
+		name string
+		edit string
+		// sign is the operator conf the edit is signed with, and that
+		// the result must verify against.
+		sign   string
+		err    string
+		levels [][]string
+		check  func(t *testing.T, pki *PKI)
+	}{
+		{
+			name:   "add replica",
+			edit:   "add-server -addr localhost:3721 -level 1 middle3",
+			levels: [][]string{{"first"}, {"middle1", "middle2", "middle3"}, {"last"}},
+			check: func(t *testing.T, pki *PKI) {
+				if *pki.Servers["middle3"].PublicKey != *pki.Servers["middle1"].PublicKey {
+					t.Fatal("middle3 does not have the key of level 1")
+				}
+			},
+		},
+		{
+			name:   "add last level",
+			edit:   "add-server -addr localhost:2721 last2",
+			levels: [][]string{{"first"}, {"middle1", "middle2"}, {"last"}, {"last2"}},
+		},
+		{
+			name: "add existing server",
+			edit: "add-server -addr localhost:2721 last",
+			err:  `server "last" already exists`,
+		},
+		{
+			name: "add with gap",
+			edit: "add-server -addr localhost:2721 -level 4 far",
+			err:  "would leave a gap",
+		},
+		{
+			name:   "remove replica",
+			edit:   "remove-server middle1",
+			levels: [][]string{{"first"}, {"middle2"}, {"last"}},
+			check: func(t *testing.T, pki *PKI) {
+				if pki.ServerOrder[1] != "middle2" {
+					t.Fatalf("ServerOrder is %v, want middle2 at level 1", pki.ServerOrder)
+				}
+			},
+		},
+		{
+			name:   "remove last level",
+			edit:   "remove-server last",
+			levels: [][]string{{"first"}, {"middle1", "middle2"}},
+		},
+		{
+			name: "remove with gap",
+			edit: "remove-server first",
+			err:  "would leave a gap",
+		},
+		{
+			name: "remove unknown",
+			edit: "remove-server nobody",
+			err:  `server "nobody" not found`,
+		},
+		{
+			name:   "move replica to new level",
+			edit:   "move-server middle2",
+			levels: [][]string{{"first"}, {"middle1"}, {"last"}, {"middle2"}},
+			check: func(t *testing.T, pki *PKI) {
+				if *pki.Servers["middle2"].PublicKey == *pki.Servers["middle1"].PublicKey {
+					t.Fatal("middle2 still has the key of level 1")
+				}
+			},
+		},
+		{
+			name:   "move to replicas",
+			edit:   "move-server -level 1 last",
+			levels: [][]string{{"first"}, {"middle1", "middle2", "last"}},
+			check: func(t *testing.T, pki *PKI) {
+				if *pki.Servers["last"].PublicKey != *pki.Servers["middle1"].PublicKey {
+					t.Fatal("last does not have the key of level 1")
+				}
+			},
+		},
+		{
+			name: "move with gap",
+			edit: "move-server -level 2 first",
+			err:  "would leave a gap",
+		},
+		{
+			name: "move to same level",
+			edit: "move-server -level 1 middle1",
+			err:  "already at level 1",
+		},
+		{
+			name:   "re-sign",
+			edit:   "add-person alice",
+			sign:   "other",
+			levels: [][]string{{"first"}, {"middle1", "middle2"}, {"last"}},
+		},
+		{
+			name: "unsigned edit of signed PKI",
+			edit: "add-person alice",
+			sign: "none",
+			err:  "pass -sign",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := newTestPKI(t)
+			before, err := readPKI(t, dir, "operator")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sign := test.sign
+			switch sign {
+			case "":
+				sign = "operator"
+			case "none":
+				sign = ""
+			}
+			err = runEdit(dir, test.edit, sign)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				after, err := readPKI(t, dir, "operator")
+				if err != nil {
+					t.Fatalf("PKI after a failed edit: %s", err)
+				}
+				if after.Epoch != before.Epoch {
+					t.Fatal("a failed edit wrote the PKI")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pki, err := readPKI(t, dir, sign)
+			if err != nil {
+				t.Fatalf("edited PKI does not verify against %s: %s", sign, err)
+			}
+			if err := pki.Validate(); err != nil {
+				t.Fatalf("edited PKI is not valid: %s", err)
+			}
+			if sign != "operator" {
+				if _, err := readPKI(t, dir, "operator"); err == nil {
+					t.Fatal("re-signed PKI verifies against the old operator key")
+				}
+			}
+			if pki.Epoch != before.Epoch+1 {
+				t.Fatalf("epoch %d, want %d", pki.Epoch, before.Epoch+1)
+			}
+			if got := levels(pki); !reflect.DeepEqual(got, test.levels) {
+				t.Fatalf("levels are %v, want %v", got, test.levels)
+			}
+			for name, info := range pki.Servers {
+				conf := new(ServerConf)
+				if err := readJSON(filepath.Join(dir, name+".conf"), conf); err != nil {
+					t.Fatal(err)
+				}
+				if *conf.PublicKey != *info.PublicKey {
+					t.Fatalf("%s.conf does not hold the key the PKI lists for %s", name, name)
+				}
+			}
+			if test.check != nil {
+				test.check(t, pki)
+			}
+		})
+	}
+}
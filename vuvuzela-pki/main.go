@@ -0,0 +1,126 @@
+// Command vuvuzela-pki checks and edits Vuvuzela PKI files.
+//
+// The editing commands generate keys, write the conf files of the
+// servers and people they add next to the PKI, and move the PKI to a new
+// epoch so that running servers pick up the change.
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	. "vuvuzela.io/vuvuzela"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"validate": {
+		usage: "validate [-operator key] [pki file ...]",
+		run:   validate,
+	},
+	"list": {
+		usage: "list [-pki file]",
+		run:   list,
+	},
+	"add-server": {
+		usage: "add-server [-pki file] [-confs dir] [-sign file] -addr host:port [-level n] [-replica-of server] [-capacity n] name",
+		run:   addServer,
+	},
+	"remove-server": {
+		usage: "remove-server [-pki file] [-sign file] name",
+		run:   removeServer,
+	},
+	"move-server": {
+		usage: "move-server [-pki file] [-confs dir] [-sign file] [-level n] name",
+		run:   moveServer,
+	},
+	"add-person": {
+		usage: "add-person [-pki file] [-confs dir] [-sign file] name",
+		run:   addPerson,
+	},
+	"set-entry": {
+		usage: "set-entry [-pki file] [-confs dir] [-sign file] [-addr url] [-membership host:port]",
+		run:   setEntry,
+	},
+	"operator": {
+		usage: "operator [-out file]",
+		run:   newOperator,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: vuvuzela-pki <command> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  vuvuzela-pki %s\n", commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "vuvuzela-pki %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// validate checks each PKI file and prints every problem it finds, so a
+// bad config is caught before the servers are started.
+func validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	operatorKey := fs.String("operator", "", "base32 key the PKI must be signed with (if empty, signatures are not checked)")
+	fs.Parse(args)
+
+	var operator ed25519.PublicKey
+	if *operatorKey != "" {
+		var err error
+		operator, err = ParseOperatorKey(*operatorKey)
+		if err != nil {
+			return fmt.Errorf("-operator: %s", err)
+		}
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"../confs/pki.conf"}
+	}
+	bad := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = DecodePKI(data, operator)
+		}
+		if err != nil {
+			bad++
+			fmt.Printf("%s:\n", path)
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Printf("\t%s\n", line)
+			}
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d PKI files are invalid", bad, len(paths))
+	}
+	return nil
+}
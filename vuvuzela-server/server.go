@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
 	"flag"
@@ -13,7 +14,6 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
-	"sync"
 	"syscall"
 	"time"
 
@@ -29,31 +29,35 @@ var doInit = flag.Bool("init", false, "create default config file")
 var confPath = flag.String("conf", "", "config file")
 // Use Absolute Path for now?
 var pkiPath = flag.String("pki", "../confs/pki.conf", "pki file")
+var operatorKey = flag.String("operator", "", "base32 key the PKI must be signed with (if empty, signatures are not checked)")
 var muOverride = flag.Float64("mu", -1.0, "override ConvoMu in conf file")
+var dialMuOverride = flag.Float64("dial-mu", -1.0, "override DialMu in conf file")
+var roundTimeout = flag.Duration("timeout", DefaultRoundTimeout, "give up on the next server after this long")
+var secure = flag.Bool("secure", false, "authenticate and encrypt connections between servers")
+var codecName = flag.String("codec", "gob", "encoding for RPCs between servers (gob or binary)")
+var streaming = flag.Bool("stream", false, "stream convo rounds to the next server instead of using batched RPCs")
+var pipelineDepth = flag.Int("depth", 1, "number of rounds this server works on at once")
+var roundLifetime = flag.Duration("lifetime", DefaultRoundLifetime, "abort rounds that have not finished after this long")
+var heartbeat = flag.Duration("heartbeat", DefaultHeartbeatInterval, "how often to send heartbeats to the membership service")
+var dialRetain = flag.Int("retain", DefaultDialRetainRounds, "number of deleted dial rounds the last server keeps buckets for")
 
-type Conf struct {
-	ServerName string
-	PublicKey  *BoxKey
-	PrivateKey *BoxKey
-	ListenAddr string `json:",omitempty"`
-	DebugAddr  string `json:",omitempty"`
-
-	ConvoMu float64
-	ConvoB  float64
-
-	DialMu float64
-	DialB  float64
-}
+// wireCodec is parsed from -codec.
+var wireCodec vrpc.Codec
 
 func WriteDefaultConf(path string) {
 	myPublicKey, myPrivateKey, err := GenerateBoxKey(rand.Reader)
 	if err != nil {
 		log.Fatalf("GenerateKey: %s", err)
 	}
-	conf := &Conf{
+	conf := &ServerConf{
 		ServerName: "mit",
 		PublicKey:  myPublicKey,
 		PrivateKey: myPrivateKey,
+
+		ConvoMu: DefaultConvoMu,
+		ConvoB:  DefaultConvoB,
+		DialMu:  DefaultDialMu,
+		DialB:   DefaultDialB,
 	}
 
 	data, err := json.MarshalIndent(conf, "", "  ")
@@ -66,6 +70,52 @@ func WriteDefaultConf(path string) {
 	fmt.Printf("wrote %q\n", path)
 }
 
+// dialServer connects to the mix server listening on addr.  With -secure,
+// the server must prove it holds the key the PKI lists for addr.
+func dialServer(pki *PKI, conf *ServerConf, addr string) (*vrpc.Client, error) {
+	dialer := &vrpc.Dialer{
+		Connections: runtime.NumCPU(),
+		Codec:       wireCodec,
+	}
+	if *secure {
+		var peerKey *BoxKey
+		for _, info := range pki.Servers {
+			if info.Address == addr {
+				peerKey = info.PublicKey
+			}
+		}
+		if peerKey == nil {
+			return nil, fmt.Errorf("no server with address %q in PKI", addr)
+		}
+		dialer.Transport = &vrpc.SecureTransport{
+			PublicKey:  conf.PublicKey.Key(),
+			PrivateKey: conf.PrivateKey.Key(),
+			PeerKey:    peerKey.Key(),
+		}
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// dialMembership connects to the membership service.  With -secure, it
+// must prove it holds the entry server's key.
+func dialMembership(pki *PKI, conf *ServerConf) (*vrpc.Client, error) {
+	dialer := &vrpc.Dialer{
+		Connections: 1,
+		Codec:       wireCodec,
+	}
+	if *secure {
+		if pki.EntryServerKey == nil {
+			return nil, fmt.Errorf("-secure needs EntryServerKey in the PKI to reach the membership service")
+		}
+		dialer.Transport = &vrpc.SecureTransport{
+			PublicKey:  conf.PublicKey.Key(),
+			PrivateKey: conf.PrivateKey.Key(),
+			PeerKey:    pki.EntryServerKey.Key(),
+		}
+	}
+	return dialer.Dial("tcp", pki.MembershipServer)
+}
+
 func logSIGINT(serverName string) {
 	to_write := fmt.Sprintf("%d\n", time.Now().UnixMicro())
 	filename := serverName + ".int";
@@ -91,6 +141,12 @@ func main() {
 	flag.Parse()
 	log.SetFormatter(&ServerFormatter{})
 
+	var err error
+	wireCodec, err = vrpc.ParseCodec(*codecName)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
 	if *confPath == "" {
 		log.Fatalf("must specify -conf flag")
 	}
@@ -100,9 +156,23 @@ func main() {
 		return
 	}
 
-	pki := ReadPKI(*pkiPath)
+	var operator ed25519.PublicKey
+	if *operatorKey != "" {
+		operator, err = ParseOperatorKey(*operatorKey)
+		if err != nil {
+			log.Fatalf("-operator: %s", err)
+		}
+	}
+	pkis, err := LoadPKIStore(*pkiPath, operator)
+	if err != nil {
+		log.Fatalf("LoadPKIStore: %s", err)
+	}
+	// Connections to the next servers are made once, with the PKI we
+	// start with; rounds use the PKI of the epoch they were started in.
+	pki := pkis.Current()
+	go pkis.Watch(DefaultPKIPollInterval, nil)
 
-	conf := new(Conf)
+	conf := new(ServerConf)
 	ReadJSONFile(*confPath, conf)
 	if conf.ServerName == "" || conf.PublicKey == nil || conf.PrivateKey == nil {
 		log.Fatalf("missing required fields: %s", *confPath)
@@ -124,39 +194,31 @@ func main() {
 	if *muOverride >= 0 {
 		conf.ConvoMu = *muOverride
 	}
+	if *dialMuOverride >= 0 {
+		conf.DialMu = *dialMuOverride
+	}
 
-	var err error
-	var client *vrpc.Client  
-	var firstClient *vrpc.Client  
-  var nextClients = make(map[string]*vrpc.Client)
+	var client *vrpc.Client
+	var firstClient *vrpc.Client
+	var nextClients = make(map[string]*vrpc.Client)
 	if addrs := pki.NextServers(conf.ServerName); addrs != nil {
-    for i, addr := range addrs{
-      client , err = vrpc.Dial("tcp", addr, runtime.NumCPU())
-      nextClients[addr] = client
-      if i == 0 {
-        firstClient = client
-      }
-      if err != nil {
-        log.Fatalf("vrpc.Dial: %s", err)
-      }
-    }
-	}
-  client =  firstClient 
-	// skip client for backup use
-	// TODO: Should one server know the address of skip client?	
-	var skipClient *vrpc.Client
-	if addr := pki.SkipServer(conf.ServerName, pki.ServerOrder); addr != "" {
-		skipClient, err = vrpc.Dial("tcp", addr, runtime.NumCPU())
-		if err != nil {
-			log.Fatalf("vrpc.Dial: %s", err)
+		for i, addr := range addrs {
+			client, err = dialServer(pki, conf, addr)
+			nextClients[addr] = client
+			if i == 0 {
+				firstClient = client
+			}
+			if err != nil {
+				log.Fatalf("vrpc.Dial: %s", err)
+			}
 		}
 	}
-	
+	client = firstClient
 
-	var idle sync.Mutex
+	pipeline := NewPipeline(*pipelineDepth)
 
 	convoService := &ConvoService{
-		Idle: &idle,
+		Pipeline: pipeline,
 
 		Laplace: vrand.Laplace{
 			Mu: conf.ConvoMu,
@@ -164,15 +226,19 @@ func main() {
 		},
 
 		PKI:        pki,
+		PKIStore:   pkis,
 		ServerName: conf.ServerName,
 		PrivateKey: conf.PrivateKey,
 
-		Client:     client,
-    NextClients: nextClients,
-		// SkipClient is for backup use
-		// Or discover when needed?
-		SkipClient: skipClient,
-		LastServer: client == nil,
+		NextClients: nextClients,
+		// servers that join later are dialed when a route first uses them
+		Dial: func(addr string) (*vrpc.Client, error) {
+			return dialServer(pkis.Current(), conf, addr)
+		},
+		LastServer:    client == nil,
+		Streaming:     *streaming,
+		Timeout:       *roundTimeout,
+		RoundLifetime: *roundLifetime,
 	}
 	InitConvoService(convoService)
 
@@ -182,19 +248,23 @@ func main() {
 	}
 
 	dialService := &DialService{
-		Idle: &idle,
+		Pipeline: pipeline,
 
 		Laplace: vrand.Laplace{
-			Mu: conf.ConvoMu,
-			B:  conf.ConvoB,
+			Mu: conf.DialMu,
+			B:  conf.DialB,
 		},
 
 		PKI:        pki,
+		PKIStore:   pkis,
 		ServerName: conf.ServerName,
 		PrivateKey: conf.PrivateKey,
 
-		Client:     client,
-		LastServer: client == nil,
+		NextClient:    convoService.NextClient,
+		LastServer:    client == nil,
+		Timeout:       *roundTimeout,
+		RoundLifetime: *roundLifetime,
+		RetainRounds:  *dialRetain,
 	}
 	InitDialService(dialService)
 
@@ -204,6 +274,32 @@ func main() {
 	if err := rpc.Register(convoService); err != nil {
 		log.Fatalf("rpc.Register: %s", err)
 	}
+	if err := rpc.Register(new(vrpc.Health)); err != nil {
+		log.Fatalf("rpc.Register: %s", err)
+	}
+
+	// A server registers with the membership service and keeps sending
+	// it heartbeats.  The entry server routes rounds around servers the
+	// service has evicted, either for missing heartbeats or because a
+	// round through them failed; KeepMembership registers again after
+	// a failed heartbeat, which brings an evicted server back.  Every
+	// view the service returns tells this server which replicas at the
+	// next level are up.
+	if pki.MembershipServer != "" {
+		// The entry server may not be up yet.
+		go func() {
+			members, err := dialMembership(pki, conf)
+			for err != nil {
+				log.WithFields(log.Fields{"service": "membership", "call": "dialMembership"}).Error(err)
+				time.Sleep(*heartbeat)
+				members, err = dialMembership(pki, conf)
+			}
+			KeepMembership(members, conf.ServerName, *heartbeat, func(m *Membership) {
+				log.WithFields(log.Fields{"service": "membership", "epoch": m.Epoch, "levels": m.Levels}).Info("membership changed")
+				convoService.ConnectNext(pkis.Current(), m)
+			})
+		}()
+	}
 
 	if conf.DebugAddr != "" {
 		go func() {
@@ -215,31 +311,23 @@ func main() {
 	if conf.ListenAddr == "" {
 		conf.ListenAddr = DefaultServerAddr
 	}
-	// Listen to incoming connection from previous server
-	// Before
-	// FirstServer:2718 ---> MiddleServer:2719 --> LastServer:2720
-	// Now
-	// FirstServer:2718 ---> MiddleServer1:3719 --> MiddleServer2:3720 --> LastServer:2720
-	// 1. When middleserver2 is down, middleserver directly forward message to last server
-	// May have some issue
-	// Last server can not break the onion layer that is supposed to be decrypted by middleserver2
-	// Does client has retry machanism?
-	// One possible solution
-	// middleserver1 / middleserver2.1
-	//               \ middleserver2.2
-	// middleserver2 group shares the same key pair
-	// security implication: larger attack surface
-	// Another possible solution
-	// middleserver1 --X--> middleserver2 --X--> last server
-	//               |--------------------------->|
-	// skip the middleserver2
-	// Problem: last server does not have private key of middleserver2, can not decrypt middleserver2 layer
-	// Possible Solution: client retry with one onion layer less
-	// Security implication: differential privacy may be broken?
-	// Try skip middleserver2 for now
 	listen, err := net.Listen("tcp", conf.ListenAddr)
 	if err != nil {
 		log.Fatal("Listen:", err)
 	}
-	rpc.Accept(listen)
+	if *secure {
+		listen = vrpc.SecureListener(listen, conf.PublicKey.Key(), conf.PrivateKey.Key(), func(peer *[32]byte) bool {
+			upstream := pkis.Current().UpstreamKeys(conf.ServerName)
+			for _, key := range upstream {
+				if *key.Key() == *peer {
+					return true
+				}
+			}
+			log.WithFields(log.Fields{"peer": (*BoxKey)(peer).String()}).Warn("rejected connection")
+			return false
+		})
+	}
+	server := vrpc.NewServer(rpc.DefaultServer, wireCodec)
+	server.HandleStream(ConvoRoundStream, convoService.ServeRoundStream)
+	server.Accept(listen)
 }
@@ -2,7 +2,9 @@ package vuvuzela
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"math"
 	"unsafe"
 
 	"golang.org/x/crypto/nacl/box"
@@ -56,10 +58,18 @@ func (i *Introduction) Unmarshal(data []byte) error {
 }
 
 type DialExchange struct {
-	Bucket         uint32
+	Bucket uint32
+	// Tag is the KeyDialTag of the sender and recipient, in rounds
+	// whose buckets come as Bloom filters, and random otherwise.  The
+	// last server puts it in the bucket's filter.
+	Tag            DialTag
 	EncryptedIntro [SizeEncryptedIntro]byte
 }
 
+// A DialTag marks an introduction between two users in a dial round.
+// It is random for noise and for dummy exchanges.
+type DialTag [8]byte
+
 func (e *DialExchange) Marshal() []byte {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, e); err != nil {
@@ -87,6 +97,41 @@ func BackwardNonce(round uint32) *[24]byte {
 	return &nonce
 }
 
+// KeyDialBucket returns the dial bucket, from 1 to buckets, that holds
+// the introductions for key in a round with the given number of buckets.
 func KeyDialBucket(key *BoxKey, buckets uint32) uint32 {
 	return binary.BigEndian.Uint32(key[28:32])%buckets + 1
 }
+
+// KeyDialTag returns the tag of an introduction in round between the
+// owner of myPrivate and the owner of theirPublic.  The sender and the
+// recipient get the same tag from their own private key and the other's
+// public key.  It comes from their shared secret, so the servers cannot
+// tell whom a tag is for.
+func KeyDialTag(theirPublic, myPrivate *BoxKey, round uint32) DialTag {
+	var shared [32]byte
+	box.Precompute(&shared, theirPublic.Key(), myPrivate.Key())
+	var r [4]byte
+	binary.BigEndian.PutUint32(r[:], round)
+	h := sha256.New()
+	h.Write([]byte("vuvuzela dial tag"))
+	h.Write(r[:])
+	h.Write(shared[:])
+	var tag DialTag
+	copy(tag[:], h.Sum(nil))
+	return tag
+}
+
+// DialBuckets returns the number of buckets for a dial round, given the
+// number of connected clients and the number of introductions that
+// recent rounds carried.
+func DialBuckets(clients int, intros float64) uint32 {
+	b := int(math.Ceil(intros / DialBucketIntros))
+	if max := clients / DialBucketClients; b > max {
+		b = max
+	}
+	if b < 1 {
+		b = 1
+	}
+	return uint32(b)
+}
@@ -8,3 +8,24 @@ func TestDialExchangeMarshal(t *testing.T) {
 	ex := new(DialExchange)
 	_ = ex.Marshal()
 }
+
+func TestDialBuckets(t *testing.T) {
+	tests := []struct {
+		clients int
+		intros  float64
+		want    uint32
+	}{
+		{0, 0, 1},
+		{10, 50000, 1},
+		{100000, 0, 1},
+		{100000, DialBucketIntros, 1},
+		{100000, 2.5 * DialBucketIntros, 3},
+		// too few clients to split them that finely
+		{3 * DialBucketClients, 10 * DialBucketIntros, 3},
+	}
+	for _, test := range tests {
+		if got := DialBuckets(test.clients, test.intros); got != test.want {
+			t.Errorf("DialBuckets(%d, %v) = %d, want %d", test.clients, test.intros, got, test.want)
+		}
+	}
+}